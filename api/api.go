@@ -8,11 +8,16 @@ type API interface {
 	GetNodeInfo() (nodeInfo *NodeInfo, err error)
 	GetUserList() (userList *[]UserInfo, err error)
 	GetIpsList() error
+	GetBannedUsers() (bannedList *[]int, err error)
 	ReportNodeStatus(nodeStatus *NodeStatus) (err error)
 	ReportNodeOnlineUsers(onlineUser *[]OnlineUser) (err error)
 	ReportUserTraffic(userTraffic *[]UserTraffic) (err error)
 	Describe() ClientInfo
 	GetNodeRule() (ruleList *[]DetectRule, err error)
+	GetRoutingRules() (ruleList *[]RoutingRule, err error)
 	ReportIllegal(detectResultList *[]DetectResult) (err error)
+	ReportDeviceHours(deviceHours *[]DeviceHours) (err error)
+	ReportNodeOnline() (err error)
+	ReportNodeOffline() (err error)
 	Debug()
 }
@@ -2,31 +2,93 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"regexp"
+	"strings"
 	"sync"
 
 	"github.com/xtls/xray-core/infra/conf"
 )
 
 const (
-	UserNotModified = "users not modified"
-	NodeNotModified = "node not modified"
-	RuleNotModified = "rules not modified"
+	UserNotModified   = "users not modified"
+	NodeNotModified   = "node not modified"
+	RuleNotModified   = "rules not modified"
+	BannedNotModified = "banned users not modified"
 )
 
+// ErrInvalidNodeConfig is matched by errors.Is for the node configs the panel sent wrong,
+// they fail until fixed in the panel, unlike the network errors
+var ErrInvalidNodeConfig = errors.New("invalid node config")
+
+// NodeConfigError is the error of an invalid node config, with a problem per invalid field
+type NodeConfigError struct {
+	NodeType string
+	Fields   []string // e.g. server_port or tls_settings.private_key
+	Problems []string
+}
+
+func (e *NodeConfigError) Error() string {
+	return fmt.Sprintf("invalid %s node config: %s", e.NodeType, strings.Join(e.Problems, ", "))
+}
+
+func (e *NodeConfigError) Is(target error) bool {
+	return target == ErrInvalidNodeConfig
+}
+
+// Add records a problem of the field
+func (e *NodeConfigError) Add(field string, problem string) {
+	e.Fields = append(e.Fields, field)
+	e.Problems = append(e.Problems, problem)
+}
+
 // Config API config
 type Config struct {
-	APIHost             string  `mapstructure:"ApiHost"`
-	NodeID              int     `mapstructure:"NodeID"`
-	Key                 string  `mapstructure:"ApiKey"`
-	NodeType            string  `mapstructure:"NodeType"`
-	EnableVless         bool    `mapstructure:"EnableVless"`
-	VlessFlow           string  `mapstructure:"VlessFlow"`
-	Timeout             int     `mapstructure:"Timeout"`
-	SpeedLimit          float64 `mapstructure:"SpeedLimit"`
-	DeviceLimit         int     `mapstructure:"DeviceLimit"`
-	RuleListPath        string  `mapstructure:"RuleListPath"`
-	DisableCustomConfig bool    `mapstructure:"DisableCustomConfig"`
+	APIHost                 string            `mapstructure:"ApiHost"`
+	Transport               string            `mapstructure:"Transport"` // rest or grpc
+	NodeID                  int               `mapstructure:"NodeID"`
+	Key                     string            `mapstructure:"ApiKey"`
+	KeyFile                 string            `mapstructure:"KeyFile"`
+	UserAgent               string            `mapstructure:"UserAgent"`
+	ClientCertPath          string            `mapstructure:"ClientCertPath"`
+	ClientKeyPath           string            `mapstructure:"ClientKeyPath"`
+	Endpoints               map[string]string `mapstructure:"Endpoints"` // Key: config, user, push, alive, aips, banned, status, illegal or devicehours, value: path
+	NodeType                string            `mapstructure:"NodeType"`
+	NodeTypeAliases         map[string]string `mapstructure:"NodeTypeAliases"` // Key: panel node type, value: V2ray, Vmess, Vless, Trojan or Shadowsocks
+	EnableVless             bool              `mapstructure:"EnableVless"`
+	VlessFlow               string            `mapstructure:"VlessFlow"`
+	Timeout                 int               `mapstructure:"Timeout"`
+	RetryWaitMin            int               `mapstructure:"RetryWaitMin"` // Millisecond
+	RetryWaitMax            int               `mapstructure:"RetryWaitMax"` // Millisecond
+	RetryJitter             bool              `mapstructure:"RetryJitter"`
+	MaxRetryAfter           int               `mapstructure:"MaxRetryAfter"` // Second
+	SpeedLimit              float64           `mapstructure:"SpeedLimit"`
+	DeviceLimit             int               `mapstructure:"DeviceLimit"`
+	DeviceLimitMultiplier   float64           `mapstructure:"DeviceLimitMultiplier"`
+	RuleListPath            string            `mapstructure:"RuleListPath"`
+	RuleListMaxSize         int64             `mapstructure:"RuleListMaxSize"`         // kB, only for a URL
+	RuleListRefreshInterval int               `mapstructure:"RuleListRefreshInterval"` // Second
+	WatchRuleList           bool              `mapstructure:"WatchRuleList"`
+	DisableCustomConfig     bool              `mapstructure:"DisableCustomConfig"`
+	RuleMaxLength           int               `mapstructure:"RuleMaxLength"`
+	RuleMaxComplexity       int               `mapstructure:"RuleMaxComplexity"`
+	GeoIPPath               string            `mapstructure:"GeoIPPath"`
+	SuppressOnlineIP        bool              `mapstructure:"SuppressOnlineIP"`
+	TrafficMultiplier       float64           `mapstructure:"TrafficMultiplier"`
+	MinReportInterval       int               `mapstructure:"MinReportInterval"` // second
+	MinTrafficReport        int64             `mapstructure:"MinTrafficReport"`  // kB
+	TrafficReportBatchSize  int               `mapstructure:"TrafficReportBatchSize"`
+	CompressTrafficReport   bool              `mapstructure:"CompressTrafficReport"`
+	SigningSecret           string            `mapstructure:"SigningSecret"`
+	FullRefreshInterval     int               `mapstructure:"FullRefreshInterval"`
+	ETagCachePath           string            `mapstructure:"ETagCachePath"`
+	NodeConfigCachePath     string            `mapstructure:"NodeConfigCachePath"`
+	OnlineReportFormat      string            `mapstructure:"OnlineReportFormat"`
+	OnlineReportDelta       bool              `mapstructure:"OnlineReportDelta"`
+	OnlineFullSync          int               `mapstructure:"OnlineFullSync"` // Reports between full snapshots in delta mode
+	LifecycleEndpoint       string            `mapstructure:"LifecycleEndpoint"`
+	ReportVersion           int               `mapstructure:"ReportVersion"` // Shape of the traffic and online reports, 1 or 2, 0 means 1
 }
 
 // NodeStatus Node status
@@ -42,6 +104,8 @@ type NodeInfo struct {
 	Authority           string
 	NodeType            string // Must be V2ray, Trojan, and Shadowsocks
 	NodeID              int
+	Name                string // Readable name of the node, the NodeID if the panel sends none
+	Region              string
 	Port                uint32
 	SpeedLimit          uint64 // Bps
 	AlterID             uint16
@@ -50,6 +114,7 @@ type NodeInfo struct {
 	Host                string
 	Path                string
 	EnableTLS           bool
+	AllowInsecure       bool // The clients may skip the certificate verification, the server side TLS of the node ignores it
 	EnableSniffing      bool
 	RouteOnly           bool
 	EnableVless         bool
@@ -79,18 +144,90 @@ type NodeInfo struct {
 	Security            string
 	Key                 string
 	RejectUnknownSni    bool
+	Transport           *TransportConfig
+	Alpn                []string
+	MinTLSVersion       string // Empty means the xray default
+	MaxTLSVersion       string
+	Fallbacks           []*FallbackConfig
+	SSPorts             []*SSPortConfig
+	TransportTuning     *TransportTuning
+	TCPFastOpen         interface{} // nil for the system default, a bool or a float64 queue length as sockopt.tcpFastOpen
+	Hysteria2Config     *Hysteria2Config
+	TUICConfig          *TUICConfig
+}
+
+// TUICConfig is the QUIC settings of a TUIC node, the ALPN list is NodeInfo.Alpn
+type TUICConfig struct {
+	CongestionControl string // cubic, new_reno or bbr
+	UDPRelayMode      string // native or quic
+	ZeroRTTHandshake  bool
+}
+
+// Hysteria2Config is the bandwidth and obfuscation of a Hysteria2 node
+type Hysteria2Config struct {
+	UpMbps                int    // 0 means unlimited
+	DownMbps              int    // 0 means unlimited
+	IgnoreClientBandwidth bool   // Use the server bandwidth whatever the client asks for
+	Obfs                  string // salamander, empty means disable
+	ObfsPassword          string
+}
+
+// TransportTuning is the buffer tuning sent by the panel, 0 means the xray default
+type TransportTuning struct {
+	KCPMtu              uint32 // mKCP
+	KCPTti              uint32 // mKCP, ms
+	KCPUplinkCapacity   uint32 // mKCP, MB/s
+	KCPDownlinkCapacity uint32 // mKCP, MB/s
+	KCPReadBufferSize   uint32 // mKCP, MB
+	KCPWriteBufferSize  uint32 // mKCP, MB
+	TCPWindowClamp      int32  // Byte
+}
+
+// SSPortConfig is one port of a Shadowsocks node running a cipher per port
+type SSPortConfig struct {
+	Port         uint32
+	CypherMethod string
+	ServerKey    string
+}
+
+// FallbackConfig is a fallback sent by the panel
+type FallbackConfig struct {
+	SNI              string
+	Alpn             string
+	Path             string
+	Dest             string
+	ProxyProtocolVer uint64
+}
+
+// TransportConfig is the parsed transport settings of a node, only the fields of its network are set
+type TransportConfig struct {
+	Network     string          // tcp, ws, grpc, httpupgrade, xhttp
+	Host        string          // ws, httpupgrade, xhttp
+	Path        string          // ws, httpupgrade, xhttp
+	Ed          uint32          // ws early data, read from the "ed" query of path
+	ServiceName string          // grpc
+	MultiMode   bool            // grpc
+	Header      json.RawMessage // tcp
 }
 
 type UserInfo struct {
-	UID         int
-	Email       string
-	UUID        string
-	Passwd      string
-	Port        uint32
-	AlterID     uint16
-	Method      string
-	SpeedLimit  uint64 // Bps
-	DeviceLimit int
+	UID            int
+	Email          string
+	UUID           string
+	Username       string // SOCKS/HTTP account sent by the panel, its password is Passwd
+	Passwd         string
+	Port           uint32
+	AlterID        uint16
+	Method         string
+	SpeedLimit     uint64  // Bps, overrides SpeedLimitMbps when set
+	SpeedLimitMbps float64 // Plan speed limit, converted to Bps by the limiter
+	DeviceLimit    int
+	IdleTimeout    int     // Second
+	PolicyID       int     // Routing policy of the user, 0 means no policy
+	BurstCredit    int64   // Byte, sent above the speed limit before it applies
+	ResetDay       int     // Day of month the traffic of the user resets, 0 means never
+	TrafficQuota   int64   // Byte, the traffic of the user per period from ResetDay, 0 means unlimited
+	MaxUploadRatio float64 // Reject the user while upload exceeds download times this, 0 means disable
 }
 
 type OnlineUser struct {
@@ -110,6 +247,8 @@ type ClientInfo struct {
 	NodeID   int
 	Key      string
 	NodeType string
+	Name     string
+	Region   string
 }
 
 type DetectRule struct {
@@ -117,11 +256,24 @@ type DetectRule struct {
 	Pattern *regexp.Regexp
 }
 
+// RoutingRule sends the traffic to the domains through an outbound configured locally
+type RoutingRule struct {
+	ID          int
+	Domain      []string
+	OutboundTag string
+}
+
 type DetectResult struct {
 	UID    int
 	RuleID int
 }
 
+// DeviceHours is the time a user had devices online, two devices for an hour are two hours
+type DeviceHours struct {
+	UID   int
+	Hours float64
+}
+
 type REALITYConfig struct {
 	Dest             string
 	ProxyProtocolVer uint64
@@ -131,12 +283,19 @@ type REALITYConfig struct {
 	MaxClientVer     string
 	MaxTimeDiff      uint64
 	ShortIds         []string
+	Fingerprint      string // uTLS fingerprint for the clients
+	SpiderX          string // Initial path of the spider for the clients
+	Mldsa65Seed      string // Post-quantum ML-DSA-65 signing seed of the server, optional
+	Mldsa65Verify    string // ML-DSA-65 verify key of the clients, optional
 }
 
 // 用户UUID和其存活的IP地址映射关系的全局变量
 var UserAliveIPsMap *sync.Map
 var PushInterval, PullInterval int
 
+// Version of XrayR reported to the panel, set on start
+var Version string
+
 // 初始化全局变量
 func init() {
 	UserAliveIPsMap = new(sync.Map)
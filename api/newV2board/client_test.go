@@ -0,0 +1,1023 @@
+package newV2board
+
+import (
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) *APIClient {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return New(&api.Config{
+		APIHost:  server.URL,
+		Key:      "qwertyuiopasdfghjkl",
+		NodeID:   1,
+		NodeType: "V2ray",
+	})
+}
+
+func TestUserAgent(t *testing.T) {
+	api.Version = "0.9.5"
+	var userAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.Header.Get("User-Agent")
+		w.Write([]byte(`{"data": true}`))
+	}))
+	t.Cleanup(server.Close)
+
+	for _, test := range []struct {
+		userAgent string
+		expected  string
+	}{
+		{userAgent: "", expected: "XrayR/0.9.5 (node 3)"},
+		{userAgent: "MyNodes/1.0", expected: "MyNodes/1.0 (node 3)"},
+	} {
+		client := New(&api.Config{APIHost: server.URL, Key: "qwertyuiopasdfghjkl", NodeID: 3, NodeType: "V2ray", UserAgent: test.userAgent})
+		assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 1, Download: 1}}))
+		assert.Equal(t, test.expected, userAgent)
+	}
+}
+
+func TestGetBannedUsers(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/server/UniProxy/banned", r.URL.Path)
+		if r.Header.Get("If-None-Match") == "banned-v1" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Etag", "banned-v1")
+		w.Write([]byte(`{"users": [1, 3]}`))
+	})
+
+	bannedList, err := client.GetBannedUsers()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{1, 3}, *bannedList)
+
+	_, err = client.GetBannedUsers()
+	assert.EqualError(t, err, api.BannedNotModified)
+}
+
+func TestGetBannedUsersWithoutEndpoint(t *testing.T) {
+	client := newTestClient(t, http.NotFound)
+
+	bannedList, err := client.GetBannedUsers()
+	assert.NoError(t, err)
+	assert.Empty(t, *bannedList)
+}
+
+func TestGetNodeInfos(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/v1/server/UniProxy/config", r.URL.Path)
+		w.Write([]byte(`[
+			{"node_type": "vless", "server_port": 443, "network": "ws", "networkSettings": {"path": "/ws"}, "tls": 1,
+			 "base_config": {"push_interval": 60, "pull_interval": 60}},
+			{"node_type": "trojan", "server_port": 8443, "server_name": "trojan.test.tk"}
+		]`))
+	})
+
+	nodeInfos, err := client.GetNodeInfos()
+	assert.NoError(t, err)
+	assert.Len(t, nodeInfos, 2)
+	assert.Equal(t, "Vless", nodeInfos[0].NodeType)
+	assert.Equal(t, uint32(443), nodeInfos[0].Port)
+	assert.Equal(t, "ws", nodeInfos[0].TransportProtocol)
+	assert.Equal(t, "Trojan", nodeInfos[1].NodeType)
+	assert.Equal(t, uint32(8443), nodeInfos[1].Port)
+
+	// GetNodeInfo keeps returning the first inbound
+	nodeInfo, err := client.GetNodeInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, nodeInfos[0], nodeInfo)
+}
+
+func TestGetNodeInfoSingleConfig(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"server_port": 443, "network": "tcp"}`))
+	})
+
+	nodeInfos, err := client.GetNodeInfos()
+	assert.NoError(t, err)
+	assert.Len(t, nodeInfos, 1)
+	assert.Equal(t, "V2ray", nodeInfos[0].NodeType)
+}
+
+type fakeResolver map[string]string
+
+func (r fakeResolver) Country(ip string) string {
+	return r[ip]
+}
+
+func TestReportNodeOnlineUsersPayload(t *testing.T) {
+	onlineUsers := &[]api.OnlineUser{{UID: 1, IP: "1.1.1.1"}, {UID: 1, IP: "8.8.8.8"}, {UID: 2, IP: ""}}
+	testCases := []struct {
+		desc     string
+		geoIP    countryResolver
+		suppress bool
+		expected string
+	}{
+		{
+			desc:     "plain",
+			expected: `{"1":["1.1.1.1","8.8.8.8"],"2":[""]}`,
+		},
+		{
+			desc:     "annotated",
+			geoIP:    fakeResolver{"1.1.1.1": "AU", "8.8.8.8": "US"},
+			expected: `{"1":[{"ip":"1.1.1.1","cc":"AU"},{"ip":"8.8.8.8","cc":"US"}],"2":[{}]}`,
+		},
+		{
+			desc:     "suppressed",
+			geoIP:    fakeResolver{"1.1.1.1": "AU", "8.8.8.8": "US"},
+			suppress: true,
+			expected: `{"1":[{"cc":"AU"},{"cc":"US"}],"2":[{}]}`,
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			var body []byte
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/api/v1/server/UniProxy/alive", r.URL.Path)
+				body, _ = io.ReadAll(r.Body)
+				w.Write([]byte(`{"data": true}`))
+			})
+			client.geoIP = test.geoIP
+			client.SuppressOnlineIP = test.suppress
+
+			assert.NoError(t, client.ReportNodeOnlineUsers(onlineUsers))
+			assert.JSONEq(t, test.expected, string(body))
+		})
+	}
+}
+
+func TestReportUserTrafficMultiplier(t *testing.T) {
+	testCases := []struct {
+		multiplier float64
+		expected   string
+	}{
+		{multiplier: 0, expected: `{"1":[101,2000],"2":[0,1]}`},
+		{multiplier: 0.5, expected: `{"1":[51,1000],"2":[0,1]}`},
+		{multiplier: 2, expected: `{"1":[202,4000],"2":[0,2]}`},
+	}
+
+	for _, test := range testCases {
+		t.Run(fmt.Sprint(test.multiplier), func(t *testing.T) {
+			var body []byte
+			client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/api/v1/server/UniProxy/push", r.URL.Path)
+				body, _ = io.ReadAll(r.Body)
+				w.Write([]byte(`{"data": true}`))
+			})
+			client.TrafficMultiplier = test.multiplier
+
+			assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{
+				{UID: 1, Upload: 101, Download: 2000},
+				{UID: 2, Upload: 0, Download: 1},
+			}))
+			assert.JSONEq(t, test.expected, string(body))
+		})
+	}
+}
+
+func TestDeviceLimitMultiplier(t *testing.T) {
+	testCases := []struct {
+		multiplier float64
+		expected   []int
+	}{
+		{multiplier: 1, expected: []int{0, 1, 3}},
+		{multiplier: 2, expected: []int{0, 2, 6}},
+		{multiplier: 0.5, expected: []int{0, 1, 1}},
+	}
+
+	for _, test := range testCases {
+		t.Run(fmt.Sprint(test.multiplier), func(t *testing.T) {
+			doer := &mockDoer{responses: []*httpResponse{
+				mockResponse(http.StatusOK, "", `{"users": [{"id": 1, "uuid": "a"}, {"id": 2, "uuid": "b", "device_limit": 1}, {"id": 3, "uuid": "c", "device_limit": 3}]}`),
+			}}
+			client := newMockClient(doer)
+			client.DeviceMultiplier = test.multiplier
+
+			users, err := client.GetUserList()
+			assert.NoError(t, err)
+			var limits []int
+			for _, u := range *users {
+				limits = append(limits, u.DeviceLimit)
+			}
+			// Unlimited stays unlimited
+			assert.Equal(t, test.expected, limits)
+		})
+	}
+}
+
+func TestPauseReporting(t *testing.T) {
+	var (
+		pushed  []string
+		online  int
+		failing bool
+	)
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/server/UniProxy/push":
+			if failing {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			body, _ := io.ReadAll(r.Body)
+			pushed = append(pushed, string(body))
+		case "/api/v1/server/UniProxy/alive":
+			online++
+		}
+		w.Write([]byte(`{"data": true}`))
+	})
+	client.client.SetRetryCount(0)
+
+	client.PauseReporting()
+	assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 100, Download: 200}}))
+	assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 10, Download: 20}, {UID: 2, Upload: 1, Download: 2}}))
+	assert.NoError(t, client.ReportNodeOnlineUsers(&[]api.OnlineUser{{UID: 1, IP: "1.1.1.1"}}))
+	assert.Empty(t, pushed)
+	assert.Zero(t, online)
+
+	// The kept traffic survives a failed flush
+	failing = true
+	assert.Error(t, client.ResumeReporting())
+	failing = false
+
+	assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 3, Upload: 5, Download: 5}}))
+	assert.Len(t, pushed, 1)
+	assert.JSONEq(t, `{"1":[110,220],"2":[1,2],"3":[5,5]}`, pushed[0])
+
+	// Nothing left to flush
+	assert.NoError(t, client.ResumeReporting())
+	assert.Len(t, pushed, 1)
+
+	client.PauseReporting()
+	assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 1, Download: 1}}))
+	assert.NoError(t, client.ResumeReporting())
+	assert.Len(t, pushed, 2)
+	assert.JSONEq(t, `{"1":[1,1]}`, pushed[1])
+}
+
+func TestMinReportInterval(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		pushed []string
+	)
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		pushed = append(pushed, string(body))
+		mu.Unlock()
+		w.Write([]byte(`{"data": true}`))
+	})
+	client.MinReportInterval = 200 * time.Millisecond
+	countPushed := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(pushed)
+	}
+
+	// The first report opens the interval
+	assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 1, Download: 1}}))
+	assert.Equal(t, 1, countPushed())
+
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 10, Download: 20}, {UID: i + 2, Upload: 1, Download: 1}}))
+	}
+	assert.Equal(t, 1, countPushed())
+
+	assert.Eventually(t, func() bool { return countPushed() == 2 }, time.Second, 10*time.Millisecond)
+	assert.JSONEq(t, `{"1":[30,60],"2":[1,1],"3":[1,1],"4":[1,1]}`, pushed[1])
+}
+
+func TestSigningSecret(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get("X-Timestamp")
+		assert.NotEmpty(t, timestamp)
+
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(r.Method + "\n" + r.URL.Path + "\n" + timestamp + "\n" + string(body)))
+		assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), r.Header.Get("X-Signature"))
+		w.Write([]byte(`{"data": true}`))
+	}))
+	t.Cleanup(server.Close)
+	client := New(&api.Config{
+		APIHost:       server.URL,
+		Key:           "qwertyuiopasdfghjkl",
+		NodeID:        1,
+		NodeType:      "V2ray",
+		SigningSecret: "secret",
+	})
+
+	assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 1, Download: 1}}))
+	_, err := client.GetBannedUsers()
+	assert.NoError(t, err)
+}
+
+func TestSignRequest(t *testing.T) {
+	req, _ := http.NewRequest(http.MethodPost, "http://panel.test/api/v1/server/UniProxy/push?token=abc", strings.NewReader(`{"1":[1,1]}`))
+	assert.NoError(t, signRequest(req, []byte("secret"), time.Unix(1700000000, 0)))
+	assert.Equal(t, "1700000000", req.Header.Get("X-Timestamp"))
+
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte("POST\n/api/v1/server/UniProxy/push\n1700000000\n" + `{"1":[1,1]}`))
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), req.Header.Get("X-Signature"))
+
+	// The body is still readable
+	body, _ := io.ReadAll(req.Body)
+	assert.Equal(t, `{"1":[1,1]}`, string(body))
+}
+
+func TestFullRefreshInterval(t *testing.T) {
+	var ifNoneMatch []string
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch = append(ifNoneMatch, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == "banned-v1" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Etag", "banned-v1")
+		w.Write([]byte(`{"users": []}`))
+	})
+	client.FullRefresh = 3
+	client.pullCounts["banned"] = 0 // No jitter
+
+	for i := 0; i < 6; i++ {
+		client.GetBannedUsers()
+	}
+	assert.Equal(t, []string{"", "banned-v1", "", "banned-v1", "banned-v1", ""}, ifNoneMatch)
+}
+
+func TestOnlineReportByIP(t *testing.T) {
+	// 1000 users behind 3 CGNAT IPs
+	var onlineUsers []api.OnlineUser
+	for uid := 1; uid <= 1000; uid++ {
+		onlineUsers = append(onlineUsers, api.OnlineUser{UID: uid, IP: fmt.Sprintf("100.64.0.%d", uid%3)})
+	}
+
+	client := newParseClient("V2ray")
+	byUID, _ := json.Marshal(client.buildOnlineData(&onlineUsers))
+	client.OnlineByIP = true
+	byIP, _ := json.Marshal(client.buildOnlineData(&onlineUsers))
+	assert.Less(t, len(byIP)*2, len(byUID))
+
+	data := make(map[string][]int)
+	assert.NoError(t, json.Unmarshal(byIP, &data))
+	assert.Len(t, data, 3)
+	assert.Len(t, data["100.64.0.1"], 334)
+
+	// Suppressed IPs can not be keys
+	client.SuppressOnlineIP = true
+	_, ok := client.buildOnlineData(&onlineUsers).(map[int][]onlineDevice)
+	assert.True(t, ok)
+}
+
+func TestGetNodeInfoNotModifiedWithoutCache(t *testing.T) {
+	var ifNoneMatch []string
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		ifNoneMatch = append(ifNoneMatch, r.Header.Get("If-None-Match"))
+		if r.Header.Get("If-None-Match") == "node-v1" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Etag", "node-v1")
+		w.Write([]byte(`{"server_port": 443, "network": "tcp"}`))
+	})
+	// The ETag survived but the parsed config did not
+	client.eTags["node"] = "node-v1"
+
+	nodeInfo, err := client.GetNodeInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(443), nodeInfo.Port)
+	assert.Equal(t, []string{"node-v1", ""}, ifNoneMatch)
+
+	// Once cached, a 304 is trusted
+	_, err = client.GetNodeInfo()
+	assert.EqualError(t, err, api.NodeNotModified)
+	assert.Len(t, ifNoneMatch, 3)
+}
+
+func TestConcurrentPulls(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/user") {
+			w.Header().Set("Etag", "users-v1")
+			w.Write([]byte(`{"users": [{"id": 1, "uuid": "a"}]}`))
+			return
+		}
+		w.Header().Set("Etag", "node-v1")
+		w.Write([]byte(`{"server_port": 443, "network": "tcp"}`))
+	})
+	client.FullRefresh = 3
+
+	// e.g. a forced refresh pulls the node and the users at once
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			client.GetNodeInfo()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			client.GetUserList()
+		}
+	}()
+	wg.Wait()
+	assert.Equal(t, "node-v1", client.getETag("node"))
+	assert.Equal(t, "users-v1", client.getETag("users"))
+}
+
+func TestMinTrafficReport(t *testing.T) {
+	var pushed []string
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		pushed = append(pushed, string(body))
+		w.Write([]byte(`{"data": true}`))
+	})
+	client.MinTrafficReport = 1024
+
+	// Nobody reaches the threshold, nothing is sent
+	assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 300, Download: 300}, {UID: 2, Upload: 10, Download: 10}}))
+	assert.Empty(t, pushed)
+
+	// User 1 accumulates past the threshold, user 2 is still carried
+	assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 200, Download: 300}, {UID: 3, Upload: 2048}}))
+	assert.Len(t, pushed, 1)
+	assert.JSONEq(t, `{"1":[500,600],"3":[2048,0]}`, pushed[0])
+
+	assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 2, Upload: 1000, Download: 4}}))
+	assert.Len(t, pushed, 2)
+	assert.JSONEq(t, `{"2":[1010,14]}`, pushed[1])
+	assert.Empty(t, client.pendingTraffic)
+}
+
+func TestCustomEndpoints(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		switch r.URL.Path {
+		case "/fork/node":
+			w.Write([]byte(`{"server_port": 443, "network": "tcp"}`))
+		case "/fork/users", "/fork/ips":
+			w.Write([]byte(`{"users": [{"id": 1, "uuid": "a", "alive_ips": ["1.1.1.1"]}]}`))
+		case "/fork/traffic", "/fork/online":
+			w.Write([]byte(`{"data": true}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	client := New(&api.Config{
+		APIHost:  server.URL,
+		Key:      "qwertyuiopasdfghjkl",
+		NodeID:   1,
+		NodeType: "V2ray",
+		Endpoints: map[string]string{
+			"config": "/fork/node",
+			"user":   "/fork/users",
+			"push":   "/fork/traffic",
+			"alive":  "/fork/online",
+			"aips":   "/fork/ips",
+		},
+	})
+
+	_, err := client.GetNodeInfo()
+	assert.NoError(t, err)
+	_, err = client.GetUserList()
+	assert.NoError(t, err)
+	assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 1, Download: 1}}))
+	assert.NoError(t, client.ReportNodeOnlineUsers(&[]api.OnlineUser{{UID: 1, IP: "1.1.1.1"}}))
+	assert.NoError(t, client.GetIpsList())
+	// banned is not overridden
+	_, err = client.GetBannedUsers()
+	assert.NoError(t, err)
+
+	assert.Equal(t, []string{"/fork/node", "/fork/users", "/fork/traffic", "/fork/online", "/fork/ips", "/api/v1/server/UniProxy/banned"}, paths)
+}
+
+// writeClientCert writes a self-signed client certificate and its key to dir
+func writeClientCert(t *testing.T, dir string) (certPath string, keyPath string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "node1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ = x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+
+	certPath = filepath.Join(dir, "client.crt")
+	keyPath = filepath.Join(dir, "client.key")
+	os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600)
+	return certPath, keyPath, cert
+}
+
+func TestClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath, cert := writeClientCert(t, dir)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "node1", r.TLS.PeerCertificates[0].Subject.CommonName)
+		w.Write([]byte(`{"server_port": 443, "network": "tcp"}`))
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(cert)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	serverCert := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}))
+
+	newClient := func(certPath string, keyPath string) *APIClient {
+		client := New(&api.Config{APIHost: server.URL, Key: "qwertyuiopasdfghjkl", NodeID: 1, NodeType: "V2ray",
+			ClientCertPath: certPath, ClientKeyPath: keyPath})
+		client.client.SetRootCertificateFromString(serverCert)
+		client.client.SetRetryCount(0)
+		return client
+	}
+
+	_, err := newClient(certPath, keyPath).GetNodeInfo()
+	assert.NoError(t, err)
+
+	// The panel refuses a client without certificate
+	_, err = newClient("", "").GetNodeInfo()
+	assert.Error(t, err)
+
+	// An invalid pair fails on start
+	assert.Panics(t, func() { newClient(certPath, certPath) })
+}
+
+func TestNodeTypeAliases(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "vmess", r.URL.Query().Get("node_type"))
+		switch r.URL.Path {
+		case "/api/v1/server/UniProxy/config":
+			w.Write([]byte(`{"node_type": "VMESS_WS", "server_port": 443, "network": "ws"}`))
+		case "/api/v1/server/UniProxy/user":
+			w.Write([]byte(`{"users": [{"id": 1, "uuid": "a"}]}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	client := New(&api.Config{
+		APIHost:         server.URL,
+		Key:             "qwertyuiopasdfghjkl",
+		NodeID:          1,
+		NodeType:        "VMESS_WS",
+		NodeTypeAliases: map[string]string{"vmess_ws": "Vmess"},
+	})
+	assert.Equal(t, "Vmess", client.Describe().NodeType)
+
+	nodeInfo, err := client.GetNodeInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, "Vmess", nodeInfo.NodeType)
+	users, err := client.GetUserList()
+	assert.NoError(t, err)
+	assert.Len(t, *users, 1)
+}
+
+func TestRetryBackoff(t *testing.T) {
+	min, max := 100*time.Millisecond, time.Second
+	assert.Equal(t, 100*time.Millisecond, retryBackoff(min, max, 1))
+	assert.Equal(t, 200*time.Millisecond, retryBackoff(min, max, 2))
+	assert.Equal(t, 800*time.Millisecond, retryBackoff(min, max, 4))
+	assert.Equal(t, time.Second, retryBackoff(min, max, 10))
+
+	client := New(&api.Config{APIHost: "http://panel.test", Key: "qwertyuiopasdfghjkl", NodeID: 1, NodeType: "V2ray",
+		RetryWaitMin: 100, RetryWaitMax: 1000, RetryJitter: true})
+	rc := client.doer.(*restyDoer).client
+	assert.Equal(t, min, rc.RetryWaitTime)
+	assert.Equal(t, max, rc.RetryMaxWaitTime)
+	assert.NotNil(t, rc.RetryAfter)
+
+	// The waits of the nodes spread over the backoff
+	res := &resty.Response{Request: rc.R()}
+	res.Request.Attempt = 2
+	waits := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		wait, err := retryJitter(rc, res)
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, wait, min)
+		assert.LessOrEqual(t, wait, 200*time.Millisecond)
+		waits[wait] = true
+	}
+	assert.Greater(t, len(waits), 1)
+
+	// They still spread once the backoff reached the max, and never go over it
+	res.Request.Attempt = 30
+	waits = make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		wait, err := retryJitter(rc, res)
+		assert.NoError(t, err)
+		assert.GreaterOrEqual(t, wait, min)
+		assert.LessOrEqual(t, wait, max)
+		waits[wait] = true
+	}
+	assert.Greater(t, len(waits), 1)
+
+	// resty defaults without the settings
+	client = New(&api.Config{APIHost: "http://panel.test", Key: "qwertyuiopasdfghjkl", NodeID: 1, NodeType: "V2ray"})
+	rc = client.doer.(*restyDoer).client
+	assert.Equal(t, resty.New().RetryWaitTime, rc.RetryWaitTime)
+	assert.Equal(t, resty.New().RetryMaxWaitTime, rc.RetryMaxWaitTime)
+	wait, err := rc.RetryAfter(rc, res)
+	assert.NoError(t, err)
+	assert.Zero(t, wait)
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	response := func(statusCode int, retryAfter string) *resty.Response {
+		header := make(http.Header)
+		if retryAfter != "" {
+			header.Set("Retry-After", retryAfter)
+		}
+		return &resty.Response{RawResponse: &http.Response{StatusCode: statusCode, Header: header}}
+	}
+	testCases := []struct {
+		res  *resty.Response
+		wait time.Duration
+		ok   bool
+	}{
+		{response(http.StatusTooManyRequests, "3"), 3 * time.Second, true},
+		{response(http.StatusTooManyRequests, now.Add(90*time.Second).Format(http.TimeFormat)), 90 * time.Second, true},
+		{response(http.StatusTooManyRequests, now.Add(-time.Minute).Format(http.TimeFormat)), 0, true},
+		{response(http.StatusTooManyRequests, "soon"), 0, false},
+		{response(http.StatusTooManyRequests, ""), 0, false},
+		{response(http.StatusServiceUnavailable, "3"), 0, false},
+		{nil, 0, false},
+	}
+	for i, c := range testCases {
+		wait, ok := retryAfter(c.res, now)
+		assert.Equal(t, c.wait, wait, i)
+		assert.Equal(t, c.ok, ok, i)
+	}
+}
+
+func TestRetryTooManyRequests(t *testing.T) {
+	var requests int
+	var retryAfter string
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.Header().Set("Retry-After", retryAfter)
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"users": [{"id": 1, "uuid": "a"}]}`))
+	})
+
+	// Retried once the wait is over
+	retryAfter = "1"
+	start := time.Now()
+	users, err := client.GetUserList()
+	assert.NoError(t, err)
+	assert.Len(t, *users, 1)
+	assert.Equal(t, 2, requests)
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+
+	// A wait longer than the max is not cut short
+	requests = 0
+	retryAfter = "3600"
+	_, err = client.GetUserList()
+	assert.Error(t, err)
+	assert.Equal(t, 1, requests)
+
+	// Without the header, the default backoff
+	requests = 0
+	retryAfter = ""
+	_, err = client.GetUserList()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests)
+
+	// A wait longer than RetryWaitMax is waited out in full
+	client.doer.(*restyDoer).client.SetRetryMaxWaitTime(100 * time.Millisecond)
+	requests = 0
+	retryAfter = "2"
+	start = time.Now()
+	_, err = client.GetUserList()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, requests)
+	assert.GreaterOrEqual(t, time.Since(start), 2*time.Second)
+}
+
+func TestETagCache(t *testing.T) {
+	var notModified int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		eTag, body := "node-v1", `{"server_port": 443, "network": "tcp"}`
+		if strings.HasSuffix(r.URL.Path, "/user") {
+			eTag, body = "users-v1", `{"users": [{"id": 1, "uuid": "a"}]}`
+		}
+		if r.Header.Get("If-None-Match") == eTag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Etag", eTag)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	apiConfig := &api.Config{APIHost: server.URL, Key: "qwertyuiopasdfghjkl", NodeID: 1, NodeType: "V2ray",
+		ETagCachePath: filepath.Join(t.TempDir(), "etag-cache.json")}
+
+	client := New(apiConfig)
+	_, err := client.GetNodeInfo()
+	assert.NoError(t, err)
+	_, err = client.GetUserList()
+	assert.NoError(t, err)
+	assert.Zero(t, notModified)
+	// The users hold their credentials, only the owner may read them
+	info, err := os.Stat(apiConfig.ETagCachePath)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	// After a restart, nothing changed
+	client = New(apiConfig)
+	nodeInfo, err := client.GetNodeInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(443), nodeInfo.Port)
+	users, err := client.GetUserList()
+	assert.NoError(t, err)
+	assert.Len(t, *users, 1)
+	assert.Equal(t, 2, notModified)
+
+	// Then as usual
+	_, err = client.GetNodeInfo()
+	assert.EqualError(t, err, api.NodeNotModified)
+	_, err = client.GetUserList()
+	assert.EqualError(t, err, api.UserNotModified)
+
+	// A broken file is a cold start
+	assert.NoError(t, os.WriteFile(apiConfig.ETagCachePath, []byte("{"), 0o600))
+	client = New(apiConfig)
+	_, err = client.GetUserList()
+	assert.NoError(t, err)
+	assert.Equal(t, 4, notModified)
+}
+
+func TestCompressTrafficReport(t *testing.T) {
+	type request struct {
+		encoding string
+		body     string
+	}
+	var requests []request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := request{encoding: r.Header.Get("Content-Encoding")}
+		body := io.Reader(r.Body)
+		if req.encoding == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if !assert.NoError(t, err) {
+				return
+			}
+			body = zr
+		}
+		b, _ := io.ReadAll(body)
+		req.body = string(b)
+		requests = append(requests, req)
+		w.Write([]byte(`{"data": true}`))
+	}))
+	t.Cleanup(server.Close)
+	client := New(&api.Config{APIHost: server.URL, Key: "qwertyuiopasdfghjkl", NodeID: 1, NodeType: "V2ray", CompressTrafficReport: true})
+
+	assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 100, Download: 200}}))
+	assert.NoError(t, client.ReportNodeOnlineUsers(&[]api.OnlineUser{{UID: 1, IP: "1.1.1.1"}}))
+	assert.Equal(t, "gzip", requests[0].encoding)
+	assert.JSONEq(t, `{"1": [100, 200]}`, requests[0].body)
+	assert.Equal(t, "gzip", requests[1].encoding)
+	assert.JSONEq(t, `{"1": ["1.1.1.1"]}`, requests[1].body)
+
+	// Plain by default
+	client = New(&api.Config{APIHost: server.URL, Key: "qwertyuiopasdfghjkl", NodeID: 1, NodeType: "V2ray"})
+	assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 100, Download: 200}}))
+	assert.Empty(t, requests[2].encoding)
+	assert.JSONEq(t, `{"1": [100, 200]}`, requests[2].body)
+}
+
+func TestRequestMetrics(t *testing.T) {
+	SetMetricsEnabled(true)
+	t.Cleanup(func() { SetMetricsEnabled(false) })
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sub/api/v1/server/UniProxy/user":
+			if r.Header.Get("If-None-Match") != "" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", "users-v1")
+			w.Write([]byte(`{"users": [{"id": 1, "uuid": "a"}]}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	t.Cleanup(server.Close)
+	client := New(&api.Config{APIHost: server.URL + "/sub", Key: "key", NodeID: 7, NodeType: "Trojan"})
+
+	_, err := client.GetUserList()
+	assert.NoError(t, err)
+	_, err = client.GetUserList()
+	assert.EqualError(t, err, api.UserNotModified)
+	assert.Error(t, client.ReportNodeStatus(&api.NodeStatus{}))
+
+	users := []string{"7", "Trojan", "GetUserList"}
+	assert.Equal(t, 2.0, testutil.ToFloat64(apiMetrics.calls.WithLabelValues(users...)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(apiMetrics.notModified.WithLabelValues(users...)))
+	assert.Zero(t, testutil.ToFloat64(apiMetrics.errors.WithLabelValues(users...)))
+	status := []string{"7", "Trojan", "ReportNodeStatus"}
+	assert.Equal(t, 1.0, testutil.ToFloat64(apiMetrics.calls.WithLabelValues(status...)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(apiMetrics.errors.WithLabelValues(status...)))
+
+	// A panel that is down has no latency
+	server.Close()
+	_, err = client.GetUserList()
+	assert.Error(t, err)
+	assert.Equal(t, 3.0, testutil.ToFloat64(apiMetrics.calls.WithLabelValues(users...)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(apiMetrics.errors.WithLabelValues(users...)))
+
+	res := httptest.NewRecorder()
+	MetricsHandler().ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Contains(t, res.Body.String(), `xrayr_api_request_duration_seconds_count{endpoint="GetUserList",node_id="7",node_type="Trojan"} 2`)
+}
+
+func TestNodeConfigCache(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+		w.Write([]byte(`{"server_port": 443, "network": "tcp", "base_config": {"push_interval": 60, "pull_interval": 60}}`))
+	}))
+	t.Cleanup(server.Close)
+	apiConfig := &api.Config{APIHost: server.URL, Key: "qwertyuiopasdfghjkl", NodeID: 1, NodeType: "V2ray",
+		NodeConfigCachePath: filepath.Join(t.TempDir(), "node-config.json")}
+
+	// Nothing cached yet
+	status.Store(http.StatusBadGateway)
+	_, err := New(apiConfig).GetNodeInfo()
+	assert.Error(t, err)
+
+	status.Store(http.StatusOK)
+	_, err = New(apiConfig).GetNodeInfo()
+	assert.NoError(t, err)
+
+	status.Store(http.StatusBadGateway)
+	client := New(apiConfig)
+	nodeInfo, err := client.GetNodeInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(443), nodeInfo.Port)
+	assert.NotNil(t, client.resp.Load())
+
+	// A 4xx is an answer of the panel
+	status.Store(http.StatusForbidden)
+	_, err = New(apiConfig).GetNodeInfo()
+	assert.Error(t, err)
+
+	server.Close()
+	nodeInfo, err = New(apiConfig).GetNodeInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(443), nodeInfo.Port)
+
+	// Only without a config in use
+	_, err = client.GetNodeInfo()
+	assert.Error(t, err)
+}
+
+func TestRemoteRuleList(t *testing.T) {
+	var rules atomic.Value
+	rules.Store("baidu.com\nqq.com\n")
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		// The panel credentials stay with the panel
+		assert.Empty(t, r.URL.Query().Get("token"))
+		assert.Contains(t, r.Header.Get("User-Agent"), "(node 1)")
+		body := rules.Load().(string)
+		eTag := fmt.Sprintf("%x", sha256.Sum256([]byte(body)))
+		if r.Header.Get("If-None-Match") == eTag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if body == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Etag", eTag)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	client := New(&api.Config{APIHost: server.URL, Key: "qwertyuiopasdfghjkl", NodeID: 1, NodeType: "V2ray",
+		RuleListPath: server.URL + "/rulelist", RuleListRefreshInterval: 3600})
+	t.Cleanup(func() { client.Close() })
+	client.resp.Store(&serverConfig{})
+	ruleCount := func() int {
+		ruleList, err := client.GetNodeRule()
+		assert.NoError(t, err)
+		return len(*ruleList)
+	}
+
+	// Fetched in the background
+	assert.Eventually(t, func() bool { return ruleCount() == 2 }, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, int32(1), fetches.Load())
+
+	// Cached until the next refresh, a bad line is skipped
+	rules.Store("baidu.com\nqq.com\n(\ngoogle.com\n")
+	assert.Equal(t, 2, ruleCount())
+	assert.NoError(t, client.remoteRuleList.fetch())
+	assert.Equal(t, 3, ruleCount())
+	assert.Equal(t, int32(2), fetches.Load())
+
+	// Unchanged, or a failed fetch, keeps the last list
+	assert.NoError(t, client.remoteRuleList.fetch())
+	assert.Equal(t, 3, ruleCount())
+	rules.Store("")
+	assert.Error(t, client.remoteRuleList.fetch())
+	assert.Equal(t, 3, ruleCount())
+	assert.Equal(t, int32(4), fetches.Load())
+}
+
+func TestRemoteRuleListRefresh(t *testing.T) {
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Write([]byte("baidu.com\n"))
+	}))
+	t.Cleanup(server.Close)
+	r := newRemoteRuleList(server.URL, resty.New(), 50*time.Millisecond, 0)
+	assert.Eventually(t, func() bool { return fetches.Load() >= 3 }, 5*time.Second, 10*time.Millisecond)
+	assert.Len(t, r.get(), 1)
+
+	r.close()
+	time.Sleep(100 * time.Millisecond)
+	stopped := fetches.Load()
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, stopped, fetches.Load())
+}
+
+func TestWatchLocalRuleList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rulelist")
+	assert.NoError(t, os.WriteFile(path, []byte("baidu.com\n"), 0o600))
+	client := New(&api.Config{APIHost: "http://127.0.0.1", Key: "qwertyuiopasdfghjkl", NodeID: 1, NodeType: "V2ray",
+		RuleListPath: path, WatchRuleList: true})
+	t.Cleanup(func() { client.Close() })
+	client.resp.Store(&serverConfig{})
+	ruleCount := func() int {
+		ruleList, err := client.GetNodeRule()
+		assert.NoError(t, err)
+		return len(*ruleList)
+	}
+	assert.Equal(t, 1, ruleCount())
+
+	assert.NoError(t, os.WriteFile(path, []byte("baidu.com\nqq.com\n"), 0o600))
+	assert.Eventually(t, func() bool { return ruleCount() == 2 }, 5*time.Second, 50*time.Millisecond)
+
+	// Replaced by an editor
+	tmp := path + ".tmp"
+	assert.NoError(t, os.WriteFile(tmp, []byte("baidu.com\nqq.com\ngoogle.com\n"), 0o600))
+	assert.NoError(t, os.Rename(tmp, path))
+	assert.Eventually(t, func() bool { return ruleCount() == 3 }, 5*time.Second, 50*time.Millisecond)
+
+	// A broken list keeps the current rules
+	assert.NoError(t, os.WriteFile(path, []byte(strings.Repeat("a", 128*1024)+"\n"), 0o600))
+	assert.Error(t, client.ReloadLocalRuleList())
+	assert.Equal(t, 3, ruleCount())
+
+	assert.NoError(t, client.Close())
+	assert.Error(t, New(&api.Config{APIHost: "http://127.0.0.1", NodeID: 1, NodeType: "V2ray"}).ReloadLocalRuleList())
+}
@@ -0,0 +1,88 @@
+package newV2board
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// httpResponse is the part of a panel response the client reads
+type httpResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// httpDoer sends a request to the panel. The resty client is the default one, tests may inject a mock.
+// The response is not nil even with an error, its StatusCode is 0 when nothing was received.
+type httpDoer interface {
+	Do(method string, path string, header map[string]string, body any) (*httpResponse, error)
+	SetToken(token string) // Sends the panel key from now on
+}
+
+// semaphore caps the requests in flight
+type semaphore chan struct{}
+
+// acquire waits for a free slot until the context is done
+func (s semaphore) acquire(ctx context.Context) error {
+	select {
+	case s <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s semaphore) release() {
+	<-s
+}
+
+// requestSem is shared by all the clients, so the nodes of a process do not hit the panel at once. nil means no cap.
+var requestSem semaphore
+
+// SetMaxConcurrentRequests caps the requests to the panel in flight at once across all clients, 0 means no cap.
+// It must be called before any client starts.
+func SetMaxConcurrentRequests(n int) {
+	if n > 0 {
+		requestSem = make(semaphore, n)
+	} else {
+		requestSem = nil
+	}
+}
+
+// restyDoer sends the requests with a resty client
+type restyDoer struct {
+	client *resty.Client
+}
+
+func (d *restyDoer) SetToken(token string) {
+	d.client.SetQueryParam("token", token)
+}
+
+func (d *restyDoer) Do(method string, path string, header map[string]string, body any) (*httpResponse, error) {
+	req := d.client.R().SetHeaders(header).ForceContentType("application/json")
+	if body != nil {
+		req.SetBody(body)
+	}
+	// Wait for a slot no longer than a request may take
+	if sem := requestSem; sem != nil {
+		timeout := d.client.GetClient().Timeout
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := sem.acquire(ctx); err != nil {
+			return &httpResponse{}, fmt.Errorf("wait for a request slot failed: %w", err)
+		}
+		defer sem.release()
+	}
+	res, err := req.Execute(method, path)
+	if res == nil {
+		return &httpResponse{}, err
+	}
+	return &httpResponse{StatusCode: res.StatusCode(), Header: res.Header(), Body: res.Body()}, err
+}
@@ -0,0 +1,581 @@
+package newV2board
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+type mockRequest struct {
+	method string
+	path   string
+	header map[string]string
+	body   any
+}
+
+// mockDoer records the requests and answers them with canned responses
+type mockDoer struct {
+	requests  []mockRequest
+	responses []*httpResponse
+	err       error
+	token     string
+}
+
+func (m *mockDoer) SetToken(token string) {
+	m.token = token
+}
+
+func (m *mockDoer) Do(method string, path string, header map[string]string, body any) (*httpResponse, error) {
+	m.requests = append(m.requests, mockRequest{method: method, path: path, header: header, body: body})
+	if m.err != nil {
+		return &httpResponse{}, m.err
+	}
+	res := m.responses[0]
+	m.responses = m.responses[1:]
+	return res, nil
+}
+
+func newMockClient(doer *mockDoer) *APIClient {
+	return &APIClient{NodeID: 1, NodeType: "V2ray", doer: doer, eTags: make(map[string]string)}
+}
+
+func mockResponse(statusCode int, eTag string, body string) *httpResponse {
+	header := make(http.Header)
+	if eTag != "" {
+		header.Set("Etag", eTag)
+	}
+	return &httpResponse{StatusCode: statusCode, Header: header, Body: []byte(body)}
+}
+
+func TestMockGetNodeInfo(t *testing.T) {
+	doer := &mockDoer{responses: []*httpResponse{
+		mockResponse(http.StatusOK, "node-v1", `{"server_port": 443, "network": "tcp"}`),
+		mockResponse(http.StatusNotModified, "", ""),
+	}}
+	client := newMockClient(doer)
+
+	nodeInfo, err := client.GetNodeInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(443), nodeInfo.Port)
+	assert.Equal(t, "node-v1", client.eTags["node"])
+
+	_, err = client.GetNodeInfo()
+	assert.EqualError(t, err, api.NodeNotModified)
+	assert.Equal(t, "node-v1", doer.requests[1].header["If-None-Match"])
+
+	doer.err = errors.New("connection refused")
+	_, err = client.GetNodeInfo()
+	assert.ErrorContains(t, err, "connection refused")
+}
+
+func TestGetNodeInfoZeroPort(t *testing.T) {
+	doer := &mockDoer{responses: []*httpResponse{
+		mockResponse(http.StatusOK, "", `{"server_port": 0, "network": "tcp"}`),
+	}}
+	client := newMockClient(doer)
+
+	_, err := client.GetNodeInfo()
+	assert.ErrorIs(t, err, api.ErrInvalidNodeConfig)
+	var configErr *api.NodeConfigError
+	assert.ErrorAs(t, err, &configErr)
+	assert.Equal(t, []string{"server_port"}, configErr.Fields)
+
+	// A network error is not
+	doer.err = errors.New("connection refused")
+	_, err = client.GetNodeInfo()
+	assert.NotErrorIs(t, err, api.ErrInvalidNodeConfig)
+}
+
+func TestGetNodeInfoREALITYMissingKey(t *testing.T) {
+	doer := &mockDoer{responses: []*httpResponse{
+		mockResponse(http.StatusOK, "", `{"server_port": 443, "network": "tcp", "tls": 2, "tls_settings": {"server_name": "www.example.com", "private_key": ""}}`),
+		mockResponse(http.StatusOK, "", `{"server_port": 443, "network": "tcp", "tls": 2, "tls_settings": {"dest": "www.example.com", "private_key": "key"}}`),
+	}}
+	client := newMockClient(doer)
+	client.NodeType = "Vless"
+
+	_, err := client.GetNodeInfo()
+	assert.ErrorIs(t, err, api.ErrInvalidNodeConfig)
+	assert.ErrorContains(t, err, "missing tls_settings.private_key")
+	var configErr *api.NodeConfigError
+	assert.ErrorAs(t, err, &configErr)
+	assert.Equal(t, []string{"tls_settings.private_key"}, configErr.Fields)
+
+	// A dest without a server_name
+	_, err = client.GetNodeInfo()
+	assert.ErrorAs(t, err, &configErr)
+	assert.Equal(t, []string{"tls_settings.server_name"}, configErr.Fields)
+}
+
+func TestMockGetUserList(t *testing.T) {
+	doer := &mockDoer{responses: []*httpResponse{
+		mockResponse(http.StatusOK, "users-v1", `{"users": [{"id": 1, "uuid": "a", "device_limit": 2}]}`),
+		mockResponse(http.StatusNotModified, "", ""),
+		mockResponse(http.StatusInternalServerError, "", `{"message": "oops"}`),
+	}}
+	client := newMockClient(doer)
+
+	users, err := client.GetUserList()
+	assert.NoError(t, err)
+	assert.Len(t, *users, 1)
+	assert.Equal(t, 2, (*users)[0].DeviceLimit)
+
+	_, err = client.GetUserList()
+	assert.EqualError(t, err, api.UserNotModified)
+	assert.Equal(t, "users-v1", doer.requests[1].header["If-None-Match"])
+
+	_, err = client.GetUserList()
+	assert.ErrorContains(t, err, "oops")
+}
+
+func TestGetUserListUUIDPassword(t *testing.T) {
+	for _, nodeType := range []string{"Hysteria2", "TUIC"} {
+		doer := &mockDoer{responses: []*httpResponse{
+			mockResponse(http.StatusOK, "", `{"users": [{"id": 1, "uuid": "a"}]}`),
+		}}
+		client := newMockClient(doer)
+		client.NodeType = nodeType
+
+		users, err := client.GetUserList()
+		assert.NoError(t, err)
+		assert.Equal(t, "a", (*users)[0].UUID)
+		assert.Equal(t, "a", (*users)[0].Passwd)
+	}
+}
+
+func TestRetryEmptyBody(t *testing.T) {
+	transientRetryWait = 0
+	t.Cleanup(func() { transientRetryWait = time.Second })
+	doer := &mockDoer{responses: []*httpResponse{
+		mockResponse(http.StatusOK, "", ""),
+		mockResponse(http.StatusOK, "node-v1", `{"server_port": 443, "network": "tcp"}`),
+		mockResponse(http.StatusOK, "", `{"users": [{"id": 1, "uu`),
+		mockResponse(http.StatusOK, "", `{"users": [{"id": 1, "uuid": "a"}]}`),
+	}}
+	client := newMockClient(doer)
+
+	nodeInfo, err := client.GetNodeInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(443), nodeInfo.Port)
+	assert.Len(t, doer.requests, 2)
+
+	users, err := client.GetUserList()
+	assert.NoError(t, err)
+	assert.Len(t, *users, 1)
+	assert.Len(t, doer.requests, 4)
+
+	// Stable malformed content is not retried again
+	doer.responses = []*httpResponse{
+		mockResponse(http.StatusOK, "", `{"users": oops`),
+		mockResponse(http.StatusOK, "", `{"users": oops`),
+	}
+	_, err = client.GetUserList()
+	assert.ErrorContains(t, err, "malformed user list")
+	assert.Len(t, doer.requests, 6)
+
+	// Bounded
+	doer.responses = []*httpResponse{
+		mockResponse(http.StatusOK, "", ""),
+		mockResponse(http.StatusOK, "", ""),
+		mockResponse(http.StatusOK, "", ""),
+		mockResponse(http.StatusOK, "", ""),
+	}
+	_, err = client.GetUserList()
+	assert.Error(t, err)
+	assert.Len(t, doer.requests, 10)
+}
+
+func TestGetUserListSpeedLimit(t *testing.T) {
+	doer := &mockDoer{responses: []*httpResponse{
+		mockResponse(http.StatusOK, "", `{"users": [{"id": 1, "uuid": "a", "speed_limit": 100}, {"id": 2, "uuid": "b"}]}`),
+		mockResponse(http.StatusOK, "", `{"users": [{"id": 1, "uuid": "a", "speed_limit": 100}]}`),
+	}}
+	client := newMockClient(doer)
+
+	// The plan value is left to the limiter to convert
+	users, err := client.GetUserList()
+	assert.NoError(t, err)
+	assert.Equal(t, float64(100), (*users)[0].SpeedLimitMbps)
+	assert.Zero(t, (*users)[0].SpeedLimit)
+	assert.Zero(t, (*users)[1].SpeedLimitMbps)
+
+	// The local SpeedLimit overrides the panel
+	client.SpeedLimit = 2.5
+	users, err = client.GetUserList()
+	assert.NoError(t, err)
+	assert.Equal(t, 2.5, (*users)[0].SpeedLimitMbps)
+}
+
+func TestGetUserListCredentials(t *testing.T) {
+	doer := &mockDoer{responses: []*httpResponse{
+		mockResponse(http.StatusOK, "", `{"users": [{"id": 1, "uuid": "a", "username": "alice", "password": "secret"}, {"id": 2, "uuid": "b"}]}`),
+	}}
+	client := newMockClient(doer)
+
+	users, err := client.GetUserList()
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", (*users)[0].Username)
+	assert.Equal(t, "secret", (*users)[0].Passwd)
+	assert.Equal(t, "a", (*users)[0].UUID)
+
+	// The UUID users are unchanged
+	assert.Empty(t, (*users)[1].Username)
+	assert.Empty(t, (*users)[1].Passwd)
+	assert.Equal(t, "b", (*users)[1].UUID)
+}
+
+func TestGetUserListTruncated(t *testing.T) {
+	transientRetryWait = 0
+	t.Cleanup(func() { transientRetryWait = time.Second })
+	doer := &mockDoer{responses: []*httpResponse{
+		mockResponse(http.StatusOK, "", `{"users": [{"id": 1, "uuid": "a"}, {"id": 2, "uu`),
+		mockResponse(http.StatusOK, "", `{"users": [{"id": 1, "uuid": "a"}, {"id": 2, "uu`),
+		mockResponse(http.StatusOK, "", `{"users": []}`),
+	}}
+	client := newMockClient(doer)
+
+	_, err := client.GetUserList()
+	assert.ErrorContains(t, err, "malformed user list")
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	// Told apart from an empty list
+	_, err = client.GetUserList()
+	assert.EqualError(t, err, "users is null")
+}
+
+func TestHTMLResponse(t *testing.T) {
+	page := mockResponse(http.StatusOK, "", "<!DOCTYPE html>\n<html><title>Welcome to nginx!</title></html>")
+	page.Header.Set("Content-Type", "text/html; charset=utf-8")
+	generic := mockResponse(http.StatusOK, "", `{"data": true}`)
+	generic.Header.Set("Content-Type", "text/plain")
+	doer := &mockDoer{responses: []*httpResponse{page, page, generic}}
+	client := newMockClient(doer)
+
+	_, err := client.GetNodeInfo()
+	assert.ErrorContains(t, err, "returned text/html; charset=utf-8 instead of JSON")
+	assert.ErrorContains(t, err, "Welcome to nginx!")
+	_, err = client.GetUserList()
+	assert.ErrorContains(t, err, "instead of JSON")
+
+	// A generic content type is still parsed
+	assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 100, Download: 200}}))
+}
+
+func TestBodySnippet(t *testing.T) {
+	assert.Equal(t, "oops", bodySnippet([]byte(" oops\n")))
+	snippet := bodySnippet([]byte(strings.Repeat("a", 1000)))
+	assert.Len(t, snippet, 203)
+	assert.True(t, strings.HasSuffix(snippet, "..."))
+}
+
+func TestMockReportUserTraffic(t *testing.T) {
+	doer := &mockDoer{responses: []*httpResponse{
+		mockResponse(http.StatusOK, "", `{"data": true}`),
+		mockResponse(http.StatusInternalServerError, "", `{"message": "oops"}`),
+	}}
+	client := newMockClient(doer)
+
+	assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 100, Download: 200}}))
+	assert.Equal(t, http.MethodPost, doer.requests[0].method)
+	assert.Equal(t, "/api/v1/server/UniProxy/push", doer.requests[0].path)
+	assert.Equal(t, map[int][]int64{1: {100, 200}}, doer.requests[0].body)
+
+	assert.Error(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 1, Download: 2}}))
+}
+
+func TestReportUserTrafficBatches(t *testing.T) {
+	ok := func() *httpResponse { return mockResponse(http.StatusOK, "", `{"data": true}`) }
+	fail := func() *httpResponse { return mockResponse(http.StatusInternalServerError, "", `{"message": "oops"}`) }
+	traffic := &[]api.UserTraffic{
+		{UID: 5, Upload: 5, Download: 5}, {UID: 1, Upload: 1, Download: 1}, {UID: 3, Upload: 3, Download: 3},
+		{UID: 2, Upload: 2, Download: 2}, {UID: 4, Upload: 4, Download: 4},
+	}
+	doer := &mockDoer{responses: []*httpResponse{ok(), ok(), ok()}}
+	client := newMockClient(doer)
+	client.TrafficBatchSize = 2
+
+	assert.NoError(t, client.ReportUserTraffic(traffic))
+	assert.Equal(t, []any{
+		map[int][]int64{1: {1, 1}, 2: {2, 2}},
+		map[int][]int64{3: {3, 3}, 4: {4, 4}},
+		map[int][]int64{5: {5, 5}},
+	}, []any{doer.requests[0].body, doer.requests[1].body, doer.requests[2].body})
+
+	// The users of a failed batch are sent with the next report
+	doer.responses = []*httpResponse{ok(), fail(), ok(), ok(), ok()}
+	assert.NoError(t, client.ReportUserTraffic(traffic))
+	assert.Equal(t, map[int][2]int64{3: {3, 3}, 4: {4, 4}}, client.pendingTraffic)
+	assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 10, Download: 10}}))
+	assert.Equal(t, map[int][]int64{1: {10, 10}, 3: {3, 3}}, doer.requests[6].body)
+	assert.Equal(t, map[int][]int64{4: {4, 4}}, doer.requests[7].body)
+	assert.Empty(t, client.pendingTraffic)
+
+	// Nothing accepted, the traffic is left to the caller
+	doer.responses = []*httpResponse{fail(), fail(), fail()}
+	assert.Error(t, client.ReportUserTraffic(traffic))
+	assert.Empty(t, client.pendingTraffic)
+
+	// One request without a batch size
+	client.TrafficBatchSize = 0
+	doer.responses = []*httpResponse{ok()}
+	assert.NoError(t, client.ReportUserTraffic(traffic))
+	assert.Len(t, doer.requests[len(doer.requests)-1].body, 5)
+}
+
+func TestMaxConcurrentRequests(t *testing.T) {
+	SetMaxConcurrentRequests(2)
+	t.Cleanup(func() { SetMaxConcurrentRequests(0) })
+
+	var inFlight, maxInFlight atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte(`{"data": true}`))
+	}))
+	t.Cleanup(server.Close)
+
+	// Many nodes report at once
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		client := New(&api.Config{APIHost: server.URL, Key: "qwertyuiopasdfghjkl", NodeID: i, NodeType: "V2ray"})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 1, Download: 1}}))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), maxInFlight.Load())
+}
+
+func TestSemaphoreContextCancel(t *testing.T) {
+	sem := make(semaphore, 1)
+	assert.NoError(t, sem.acquire(context.Background()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, sem.acquire(ctx), context.Canceled)
+
+	sem.release()
+	assert.NoError(t, sem.acquire(context.Background()))
+}
+
+func TestReportNodeOnline(t *testing.T) {
+	api.Version = "0.9.5"
+	doer := &mockDoer{responses: []*httpResponse{
+		mockResponse(http.StatusOK, "", `{"data": true}`),
+		mockResponse(http.StatusNotFound, "", ""),
+	}}
+	client := newMockClient(doer)
+
+	// Disabled without an endpoint
+	assert.NoError(t, client.ReportNodeOnline())
+	assert.Empty(t, doer.requests)
+
+	client.LifecycleEndpoint = "/api/v1/server/UniProxy/lifecycle"
+	assert.NoError(t, client.ReportNodeOnline())
+	assert.Equal(t, "/api/v1/server/UniProxy/lifecycle", doer.requests[0].path)
+	event := doer.requests[0].body.(*lifecycleEvent)
+	assert.Equal(t, "online", event.Event)
+	assert.Equal(t, "0.9.5", event.Version)
+	assert.InDelta(t, time.Now().Unix(), event.Timestamp, 5)
+
+	// The panel has no such endpoint
+	assert.NoError(t, client.ReportNodeOffline())
+	assert.Equal(t, "offline", doer.requests[1].body.(*lifecycleEvent).Event)
+}
+
+func TestReportNodeStatus(t *testing.T) {
+	doer := &mockDoer{responses: []*httpResponse{
+		mockResponse(http.StatusOK, "", `{"data": true}`),
+		mockResponse(http.StatusNotFound, "", ""),
+		mockResponse(http.StatusInternalServerError, "", `{"message": "oops"}`),
+	}}
+	client := newMockClient(doer)
+	status := &api.NodeStatus{CPU: 12.5, Mem: 40, Disk: 71.25, Uptime: 86400}
+
+	assert.NoError(t, client.ReportNodeStatus(status))
+	assert.Equal(t, http.MethodPost, doer.requests[0].method)
+	assert.Equal(t, "/api/v1/server/UniProxy/status", doer.requests[0].path)
+	body, err := json.Marshal(doer.requests[0].body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"cpu": 12.5, "mem": 40, "disk": 71.25, "uptime": 86400}`, string(body))
+
+	// The panel has no such endpoint
+	assert.NoError(t, client.ReportNodeStatus(status))
+	assert.Error(t, client.ReportNodeStatus(status))
+}
+
+func TestReportIllegal(t *testing.T) {
+	doer := &mockDoer{responses: []*httpResponse{
+		mockResponse(http.StatusOK, "", `{"data": true}`),
+		mockResponse(http.StatusMethodNotAllowed, "", ""),
+		mockResponse(http.StatusInternalServerError, "", `{"message": "oops"}`),
+		mockResponse(http.StatusOK, "", `{"data": true}`),
+	}}
+	client := newMockClient(doer)
+	hits := &[]api.DetectResult{{UID: 1, RuleID: 3}, {UID: 2, RuleID: 3}, {UID: 1, RuleID: 7}}
+
+	assert.NoError(t, client.ReportIllegal(hits))
+	assert.Len(t, doer.requests, 1)
+	assert.Equal(t, "/api/v1/server/UniProxy/illegal", doer.requests[0].path)
+	body, err := json.Marshal(doer.requests[0].body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"1": [3, 7], "2": [3]}`, string(body))
+
+	// The panel does not support it
+	assert.NoError(t, client.ReportIllegal(hits))
+	assert.Error(t, client.ReportIllegal(hits))
+
+	// Nothing to report
+	assert.NoError(t, client.ReportIllegal(&[]api.DetectResult{}))
+	assert.Len(t, doer.requests, 3)
+
+	// The audit hits are not held back by a pause
+	client.PauseReporting()
+	assert.NoError(t, client.ReportIllegal(hits))
+	assert.Len(t, doer.requests, 4)
+}
+
+func TestReportDeviceHours(t *testing.T) {
+	doer := &mockDoer{responses: []*httpResponse{
+		mockResponse(http.StatusOK, "", `{"data": true}`),
+		mockResponse(http.StatusNotFound, "", ""),
+		mockResponse(http.StatusInternalServerError, "", `{"message": "oops"}`),
+	}}
+	client := newMockClient(doer)
+	hours := &[]api.DeviceHours{{UID: 1, Hours: 1.5}, {UID: 2, Hours: 0.25}}
+
+	assert.NoError(t, client.ReportDeviceHours(hours))
+	assert.Len(t, doer.requests, 1)
+	assert.Equal(t, "/api/v1/server/UniProxy/devicehours", doer.requests[0].path)
+	body, err := json.Marshal(doer.requests[0].body)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"1": 1.5, "2": 0.25}`, string(body))
+
+	// The panel does not support it
+	assert.NoError(t, client.ReportDeviceHours(hours))
+	assert.Error(t, client.ReportDeviceHours(hours))
+
+	// Nothing to report
+	assert.NoError(t, client.ReportDeviceHours(&[]api.DeviceHours{}))
+	assert.Len(t, doer.requests, 3)
+}
+
+func TestReloadKeyOnAuthFailure(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "apikey")
+	doer := &mockDoer{responses: []*httpResponse{
+		mockResponse(http.StatusUnauthorized, "", `{"message": "token is error"}`),
+		mockResponse(http.StatusOK, "users-v1", `{"users": [{"id": 1, "uuid": "a"}]}`),
+	}}
+	client := newMockClient(doer)
+	client.Key = "old"
+	client.KeyFile = keyFile
+	assert.NoError(t, os.WriteFile(keyFile, []byte("new\n"), 0o600))
+
+	users, err := client.GetUserList()
+	assert.NoError(t, err)
+	assert.Len(t, *users, 1)
+	assert.Len(t, doer.requests, 2)
+	assert.Equal(t, "new", client.Key)
+	assert.Equal(t, "new", doer.token)
+
+	// The key in the file is rejected too, do not retry
+	doer.responses = []*httpResponse{mockResponse(http.StatusForbidden, "", `{"message": "token is error"}`)}
+	_, err = client.GetUserList()
+	assert.Error(t, err)
+	assert.Len(t, doer.requests, 3)
+
+	// Without a key source
+	client.KeyFile = ""
+	doer.responses = []*httpResponse{mockResponse(http.StatusUnauthorized, "", `{"message": "token is error"}`)}
+	_, err = client.GetUserList()
+	assert.Error(t, err)
+	assert.Len(t, doer.requests, 4)
+}
+
+func TestReportOnlineDelta(t *testing.T) {
+	ok := func() *httpResponse { return mockResponse(http.StatusOK, "", `{"data": true}`) }
+	doer := &mockDoer{responses: []*httpResponse{ok(), ok(), mockResponse(http.StatusInternalServerError, "", ""), ok(), ok()}}
+	client := newMockClient(doer)
+	client.OnlineDelta = true
+	client.OnlineFullSync = 10
+
+	// The first report is a full snapshot
+	assert.NoError(t, client.ReportNodeOnlineUsers(&[]api.OnlineUser{{UID: 1, IP: "1.1.1.1"}, {UID: 2, IP: "2.2.2.2"}}))
+	assert.Equal(t, map[int][]string{1: {"1.1.1.1"}, 2: {"2.2.2.2"}}, doer.requests[0].body)
+
+	// Only the change is sent
+	assert.NoError(t, client.ReportNodeOnlineUsers(&[]api.OnlineUser{{UID: 1, IP: "1.1.1.1"}, {UID: 1, IP: "3.3.3.3"}}))
+	assert.Equal(t, &onlineDelta{
+		Added:   map[int][]string{1: {"3.3.3.3"}},
+		Removed: map[int][]string{2: {"2.2.2.2"}},
+	}, doer.requests[1].body)
+
+	// A failed report is followed by a full snapshot
+	assert.NoError(t, client.ReportNodeOnlineUsers(&[]api.OnlineUser{{UID: 1, IP: "1.1.1.1"}}))
+	assert.NoError(t, client.ReportNodeOnlineUsers(&[]api.OnlineUser{{UID: 1, IP: "1.1.1.1"}}))
+	assert.Equal(t, map[int][]string{1: {"1.1.1.1"}}, doer.requests[3].body)
+
+	// And every OnlineFullSync reports
+	client.OnlineFullSync = 1
+	assert.NoError(t, client.ReportNodeOnlineUsers(&[]api.OnlineUser{{UID: 1, IP: "1.1.1.1"}}))
+	assert.Equal(t, map[int][]string{1: {"1.1.1.1"}}, doer.requests[4].body)
+}
+
+func TestReportVersion(t *testing.T) {
+	ok := func() *httpResponse { return mockResponse(http.StatusOK, "", `{"data": true}`) }
+	traffic := &[]api.UserTraffic{{UID: 2, Upload: 1, Download: 2}, {UID: 1, Upload: 100, Download: 200}}
+	online := &[]api.OnlineUser{{UID: 1, IP: "1.1.1.1"}, {UID: 1, IP: "2.2.2.2"}}
+
+	// Version 1 by default
+	client := New(&api.Config{APIHost: "http://panel.test", Key: "qwertyuiopasdfghjkl", NodeID: 1, NodeType: "V2ray"})
+	assert.Equal(t, reportV1, client.ReportVersion)
+	doer := &mockDoer{responses: []*httpResponse{ok(), ok()}}
+	client.doer = doer
+	assert.NoError(t, client.ReportUserTraffic(traffic))
+	assert.Equal(t, map[int][]int64{1: {100, 200}, 2: {1, 2}}, doer.requests[0].body)
+	assert.NoError(t, client.ReportNodeOnlineUsers(online))
+	assert.Equal(t, map[int][]string{1: {"1.1.1.1", "2.2.2.2"}}, doer.requests[1].body)
+
+	client = New(&api.Config{APIHost: "http://panel.test", Key: "qwertyuiopasdfghjkl", NodeID: 1, NodeType: "V2ray",
+		ReportVersion: 2, OnlineReportDelta: true})
+	assert.False(t, client.OnlineDelta)
+	doer = &mockDoer{responses: []*httpResponse{ok(), ok()}}
+	client.doer = doer
+	assert.NoError(t, client.ReportUserTraffic(traffic))
+	assert.Equal(t, &trafficV2{Traffics: []userTrafficV2{{UID: 1, Upload: 100, Download: 200}, {UID: 2, Upload: 1, Download: 2}}}, doer.requests[0].body)
+	assert.NoError(t, client.ReportNodeOnlineUsers(online))
+	assert.Equal(t, &onlineV2{Online: []onlineUserV2{{UID: 1, IP: "1.1.1.1"}, {UID: 1, IP: "2.2.2.2"}}}, doer.requests[1].body)
+
+	// The IPs are left out when suppressed
+	client.SuppressOnlineIP = true
+	doer.responses = []*httpResponse{ok()}
+	assert.NoError(t, client.ReportNodeOnlineUsers(online))
+	assert.Equal(t, &onlineV2{Online: []onlineUserV2{{UID: 1}, {UID: 1}}}, doer.requests[2].body)
+
+	// Unsupported versions fall back to 1
+	client = New(&api.Config{APIHost: "http://panel.test", Key: "qwertyuiopasdfghjkl", NodeID: 1, NodeType: "V2ray", ReportVersion: 3})
+	assert.Equal(t, reportV1, client.ReportVersion)
+}
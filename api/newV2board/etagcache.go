@@ -0,0 +1,105 @@
+package newV2board
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// eTagCacheEntry is the last version of a resource, the body is kept so a 304 after a restart can be served
+type eTagCacheEntry struct {
+	ETag string          `json:"etag"`
+	Body json.RawMessage `json:"body"`
+}
+
+// readETagCache reads the entries of the cache file by ETag key, a missing file has none
+func readETagCache(path string) (map[string]*eTagCacheEntry, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return map[string]*eTagCacheEntry{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*eTagCacheEntry)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// loadETagCache restores the ETags and bodies of the last run, so the first pulls may get a 304
+func (c *APIClient) loadETagCache() {
+	entries, err := readETagCache(c.ETagCachePath)
+	if err != nil {
+		log.Printf("Load the ETag cache %s failed: %s", c.ETagCachePath, err)
+		return
+	}
+	c.eTagCacheMu.Lock()
+	defer c.eTagCacheMu.Unlock()
+	c.eTagMu.Lock()
+	defer c.eTagMu.Unlock()
+	for key, entry := range entries {
+		if entry == nil || entry.ETag == "" || len(entry.Body) == 0 {
+			continue
+		}
+		c.eTags[key] = entry.ETag
+		c.cachedBodies[key] = entry.Body
+		c.eTagCache[key] = entry
+	}
+}
+
+// takeCachedBody returns the body of the resource loaded from the cache file, once
+func (c *APIClient) takeCachedBody(key string) ([]byte, bool) {
+	c.eTagMu.Lock()
+	defer c.eTagMu.Unlock()
+	body, ok := c.cachedBodies[key]
+	delete(c.cachedBodies, key)
+	return body, ok
+}
+
+// saveETagCache writes the version of the resource to the cache file, the other entries are kept.
+// The file is only rewritten when the ETag changed.
+func (c *APIClient) saveETagCache(key string, eTag string, body []byte) {
+	if c.ETagCachePath == "" || eTag == "" {
+		return
+	}
+	c.eTagCacheMu.Lock()
+	defer c.eTagCacheMu.Unlock()
+	if entry, ok := c.eTagCache[key]; ok && entry.ETag == eTag {
+		return
+	}
+	c.eTagCache[key] = &eTagCacheEntry{ETag: eTag, Body: body}
+	if err := writeFileAtomic(c.ETagCachePath, c.eTagCache); err != nil {
+		log.Printf("Save the ETag cache %s failed: %s", c.ETagCachePath, err)
+	}
+}
+
+// writeFileAtomic writes v as JSON to a temporary file renamed over path, a crash never leaves half a file.
+// The file is only readable by the owner, the users in it hold their credentials.
+func writeFileAtomic(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
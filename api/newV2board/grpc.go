@@ -0,0 +1,256 @@
+package newV2board
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+// grpcServiceName is the panel service of the gRPC transport. It has a method for each operation, named
+// after the APIClient method: GetNodeInfo, GetUserList, ReportUserTraffic, ReportNodeOnlineUsers, GetIpsList,
+// GetBannedUsers, ReportNodeStatus, ReportIllegal, ReportDeviceHours and ReportNodeLifecycle. The messages
+// are the JSON of the REST bodies, so GetNodeInfo answers a serverConfig, GetUserList answers {"users": [user]}
+// and the reports are sent the report the REST endpoint is posted. A pull has no request fields, it sends {}.
+//
+// The node_id, node_type and token are sent in the metadata, with the if-none-match of a pull. The panel
+// answers an etag in the header metadata, and not-modified: true instead of an unchanged resource.
+// A failed call answers the gRPC status of the HTTP status it would have answered over REST.
+const grpcServiceName = "xrayr.panel.v1.Panel"
+
+// jsonCodec encodes the gRPC messages as JSON, there is no generated protobuf code to maintain
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+// grpcStatusCodes are the HTTP statuses of the gRPC status codes, the others are a 500
+var grpcStatusCodes = map[codes.Code]int{
+	codes.OK:                http.StatusOK,
+	codes.InvalidArgument:   http.StatusBadRequest,
+	codes.Unauthenticated:   http.StatusUnauthorized,
+	codes.PermissionDenied:  http.StatusForbidden,
+	codes.NotFound:          http.StatusNotFound,
+	codes.ResourceExhausted: http.StatusTooManyRequests,
+	codes.Unimplemented:     http.StatusNotImplemented,
+	codes.Unavailable:       http.StatusServiceUnavailable,
+	codes.DeadlineExceeded:  http.StatusGatewayTimeout,
+}
+
+// grpcTarget returns the address and the transport credentials of the panel at apiHost,
+// https:// and grpcs:// use TLS
+func grpcTarget(apiHost string, certs []tls.Certificate) (string, grpc.DialOption, error) {
+	u, err := url.Parse(apiHost)
+	if err != nil {
+		return "", nil, err
+	}
+	switch u.Scheme {
+	case "https", "grpcs":
+		return u.Host, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{Certificates: certs})), nil
+	case "http", "grpc":
+		return u.Host, grpc.WithTransportCredentials(insecure.NewCredentials()), nil
+	default:
+		return "", nil, fmt.Errorf("unsupported scheme of gRPC panel: %s", apiHost)
+	}
+}
+
+// grpcDoer sends the requests to the panel over gRPC. A call is retried like a REST request while the panel
+// is unavailable or rate limits it, each attempt is signed and recorded in the metrics.
+type grpcDoer struct {
+	conn       *grpc.ClientConn
+	timeout    time.Duration
+	mu         sync.Mutex
+	metadata   map[string]string // node_id, node_type and token
+	methodName func(path string) string
+	secret     []byte // Signs the calls, nil means no signature
+	retries    int
+	waitMin    time.Duration
+	waitMax    time.Duration
+	maxRetry   time.Duration // The longest retry-after waited out
+	jitter     bool
+	observe    func(path string, statusCode int, latency time.Duration, err error) // nil means no metrics
+}
+
+func newGRPCDoer(target string, query map[string]string, timeout time.Duration, opts ...grpc.DialOption) (*grpcDoer, error) {
+	opts = append(opts, grpc.WithDefaultCallOptions(grpc.ForceCodec(jsonCodec{})))
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &grpcDoer{conn: conn, timeout: timeout, metadata: maps.Clone(query)}, nil
+}
+
+// useGRPC sends the requests to the panel at target over gRPC, with the User-Agent, timeout and retries
+// of the resty client
+func (c *APIClient) useGRPC(target string, query map[string]string, apiConfig *api.Config, opts ...grpc.DialOption) error {
+	opts = append(opts, grpc.WithUserAgent(c.client.Header.Get("User-Agent")))
+	doer, err := newGRPCDoer(target, query, c.client.GetClient().Timeout, opts...)
+	if err != nil {
+		return err
+	}
+	doer.methodName = c.endpointName
+	if apiConfig.SigningSecret != "" {
+		doer.secret = []byte(apiConfig.SigningSecret)
+	}
+	doer.retries = c.client.RetryCount
+	doer.waitMin = c.client.RetryWaitTime
+	doer.waitMax = c.client.RetryMaxWaitTime
+	doer.jitter = apiConfig.RetryJitter
+	doer.maxRetry = maxRetryAfter(apiConfig)
+	if metricsEnabled {
+		doer.observe = c.observeRequest
+	}
+	c.doer = doer
+	return nil
+}
+
+func (d *grpcDoer) SetToken(token string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.metadata["token"] = token
+}
+
+// Do calls the method of the path. The header is sent as metadata, but a Content-Encoding of gzip
+// gzips the call, the body is not compressed by the caller.
+func (d *grpcDoer) Do(method string, path string, header map[string]string, body any) (*httpResponse, error) {
+	name := d.methodName(path)
+	if name == "other" {
+		return &httpResponse{}, fmt.Errorf("no gRPC method for %s", path)
+	}
+	fullMethod := "/" + grpcServiceName + "/" + name
+	req := json.RawMessage("{}")
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return &httpResponse{}, err
+		}
+		req = b
+	}
+	md := metadata.New(nil)
+	d.mu.Lock()
+	for k, v := range d.metadata {
+		md.Set(k, v)
+	}
+	d.mu.Unlock()
+	var opts []grpc.CallOption
+	for k, v := range header {
+		if http.CanonicalHeaderKey(k) == "Content-Encoding" {
+			if v == "gzip" {
+				opts = append(opts, grpc.UseCompressor(gzip.Name))
+			}
+			continue
+		}
+		md.Set(k, v)
+	}
+
+	if sem := requestSem; sem != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+		defer cancel()
+		if err := sem.acquire(ctx); err != nil {
+			return &httpResponse{}, fmt.Errorf("wait for a request slot failed: %w", err)
+		}
+		defer sem.release()
+	}
+	for attempt := 1; ; attempt++ {
+		res, trailer, err := d.call(fullMethod, path, md, req, opts)
+		wait, retry := d.retryWait(res, trailer, attempt)
+		if !retry || attempt > d.retries {
+			return res, err
+		}
+		time.Sleep(wait)
+	}
+}
+
+// call invokes the method once, it returns the header and trailer metadata with the response
+func (d *grpcDoer) call(fullMethod string, path string, md metadata.MD, req json.RawMessage, opts []grpc.CallOption) (*httpResponse, metadata.MD, error) {
+	md = md.Copy()
+	if d.secret != nil {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		md.Set("x-timestamp", timestamp)
+		md.Set("x-signature", signature(d.secret, http.MethodPost, fullMethod, timestamp, req))
+	}
+	ctx, cancel := context.WithTimeout(metadata.NewOutgoingContext(context.Background(), md), d.timeout)
+	defer cancel()
+	var reply json.RawMessage
+	var header, trailer metadata.MD
+	opts = append(slices.Clip(opts), grpc.Header(&header), grpc.Trailer(&trailer))
+	start := time.Now()
+	err := d.conn.Invoke(ctx, fullMethod, req, &reply, opts...)
+	latency := time.Since(start)
+
+	res, err := grpcHTTPResponse(reply, header, err)
+	if d.observe != nil {
+		d.observe(path, res.StatusCode, latency, err)
+	}
+	return res, metadata.Join(header, trailer), err
+}
+
+// grpcHTTPResponse returns the HTTP response of the same meaning as the result of a call
+func grpcHTTPResponse(reply json.RawMessage, header metadata.MD, err error) (*httpResponse, error) {
+	resHeader := make(http.Header)
+	if eTag := header.Get("etag"); len(eTag) > 0 {
+		resHeader.Set("Etag", eTag[0])
+	}
+	if err != nil {
+		s, ok := status.FromError(err)
+		if !ok {
+			return &httpResponse{}, err
+		}
+		statusCode, ok := grpcStatusCodes[s.Code()]
+		if !ok {
+			statusCode = http.StatusInternalServerError
+		}
+		return &httpResponse{StatusCode: statusCode, Header: resHeader, Body: []byte(s.Message())}, nil
+	}
+	if notModified := header.Get("not-modified"); len(notModified) > 0 && notModified[0] == "true" {
+		return &httpResponse{StatusCode: http.StatusNotModified, Header: resHeader}, nil
+	}
+	return &httpResponse{StatusCode: http.StatusOK, Header: resHeader, Body: reply}, nil
+}
+
+// retryWait returns the wait before retrying the call after attempt. An unavailable panel is retried with the
+// backoff of the REST requests, a rate limited call after the retry-after metadata unless that is longer than maxRetry.
+func (d *grpcDoer) retryWait(res *httpResponse, md metadata.MD, attempt int) (time.Duration, bool) {
+	switch res.StatusCode {
+	case http.StatusServiceUnavailable:
+	case http.StatusTooManyRequests:
+		if retryAfter := md.Get("retry-after"); len(retryAfter) > 0 {
+			if wait, ok := parseRetryAfter(retryAfter[0], time.Now()); ok {
+				return wait, wait <= d.maxRetry
+			}
+		}
+	default:
+		return 0, false
+	}
+	wait := retryBackoff(d.waitMin, d.waitMax, attempt)
+	if d.jitter {
+		wait = jitterWait(d.waitMin, wait)
+	}
+	return wait, true
+}
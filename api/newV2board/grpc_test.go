@@ -0,0 +1,197 @@
+package newV2board
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+// grpcCall is a call received by the test panel
+type grpcCall struct {
+	method string
+	md     metadata.MD
+	body   json.RawMessage
+}
+
+// get returns the first value of the metadata key
+func (c *grpcCall) get(key string) string {
+	if v := c.md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// newGRPCTestClient serves the panel handler as the methods of the panel service over an in-memory connection
+func newGRPCTestClient(t *testing.T, apiConfig *api.Config, handler func(ctx context.Context, call *grpcCall) (any, error)) *APIClient {
+	listener := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(grpc.ForceServerCodec(jsonCodec{}))
+	desc := &grpc.ServiceDesc{ServiceName: grpcServiceName, HandlerType: (*any)(nil)}
+	for _, name := range append(slices.Sorted(maps.Values(endpointNames)), "ReportNodeLifecycle") {
+		desc.Methods = append(desc.Methods, grpc.MethodDesc{
+			MethodName: name,
+			Handler: func(_ any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+				call := &grpcCall{method: name}
+				if err := dec(&call.body); err != nil {
+					return nil, err
+				}
+				call.md, _ = metadata.FromIncomingContext(ctx)
+				return handler(ctx, call)
+			},
+		})
+	}
+	server.RegisterService(desc, struct{}{})
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	client := New(apiConfig)
+	query := map[string]string{"node_id": strconv.Itoa(apiConfig.NodeID), "node_type": "v2ray", "token": apiConfig.Key}
+	err := client.useGRPC("passthrough:///bufnet", query, apiConfig,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.doer.(*grpcDoer).conn.Close() })
+	return client
+}
+
+// countingCompressor counts the messages compressed with gzip
+type countingCompressor struct {
+	encoding.Compressor
+	calls *atomic.Int32
+}
+
+func (c countingCompressor) Compress(w io.Writer) (io.WriteCloser, error) {
+	c.calls.Add(1)
+	return c.Compressor.Compress(w)
+}
+
+func TestGRPCTransport(t *testing.T) {
+	var gzipped atomic.Int32
+	encoding.RegisterCompressor(countingCompressor{Compressor: encoding.GetCompressor(gzip.Name), calls: &gzipped})
+	t.Cleanup(func() { encoding.RegisterCompressor(encoding.GetCompressor(gzip.Name).(countingCompressor).Compressor) })
+
+	var pushed json.RawMessage
+	client := newGRPCTestClient(t, &api.Config{APIHost: "http://panel.test", Key: "qwertyuiopasdfghjkl", NodeID: 1, NodeType: "V2ray",
+		UserAgent: "panel-test", SigningSecret: "secret", CompressTrafficReport: true},
+		func(ctx context.Context, call *grpcCall) (any, error) {
+			assert.Equal(t, "qwertyuiopasdfghjkl", call.get("token"))
+			assert.Equal(t, "1", call.get("node_id"))
+			assert.Contains(t, call.get("user-agent"), "panel-test (node 1)")
+			// Signed like a REST request
+			assert.Equal(t, signature([]byte("secret"), http.MethodPost, "/"+grpcServiceName+"/"+call.method, call.get("x-timestamp"), call.body),
+				call.get("x-signature"))
+			switch call.method {
+			case "GetNodeInfo":
+				assert.JSONEq(t, `{}`, string(call.body))
+				if call.get("if-none-match") == "node-v1" {
+					grpc.SetHeader(ctx, metadata.Pairs("etag", "node-v1", "not-modified", "true"))
+					return struct{}{}, nil
+				}
+				grpc.SetHeader(ctx, metadata.Pairs("etag", "node-v1"))
+				config := &serverConfig{ServerPort: 443}
+				config.Network = "ws"
+				config.NetworkSettings.Path = "/ws"
+				return config, nil
+			case "GetUserList":
+				return map[string][]*user{"users": {{Id: 1, Uuid: "a", DeviceLimit: 2}}}, nil
+			case "ReportUserTraffic":
+				pushed = call.body
+				return map[string]bool{"data": true}, nil
+			}
+			return nil, status.Error(codes.NotFound, "not found")
+		})
+
+	nodeInfo, err := client.GetNodeInfo()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(443), nodeInfo.Port)
+	assert.Equal(t, "/ws", nodeInfo.Path)
+	_, err = client.GetNodeInfo()
+	assert.EqualError(t, err, api.NodeNotModified)
+
+	users, err := client.GetUserList()
+	assert.NoError(t, err)
+	assert.Len(t, *users, 1)
+	assert.Equal(t, 2, (*users)[0].DeviceLimit)
+
+	// The report is gzipped by gRPC, the pulls are not
+	assert.Zero(t, gzipped.Load())
+	assert.NoError(t, client.ReportUserTraffic(&[]api.UserTraffic{{UID: 1, Upload: 100, Download: 200}}))
+	traffic := make(map[int][]int64)
+	assert.NoError(t, json.Unmarshal(pushed, &traffic))
+	assert.Equal(t, map[int][]int64{1: {100, 200}}, traffic)
+	assert.Equal(t, int32(2), gzipped.Load()) // The call and its reply
+
+	// The reloaded key is sent from now on
+	client.doer.SetToken("new")
+	assert.Equal(t, "new", client.doer.(*grpcDoer).metadata["token"])
+}
+
+func TestGRPCRetry(t *testing.T) {
+	SetMetricsEnabled(true)
+	t.Cleanup(func() { SetMetricsEnabled(false) })
+	var userCalls, statusCalls atomic.Int32
+	client := newGRPCTestClient(t, &api.Config{APIHost: "http://panel.test", Key: "key", NodeID: 8, NodeType: "V2ray",
+		RetryWaitMin: 1, RetryWaitMax: 10, RetryJitter: true, MaxRetryAfter: 30},
+		func(ctx context.Context, call *grpcCall) (any, error) {
+			switch call.method {
+			case "GetUserList":
+				// Unavailable while the panel restarts
+				if userCalls.Add(1) == 1 {
+					return nil, status.Error(codes.Unavailable, "restarting")
+				}
+				return map[string][]*user{"users": {{Id: 1, Uuid: "a"}}}, nil
+			case "ReportNodeStatus":
+				// Rate limited longer than MaxRetryAfter
+				statusCalls.Add(1)
+				grpc.SetTrailer(ctx, metadata.Pairs("retry-after", "60"))
+				return nil, status.Error(codes.ResourceExhausted, "slow down")
+			}
+			return nil, status.Error(codes.NotFound, "not found")
+		})
+
+	users, err := client.GetUserList()
+	assert.NoError(t, err)
+	assert.Len(t, *users, 1)
+	assert.Equal(t, int32(2), userCalls.Load())
+	assert.Error(t, client.ReportNodeStatus(&api.NodeStatus{}))
+	assert.Equal(t, int32(1), statusCalls.Load())
+
+	// Each attempt is recorded
+	labels := []string{"8", "V2ray", "GetUserList"}
+	assert.Equal(t, 2.0, testutil.ToFloat64(apiMetrics.calls.WithLabelValues(labels...)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(apiMetrics.errors.WithLabelValues(labels...)))
+	labels = []string{"8", "V2ray", "ReportNodeStatus"}
+	assert.Equal(t, 1.0, testutil.ToFloat64(apiMetrics.errors.WithLabelValues(labels...)))
+}
+
+func TestGRPCTarget(t *testing.T) {
+	target, _, err := grpcTarget("https://panel.test:8443", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "panel.test:8443", target)
+	target, _, err = grpcTarget("grpc://127.0.0.1:9000", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:9000", target)
+	_, _, err = grpcTarget("ftp://panel.test", nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,125 @@
+package newV2board
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// endpointNames are the method names the metrics of each operation are labeled with, and the gRPC methods called
+var endpointNames = map[string]string{
+	"config":      "GetNodeInfo",
+	"user":        "GetUserList",
+	"push":        "ReportUserTraffic",
+	"alive":       "ReportNodeOnlineUsers",
+	"aips":        "GetIpsList",
+	"banned":      "GetBannedUsers",
+	"status":      "ReportNodeStatus",
+	"illegal":     "ReportIllegal",
+	"devicehours": "ReportDeviceHours",
+}
+
+// requestMetrics are the metrics of the panel requests of all clients, by node and endpoint
+type requestMetrics struct {
+	calls       *prometheus.CounterVec
+	errors      *prometheus.CounterVec
+	notModified *prometheus.CounterVec
+	latency     *prometheus.HistogramVec
+}
+
+func newRequestMetrics(reg prometheus.Registerer) *requestMetrics {
+	labels := []string{"node_id", "node_type", "endpoint"}
+	m := &requestMetrics{
+		calls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "xrayr_api_requests_total",
+			Help: "Requests sent to the panel, each retry counts.",
+		}, labels),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "xrayr_api_request_errors_total",
+			Help: "Requests to the panel that failed or got a status of 400 or more.",
+		}, labels),
+		notModified: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "xrayr_api_not_modified_total",
+			Help: "Requests to the panel answered with 304 Not Modified.",
+		}, labels),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "xrayr_api_request_duration_seconds",
+			Help:    "Time from sending a request to the panel to reading its response.",
+			Buckets: prometheus.DefBuckets,
+		}, labels),
+	}
+	reg.MustRegister(m.calls, m.errors, m.notModified, m.latency)
+	return m
+}
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+	apiMetrics      = newRequestMetrics(metricsRegistry)
+	// metricsEnabled makes the clients created after it record the metrics
+	metricsEnabled bool
+)
+
+// SetMetricsEnabled turns on the metrics of the panel requests, served by MetricsHandler.
+// It must be called before any client starts.
+func SetMetricsEnabled(enable bool) {
+	metricsEnabled = enable
+}
+
+// MetricsHandler serves the metrics of the panel requests in the Prometheus format
+func MetricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// observeRequests records the metrics of every request of the resty client, each retry is a request
+func (c *APIClient) observeRequests(client *resty.Client) {
+	client.OnAfterResponse(func(_ *resty.Client, res *resty.Response) error {
+		c.observeRequest(res.Request.RawRequest.URL.Path, res.StatusCode(), res.Time(), nil)
+		return nil
+	})
+	// A request without a response is only seen here, once after its retries
+	client.OnError(func(req *resty.Request, err error) {
+		var resErr *resty.ResponseError
+		if errors.As(err, &resErr) && resErr.Response != nil && resErr.Response.RawResponse != nil {
+			return
+		}
+		path := req.URL
+		if u, parseErr := url.Parse(req.URL); parseErr == nil {
+			path = u.Path
+		}
+		c.observeRequest(path, 0, 0, err)
+	})
+}
+
+func (c *APIClient) observeRequest(path string, statusCode int, latency time.Duration, err error) {
+	labels := prometheus.Labels{"node_id": strconv.Itoa(c.NodeID), "node_type": c.NodeType, "endpoint": c.endpointName(path)}
+	apiMetrics.calls.With(labels).Inc()
+	if err != nil || statusCode >= http.StatusBadRequest {
+		apiMetrics.errors.With(labels).Inc()
+	}
+	if statusCode == http.StatusNotModified {
+		apiMetrics.notModified.With(labels).Inc()
+	}
+	if err == nil {
+		apiMetrics.latency.With(labels).Observe(latency.Seconds())
+	}
+}
+
+// endpointName returns the method name of the request path, the path may follow the path of the ApiHost
+func (c *APIClient) endpointName(path string) string {
+	for operation, name := range endpointNames {
+		if strings.HasSuffix(path, c.endpoint(operation)) {
+			return name
+		}
+	}
+	if c.LifecycleEndpoint != "" && strings.HasSuffix(path, c.LifecycleEndpoint) {
+		return "ReportNodeLifecycle"
+	}
+	return "other"
+}
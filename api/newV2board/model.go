@@ -2,19 +2,135 @@ package newV2board
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
 )
 
 type serverConfig struct {
 	shadowsocks
 	v2ray
 	trojan
+	hysteria
+	tuic
 
-	ServerPort int `json:"server_port"`
+	NodeType   string `json:"node_type"`
+	Name       string `json:"name"`
+	Region     string `json:"region"`
+	ServerPort int    `json:"server_port"`
 	BaseConfig struct {
 		PushInterval int `json:"push_interval"`
 		PullInterval int `json:"pull_interval"`
 	} `json:"base_config"`
-	Routes []route `json:"routes"`
+	Routes          []route          `json:"routes"`
+	TransportTuning *transportTuning `json:"transport_tuning"`
+	TCPFastOpen     json.RawMessage  `json:"tcp_fast_open"` // Bool or queue length
+}
+
+type transportTuning struct {
+	Mtu              uint32 `json:"mtu"`
+	Tti              uint32 `json:"tti"`
+	UplinkCapacity   uint32 `json:"uplink_capacity"`
+	DownlinkCapacity uint32 `json:"downlink_capacity"`
+	ReadBufferSize   uint32 `json:"read_buffer_size"`
+	WriteBufferSize  uint32 `json:"write_buffer_size"`
+	TCPWindowClamp   int32  `json:"tcp_window_clamp"`
+}
+
+var defaultRuleListMaxSize int64 = 10 * 1024 * 1024 // Byte, for a rule list fetched from a URL
+
+const defaultOnlineFullSync = 10 // Reports
+
+// defaultMaxRetryAfter is the longest Retry-After of a 429 waited out before the retry
+const defaultMaxRetryAfter = 5 * time.Minute
+
+// transientRetryCount is the retries of an empty or invalid 200, the same budget as the retries of a failed request
+const transientRetryCount = 3
+
+// transientRetryWait is the wait before each of the retries
+var transientRetryWait = time.Second
+
+// The REALITY client settings when the panel sends none
+const (
+	defaultFingerprint = "chrome"
+	defaultSpiderX     = "/"
+)
+
+// defaultEndpoints are the UniProxy paths of the operations, Endpoints in the config overrides them
+var defaultEndpoints = map[string]string{
+	"config":      "/api/v1/server/UniProxy/config",
+	"user":        "/api/v1/server/UniProxy/user",
+	"push":        "/api/v1/server/UniProxy/push",
+	"alive":       "/api/v1/server/UniProxy/alive",
+	"aips":        "/api/v1/server/UniProxy/aips",
+	"banned":      "/api/v1/server/UniProxy/banned",
+	"status":      "/api/v1/server/UniProxy/status",
+	"illegal":     "/api/v1/server/UniProxy/illegal",
+	"devicehours": "/api/v1/server/UniProxy/devicehours",
+}
+
+// supportedNetworks are the transports the controller can build
+var supportedNetworks = map[string]bool{
+	"tcp":         true,
+	"ws":          true,
+	"websocket":   true,
+	"grpc":        true,
+	"httpupgrade": true,
+	"splithttp":   true,
+	"xhttp":       true,
+	"kcp":         true,
+	"mkcp":        true,
+}
+
+// stringList is a JSON array of strings or a string of comma separated values
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		values := strings.Split(s, ",")
+		for i := range values {
+			values[i] = strings.TrimSpace(values[i])
+		}
+		*l = values
+		return nil
+	}
+	var values []string
+	if err := json.Unmarshal(data, &values); err != nil {
+		return fmt.Errorf("must be a string or an array of strings: %s", err)
+	}
+	*l = values
+	return nil
+}
+
+// nonEmpty returns the values that are not blank
+func (l stringList) nonEmpty() []string {
+	var values []string
+	for _, v := range l {
+		if strings.TrimSpace(v) != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// tlsVersions are the min_version and max_version xray accepts
+var tlsVersions = map[string]bool{
+	"1.0": true,
+	"1.1": true,
+	"1.2": true,
+	"1.3": true,
+}
+
+// nodeTypes maps the node types sent by the panel to the XrayR ones
+var nodeTypes = map[string]string{
+	"v2ray":       "V2ray",
+	"vmess":       "Vmess",
+	"vless":       "Vless",
+	"trojan":      "Trojan",
+	"shadowsocks": "Shadowsocks",
+	"hysteria2":   "Hysteria2",
+	"tuic":        "TUIC",
 }
 
 type shadowsocks struct {
@@ -25,6 +141,11 @@ type shadowsocks struct {
 		Host string `json:"host"`
 	} `json:"obfs_settings"`
 	ServerKey string `json:"server_key"`
+	Ports     []struct {
+		Port      int    `json:"port"`
+		Cipher    string `json:"cipher"`
+		ServerKey string `json:"server_key"`
+	} `json:"ports"`
 }
 
 type v2ray struct {
@@ -34,23 +155,58 @@ type v2ray struct {
 		Host        string           `json:"host"`
 		Headers     *json.RawMessage `json:"headers"`
 		ServiceName string           `json:"serviceName"`
+		MultiMode   bool             `json:"multiMode"`
 		Header      *json.RawMessage `json:"header"`
 	} `json:"networkSettings"`
 	VlessFlow   string `json:"flow"`
 	TlsSettings struct {
-		ServerPort string `json:"server_port"`
-		Dest       string `json:"dest"`
-		Xver       uint64 `json:"xver,string"`
-		Sni        string `json:"server_name"`
-		PrivateKey string `json:"private_key"`
-		ShortId    string `json:"short_id"`
+		ServerPort    string     `json:"server_port"`
+		Dest          string     `json:"dest"`
+		Xver          uint64     `json:"xver,string"`
+		Sni           stringList `json:"server_name"` // A pool of REALITY server names
+		PrivateKey    string     `json:"private_key"`
+		ShortId       stringList `json:"short_id"`
+		Fingerprint   string     `json:"fingerprint"`
+		SpiderX       string     `json:"spider_x"`
+		AllowInsecure bool       `json:"allowInsecure"`
+		Mldsa65Seed   string     `json:"mldsa65_seed"`
+		Mldsa65Verify string     `json:"mldsa65_verify"`
+		Alpn          []string   `json:"alpn"`
+		MinVersion    string     `json:"min_version"` // 1.0 to 1.3
+		MaxVersion    string     `json:"max_version"`
 	} `json:"tls_settings"`
 	Tls int `json:"tls"`
 }
 
 type trojan struct {
-	Host       string `json:"host"`
-	ServerName string `json:"server_name"`
+	Host       string     `json:"host"`
+	ServerName string     `json:"server_name"`
+	Alpn       []string   `json:"alpn"`
+	Fallbacks  []fallback `json:"fallbacks"`
+}
+
+// hysteria is the Hysteria2 node config, it shares host, server_name and obfs with the other types
+type hysteria struct {
+	Version               int    `json:"version"`
+	UpMbps                int    `json:"up_mbps"`
+	DownMbps              int    `json:"down_mbps"`
+	ObfsPassword          string `json:"obfs-password"`
+	IgnoreClientBandwidth bool   `json:"ignore_client_bandwidth"`
+}
+
+// tuic is the TUIC node config, the ALPN list is shared with trojan
+type tuic struct {
+	CongestionControl string `json:"congestion_control"`
+	UDPRelayMode      string `json:"udp_relay_mode"`
+	ZeroRTTHandshake  bool   `json:"zero_rtt_handshake"`
+}
+
+type fallback struct {
+	SNI  string `json:"server_name"`
+	Alpn string `json:"alpn"`
+	Path string `json:"path"`
+	Dest string `json:"dest"`
+	Xver uint64 `json:"xver"`
 }
 
 type route struct {
@@ -61,13 +217,82 @@ type route struct {
 }
 
 type user struct {
-	Id          int    `json:"id"`
-	Uuid        string `json:"uuid"`
-	SpeedLimit  int    `json:"speed_limit"`
-	DeviceLimit int    `json:"device_limit"`
+	Id             int     `json:"id"`
+	Uuid           string  `json:"uuid"`
+	SpeedLimit     int     `json:"speed_limit"`
+	DeviceLimit    int     `json:"device_limit"`
+	IdleTimeout    int     `json:"idle_timeout"`
+	PolicyID       int     `json:"policy_id"`
+	BurstCredit    int64   `json:"burst_credit"`
+	ResetDay       int     `json:"reset_day"`
+	TrafficQuota   int64   `json:"traffic_quota"`
+	MaxUploadRatio float64 `json:"max_upload_ratio"`
+	Username       string  `json:"username"` // SOCKS/HTTP account, optional
+	Password       string  `json:"password"`
+}
+
+// onlineDelta is the change of the online users since the last report
+type onlineDelta struct {
+	Added   map[int][]string `json:"added"`   // Key: UID, value: IPs
+	Removed map[int][]string `json:"removed"` // Key: UID, value: IPs
+}
+
+type statusReport struct {
+	CPU    float64 `json:"cpu"`    // Percent
+	Mem    float64 `json:"mem"`    // Percent
+	Disk   float64 `json:"disk"`   // Percent
+	Uptime uint64  `json:"uptime"` // Second
+}
+
+type lifecycleEvent struct {
+	Event     string `json:"event"` // online or offline
+	Timestamp int64  `json:"timestamp"`
+	Version   string `json:"version"`
 }
 
 type aips struct {
 	Id       int      `json:"id"`
 	AliveIPs []string `json:"alive_ips"`
 }
+
+// The report shapes, v1 is keyed by UID and v2 is a list of records
+const (
+	reportV1 = 1
+	reportV2 = 2
+)
+
+// trafficV2 is the traffic report in ReportVersion 2
+type trafficV2 struct {
+	Traffics []userTrafficV2 `json:"traffics"`
+}
+
+type userTrafficV2 struct {
+	UID      int   `json:"uid"`
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// onlineV2 is the online report in ReportVersion 2
+type onlineV2 struct {
+	Online []onlineUserV2 `json:"online"`
+}
+
+type onlineUserV2 struct {
+	UID int    `json:"uid"`
+	IP  string `json:"ip,omitempty"`
+	CC  string `json:"cc,omitempty"`
+}
+
+type onlineDevice struct {
+	IP string `json:"ip,omitempty"`
+	CC string `json:"cc,omitempty"`
+}
+
+// countryResolver resolves the country code of an ip
+type countryResolver interface {
+	Country(ip string) string
+}
+
+type banned struct {
+	Users []int `json:"users"`
+}
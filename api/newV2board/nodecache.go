@@ -0,0 +1,29 @@
+package newV2board
+
+import (
+	"encoding/json"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+// loadNodeConfigCache parses the node config of the last successful pull, kept at NodeConfigPath
+func (c *APIClient) loadNodeConfigCache() ([]*api.NodeInfo, error) {
+	data, err := os.ReadFile(c.NodeConfigPath)
+	if err != nil {
+		return nil, err
+	}
+	return c.applyNodeConfig(data)
+}
+
+// saveNodeConfigCache writes the node config to NodeConfigPath, a failure only costs the fallback
+func (c *APIClient) saveNodeConfigCache(b []byte) {
+	if c.NodeConfigPath == "" {
+		return
+	}
+	if err := writeFileAtomic(c.NodeConfigPath, json.RawMessage(b)); err != nil {
+		log.Printf("Save the node config cache %s failed: %s", c.NodeConfigPath, err)
+	}
+}
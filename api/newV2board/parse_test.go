@@ -0,0 +1,551 @@
+package newV2board
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bitly/go-simplejson"
+	"github.com/stretchr/testify/assert"
+	"github.com/xtls/xray-core/infra/conf"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func decodeServerConfig(t *testing.T, data string) *serverConfig {
+	s := new(serverConfig)
+	if err := json.Unmarshal([]byte(data), s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newParseClient(nodeType string) *APIClient {
+	return &APIClient{NodeID: 1, NodeType: nodeType}
+}
+
+func TestParseTransportConfig(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		config   string
+		expected *api.TransportConfig
+	}{
+		{
+			desc:   "ws",
+			config: `{"server_port": 443, "network": "ws", "networkSettings": {"path": "/ws?ed=2048", "headers": {"Host": "ws.test.tk"}}}`,
+			expected: &api.TransportConfig{
+				Network: "ws",
+				Host:    "ws.test.tk",
+				Path:    "/ws?ed=2048",
+				Ed:      2048,
+			},
+		},
+		{
+			desc:   "grpc",
+			config: `{"server_port": 443, "network": "grpc", "networkSettings": {"serviceName": "grpc", "multiMode": true}}`,
+			expected: &api.TransportConfig{
+				Network:     "grpc",
+				ServiceName: "grpc",
+				MultiMode:   true,
+			},
+		},
+		{
+			desc:   "tcp",
+			config: `{"server_port": 443, "network": "tcp", "networkSettings": {"header": {"type": "http"}}}`,
+			expected: &api.TransportConfig{
+				Network: "tcp",
+				Header:  json.RawMessage(`{"type": "http"}`),
+			},
+		},
+		{
+			desc:   "httpupgrade",
+			config: `{"server_port": 443, "network": "httpupgrade", "networkSettings": {"path": "/up", "host": "up.test.tk"}}`,
+			expected: &api.TransportConfig{
+				Network: "httpupgrade",
+				Host:    "up.test.tk",
+				Path:    "/up",
+			},
+		},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.desc, func(t *testing.T) {
+			nodeInfo, err := newParseClient("V2ray").parseV2rayNodeResponse(decodeServerConfig(t, test.config))
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, nodeInfo.Transport)
+		})
+	}
+}
+
+func TestParseTrojanTransportConfig(t *testing.T) {
+	nodeInfo, err := newParseClient("Trojan").parseTrojanNodeResponse(decodeServerConfig(t, `{"server_port": 443}`))
+	assert.NoError(t, err)
+	assert.Equal(t, &api.TransportConfig{Network: "tcp"}, nodeInfo.Transport)
+}
+
+func TestGetNodeRuleRejectsLongPattern(t *testing.T) {
+	client := newParseClient("V2ray")
+	client.RuleMaxLength = 64
+	client.resp.Store(decodeServerConfig(t, `{"server_port": 443, "routes": [
+		{"id": 1, "match": ["baidu.com", "qq.com"], "action": "block"},
+		{"id": 2, "match": ["`+strings.Repeat("a", 100)+`"], "action": "block"}
+	]}`))
+
+	ruleList, err := client.GetNodeRule()
+	assert.NoError(t, err)
+	assert.Len(t, *ruleList, 1)
+	assert.Equal(t, "baidu.com|qq.com", (*ruleList)[0].Pattern.String())
+}
+
+func TestCompileRuleComplexity(t *testing.T) {
+	client := newParseClient("V2ray")
+	client.RuleMaxComplexity = 100
+
+	_, err := client.compileRule("baidu.com")
+	assert.NoError(t, err)
+	_, err = client.compileRule("(a{1,50}){1,50}")
+	assert.Error(t, err)
+}
+
+func TestParseTrojanFallbacks(t *testing.T) {
+	nodeInfo, err := newParseClient("Trojan").parseTrojanNodeResponse(decodeServerConfig(t, `{"server_port": 443, "alpn": ["h2", "http/1.1"],
+		"fallbacks": [{"dest": "80"}, {"alpn": "h2", "path": "/web", "dest": "8080", "xver": 1}]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"h2", "http/1.1"}, nodeInfo.Alpn)
+	assert.Equal(t, []*api.FallbackConfig{
+		{Dest: "80"},
+		{Alpn: "h2", Path: "/web", Dest: "8080", ProxyProtocolVer: 1},
+	}, nodeInfo.Fallbacks)
+
+	// No fallbacks from the panel
+	nodeInfo, err = newParseClient("Trojan").parseTrojanNodeResponse(decodeServerConfig(t, `{"server_port": 443}`))
+	assert.NoError(t, err)
+	assert.Nil(t, nodeInfo.Alpn)
+	assert.Nil(t, nodeInfo.Fallbacks)
+}
+
+func TestReadRuleList(t *testing.T) {
+	ruleList, err := readRuleList(strings.NewReader("baidu.com\nqq.com\n"), 1024, false)
+	assert.NoError(t, err)
+	assert.Len(t, ruleList, 2)
+
+	// gzip content is decompressed
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write([]byte("baidu.com\nqq.com\n"))
+	w.Close()
+	ruleList, err = readRuleList(&b, 1024, false)
+	assert.NoError(t, err)
+	assert.Len(t, ruleList, 2)
+}
+
+func TestReadRuleListGzipBomb(t *testing.T) {
+	// 1 MB of rules compresses to a few kB
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write(bytes.Repeat([]byte("example.com\n"), 1<<20/12))
+	w.Close()
+	assert.Less(t, b.Len(), 8*1024)
+
+	_, err := readRuleList(&b, 64*1024, true)
+	assert.Error(t, err)
+
+	_, err = readRuleList(strings.NewReader(strings.Repeat("example.com\n", 100)), 1024, true)
+	assert.Error(t, err)
+}
+
+func TestReadRuleListInvalid(t *testing.T) {
+	// A rule list fetched from a URL skips the bad rule
+	ruleList, err := readRuleList(strings.NewReader("baidu.com\n(\nqq.com\n"), 1024, true)
+	assert.NoError(t, err)
+	assert.Len(t, ruleList, 2)
+
+	// The local file fails
+	path := filepath.Join(t.TempDir(), "rulelist")
+	assert.NoError(t, os.WriteFile(path, []byte("baidu.com\n(\nqq.com\n"), 0o600))
+	_, err = readRuleListFile(path)
+	assert.Error(t, err)
+}
+
+func TestReadLocalRuleListUncapped(t *testing.T) {
+	defer func(maxSize int64) { defaultRuleListMaxSize = maxSize }(defaultRuleListMaxSize)
+	defaultRuleListMaxSize = 1024
+
+	// Larger than the cap of a rule list fetched from a URL
+	path := filepath.Join(t.TempDir(), "rulelist")
+	assert.NoError(t, os.WriteFile(path, []byte(strings.Repeat("example.com\n", 100)), 0o600))
+	assert.Len(t, readLocalRuleList(path), 100)
+
+	ruleList, err := readRuleListFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, ruleList, 100)
+}
+
+func TestParseSSPorts(t *testing.T) {
+	nodeInfo, err := newParseClient("Shadowsocks").parseSSNodeResponse(decodeServerConfig(t, `{"ports": [
+		{"port": 10001, "cipher": "aes-128-gcm"},
+		{"port": 10002, "cipher": "2022-blake3-aes-128-gcm", "server_key": "key"}
+	]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []*api.SSPortConfig{
+		{Port: 10001, CypherMethod: "aes-128-gcm"},
+		{Port: 10002, CypherMethod: "2022-blake3-aes-128-gcm", ServerKey: "key"},
+	}, nodeInfo.SSPorts)
+	assert.Equal(t, uint32(10001), nodeInfo.Port)
+	assert.Equal(t, "aes-128-gcm", nodeInfo.CypherMethod)
+
+	// Single port
+	nodeInfo, err = newParseClient("Shadowsocks").parseSSNodeResponse(decodeServerConfig(t, `{"server_port": 443, "cipher": "aes-256-gcm"}`))
+	assert.NoError(t, err)
+	assert.Nil(t, nodeInfo.SSPorts)
+	assert.Equal(t, uint32(443), nodeInfo.Port)
+
+	_, err = newParseClient("Shadowsocks").parseSSNodeResponse(decodeServerConfig(t, `{"ports": [{"port": 10001}]}`))
+	assert.Error(t, err)
+}
+
+func TestValidateServerConfig(t *testing.T) {
+	testCases := []struct {
+		nodeType string
+		config   string
+		errMsg   string
+	}{
+		{"V2ray", `{"server_port": 443, "network": "ws"}`, ""},
+		{"V2ray", `{"network": "quic"}`, "invalid V2ray node config: server_port must > 0, invalid network: quic"},
+		{"Vless", `{"server_port": 443, "network": "tcp", "tls": 2}`, "invalid Vless node config: missing tls_settings.private_key, missing tls_settings.server_name"},
+		{"Vmess", `{"server_port": 443, "network": "ws", "tls": 1, "tls_settings": {"min_version": "1.3", "max_version": "1.2"}}`, "invalid Vmess node config: tls_settings.min_version 1.3 is above max_version 1.2"},
+		{"Vmess", `{"server_port": 443, "network": "ws", "tls": 1, "tls_settings": {"max_version": "3"}}`, "invalid Vmess node config: invalid tls_settings.max_version: 3"},
+		{"Trojan", `{"server_port": 443}`, ""},
+		{"Shadowsocks", `{"server_port": 70000}`, "invalid Shadowsocks node config: invalid server_port: 70000, missing cipher"},
+		{"Hysteria2", `{"server_port": 443, "obfs": "salamander"}`, "invalid Hysteria2 node config: missing obfs-password"},
+		{"Hysteria2", `{"server_port": 443, "version": 1, "obfs": "http"}`, "invalid Hysteria2 node config: unsupported hysteria version: 1, invalid obfs: http"},
+		{"TUIC", `{"server_port": 443, "congestion_control": "reno", "udp_relay_mode": "tcp"}`, "invalid TUIC node config: invalid congestion_control: reno, invalid udp_relay_mode: tcp"},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.config, func(t *testing.T) {
+			_, err := newParseClient(test.nodeType).parseNodeResponse(decodeServerConfig(t, test.config))
+			if test.errMsg == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, test.errMsg)
+			}
+		})
+	}
+}
+
+func FuzzParseNodeResponse(f *testing.F) {
+	f.Add([]byte(`{"server_port": 443, "network": "ws", "networkSettings": {"path": "/ws?ed=2048", "headers": {"Host": "ws.test.tk"}}}`))
+	f.Add([]byte(`{"server_port": 443, "network": "tcp", "networkSettings": {"header": {"type": "http"}}, "tls": 2}`))
+	f.Add([]byte(`[{"node_type": "trojan", "server_port": 443, "fallbacks": [{"dest": "80"}]}, {"node_type": "shadowsocks", "ports": [{"port": 1, "cipher": "aes-128-gcm"}]}]`))
+	f.Add([]byte(`{"server_port": 443, "cipher": "aes-128-gcm", "obfs": "http", "obfs_settings": {"path": "p"}}`))
+	f.Add([]byte(`{"networkSettings": {"headers": 5}}`))
+	f.Add([]byte(`[{"ports":[{}]}]`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		servers, err := decodeServerConfigs(data)
+		if err != nil {
+			return
+		}
+		for _, server := range servers {
+			for _, nodeType := range []string{"V2ray", "Trojan", "Shadowsocks", "Hysteria2", "TUIC"} {
+				nodeInfo, err := newParseClient(nodeType).parseNodeResponse(server)
+				if err != nil {
+					assert.NotEmpty(t, err.Error())
+					continue
+				}
+				assert.NotZero(t, nodeInfo.Port)
+			}
+		}
+	})
+}
+
+func TestParseNodeName(t *testing.T) {
+	client := newParseClient("Trojan")
+	nodeInfo, err := client.parseNodeResponse(decodeServerConfig(t, `{"server_port": 443, "name": "HK 01", "region": "HK"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "HK 01", nodeInfo.Name)
+	assert.Equal(t, "HK", nodeInfo.Region)
+
+	// Default to the NodeID
+	nodeInfo, err = client.parseNodeResponse(decodeServerConfig(t, `{"server_port": 443}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "1", nodeInfo.Name)
+	assert.Empty(t, nodeInfo.Region)
+	assert.Equal(t, "1", client.Describe().Name)
+
+	client.resp.Store(decodeServerConfig(t, `{"server_port": 443, "name": "HK 01", "region": "HK"}`))
+	assert.Equal(t, "HK 01", client.Describe().Name)
+	assert.Equal(t, "HK", client.Describe().Region)
+}
+
+func TestParseAllowInsecure(t *testing.T) {
+	nodeInfo, err := newParseClient("Vmess").parseV2rayNodeResponse(decodeServerConfig(t, `{"server_port": 443, "network": "tcp", "tls": 1,
+		"tls_settings": {"server_name": "www.example.com", "allowInsecure": true}}`))
+	assert.NoError(t, err)
+	assert.True(t, nodeInfo.AllowInsecure)
+
+	nodeInfo, err = newParseClient("Trojan").parseTrojanNodeResponse(decodeServerConfig(t, `{"server_port": 443, "tls_settings": {"allowInsecure": true}}`))
+	assert.NoError(t, err)
+	assert.True(t, nodeInfo.AllowInsecure)
+
+	// Verify by default
+	nodeInfo, err = newParseClient("Trojan").parseTrojanNodeResponse(decodeServerConfig(t, `{"server_port": 443}`))
+	assert.NoError(t, err)
+	assert.False(t, nodeInfo.AllowInsecure)
+}
+
+func TestParseTLSSettings(t *testing.T) {
+	nodeInfo, err := newParseClient("Vmess").parseNodeResponse(decodeServerConfig(t, `{"server_port": 443, "network": "ws", "tls": 1,
+		"tls_settings": {"alpn": ["h2"], "min_version": "1.2", "max_version": "1.3"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"h2"}, nodeInfo.Alpn)
+	assert.Equal(t, "1.2", nodeInfo.MinTLSVersion)
+	assert.Equal(t, "1.3", nodeInfo.MaxTLSVersion)
+
+	// The xray defaults
+	nodeInfo, err = newParseClient("Vmess").parseNodeResponse(decodeServerConfig(t, `{"server_port": 443, "network": "ws", "tls": 1}`))
+	assert.NoError(t, err)
+	assert.Nil(t, nodeInfo.Alpn)
+	assert.Empty(t, nodeInfo.MinTLSVersion)
+	assert.Empty(t, nodeInfo.MaxTLSVersion)
+}
+
+func TestParseTCPFastOpen(t *testing.T) {
+	testCases := []struct {
+		tfo  string
+		want interface{}
+	}{
+		{``, nil},
+		{`, "tcp_fast_open": null`, nil},
+		{`, "tcp_fast_open": true`, true},
+		{`, "tcp_fast_open": false`, false},
+		{`, "tcp_fast_open": 512`, float64(512)},
+		{`, "tcp_fast_open": -1`, nil},
+		{`, "tcp_fast_open": 1.5`, nil},
+		{`, "tcp_fast_open": "on"`, nil},
+	}
+	for _, c := range testCases {
+		nodeInfo, err := newParseClient("Vmess").parseV2rayNodeResponse(decodeServerConfig(t, `{"server_port": 443, "network": "tcp"`+c.tfo+`}`))
+		assert.NoError(t, err)
+		assert.Equal(t, c.want, nodeInfo.TCPFastOpen, c.tfo)
+
+		nodeInfo, err = newParseClient("Trojan").parseTrojanNodeResponse(decodeServerConfig(t, `{"server_port": 443`+c.tfo+`}`))
+		assert.NoError(t, err)
+		assert.Equal(t, c.want, nodeInfo.TCPFastOpen, c.tfo)
+	}
+}
+
+func TestParseHysteria2(t *testing.T) {
+	nodeInfo, err := newParseClient("Hysteria2").parseNodeResponse(decodeServerConfig(t, `{"server_port": 443, "version": 2, "host": "hy.test.tk",
+		"up_mbps": 100, "down_mbps": 200, "obfs": "salamander", "obfs-password": "secret"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(443), nodeInfo.Port)
+	assert.Equal(t, "hy.test.tk", nodeInfo.Host)
+	assert.True(t, nodeInfo.EnableTLS)
+	assert.Equal(t, &api.Hysteria2Config{
+		UpMbps:       100,
+		DownMbps:     200,
+		Obfs:         "salamander",
+		ObfsPassword: "secret",
+	}, nodeInfo.Hysteria2Config)
+
+	// The server name wins over the host, no obfs by default
+	nodeInfo, err = newParseClient("Hysteria2").parseNodeResponse(decodeServerConfig(t, `{"server_port": 443, "host": "hy.test.tk", "server_name": "sni.test.tk"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "sni.test.tk", nodeInfo.Host)
+	assert.Empty(t, nodeInfo.Hysteria2Config.Obfs)
+	assert.Zero(t, nodeInfo.Hysteria2Config.UpMbps)
+}
+
+func TestParseTUIC(t *testing.T) {
+	nodeInfo, err := newParseClient("TUIC").parseNodeResponse(decodeServerConfig(t, `{"server_port": 443, "server_name": "tuic.test.tk",
+		"congestion_control": "cubic", "udp_relay_mode": "quic", "zero_rtt_handshake": true, "alpn": ["h3", "spdy/3.1"]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "tuic.test.tk", nodeInfo.Host)
+	assert.True(t, nodeInfo.EnableTLS)
+	assert.Equal(t, []string{"h3", "spdy/3.1"}, nodeInfo.Alpn)
+	assert.Equal(t, &api.TUICConfig{CongestionControl: "cubic", UDPRelayMode: "quic", ZeroRTTHandshake: true}, nodeInfo.TUICConfig)
+
+	nodeInfo, err = newParseClient("TUIC").parseNodeResponse(decodeServerConfig(t, `{"server_port": 443}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"h3"}, nodeInfo.Alpn)
+	assert.Equal(t, &api.TUICConfig{CongestionControl: "bbr", UDPRelayMode: "native"}, nodeInfo.TUICConfig)
+}
+
+func TestParseREALITYClientSettings(t *testing.T) {
+	nodeInfo, err := newParseClient("Vless").parseV2rayNodeResponse(decodeServerConfig(t, `{"server_port": 443, "network": "tcp", "tls": 2,
+		"tls_settings": {"server_name": "www.example.com", "private_key": "key", "fingerprint": "firefox", "spider_x": "/search"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "firefox", nodeInfo.REALITYConfig.Fingerprint)
+	assert.Equal(t, "/search", nodeInfo.REALITYConfig.SpiderX)
+
+	nodeInfo, err = newParseClient("Vless").parseV2rayNodeResponse(decodeServerConfig(t, `{"server_port": 443, "network": "tcp", "tls": 2,
+		"tls_settings": {"server_name": "www.example.com", "private_key": "key"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, defaultFingerprint, nodeInfo.REALITYConfig.Fingerprint)
+	assert.Equal(t, defaultSpiderX, nodeInfo.REALITYConfig.SpiderX)
+}
+
+func TestParseREALITYServerNamePool(t *testing.T) {
+	testCases := []struct {
+		tlsSettings string
+		serverNames []string
+		shortIds    []string
+	}{
+		{`"server_name": "a.example.com", "short_id": "0123"`, []string{"a.example.com"}, []string{"0123"}},
+		{`"server_name": "a.example.com, b.example.com", "short_id": "0123,,4567"`, []string{"a.example.com", "b.example.com"}, []string{"0123", "", "4567"}},
+		{`"server_name": ["a.example.com", "b.example.com"], "short_id": ["0123", "4567"]`, []string{"a.example.com", "b.example.com"}, []string{"0123", "4567"}},
+		{`"server_name": "a.example.com"`, []string{"a.example.com"}, []string{""}},
+	}
+	for _, test := range testCases {
+		t.Run(test.tlsSettings, func(t *testing.T) {
+			nodeInfo, err := newParseClient("Vless").parseNodeResponse(decodeServerConfig(t, `{"server_port": 443, "network": "tcp", "tls": 2,
+				"tls_settings": {"private_key": "key", `+test.tlsSettings+`}}`))
+			assert.NoError(t, err)
+			assert.Equal(t, test.serverNames, nodeInfo.REALITYConfig.ServerNames)
+			assert.Equal(t, test.shortIds, nodeInfo.REALITYConfig.ShortIds)
+			// Without a dest the first server name is the target
+			assert.Equal(t, "a.example.com:", nodeInfo.REALITYConfig.Dest)
+		})
+	}
+
+	s := new(serverConfig)
+	assert.Error(t, json.Unmarshal([]byte(`{"tls_settings": {"server_name": 1}}`), s))
+}
+
+func TestParseREALITYMldsa65(t *testing.T) {
+	nodeInfo, err := newParseClient("Vless").parseV2rayNodeResponse(decodeServerConfig(t, `{"server_port": 443, "network": "tcp", "tls": 2,
+		"tls_settings": {"server_name": "www.example.com", "private_key": "key", "mldsa65_seed": "seed", "mldsa65_verify": "verify"}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "seed", nodeInfo.REALITYConfig.Mldsa65Seed)
+	assert.Equal(t, "verify", nodeInfo.REALITYConfig.Mldsa65Verify)
+
+	// Unset by default
+	nodeInfo, err = newParseClient("Vless").parseV2rayNodeResponse(decodeServerConfig(t, `{"server_port": 443, "network": "tcp", "tls": 2,
+		"tls_settings": {"server_name": "www.example.com", "private_key": "key"}}`))
+	assert.NoError(t, err)
+	assert.Empty(t, nodeInfo.REALITYConfig.Mldsa65Seed)
+	assert.Empty(t, nodeInfo.REALITYConfig.Mldsa65Verify)
+}
+
+func TestParseTransportTuning(t *testing.T) {
+	nodeInfo, err := newParseClient("V2ray").parseNodeResponse(decodeServerConfig(t, `{"server_port": 443, "network": "kcp",
+		"transport_tuning": {"mtu": 1350, "tti": 20, "uplink_capacity": 50, "downlink_capacity": 100, "read_buffer_size": 4, "write_buffer_size": 4096, "tcp_window_clamp": 600}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, &api.TransportTuning{
+		KCPMtu:              1350,
+		KCPTti:              20,
+		KCPUplinkCapacity:   50,
+		KCPDownlinkCapacity: 100,
+		KCPReadBufferSize:   4,
+		TCPWindowClamp:      600,
+	}, nodeInfo.TransportTuning) // write_buffer_size is out of range
+
+	nodeInfo, err = newParseClient("V2ray").parseNodeResponse(decodeServerConfig(t, `{"server_port": 443, "network": "kcp",
+		"transport_tuning": {"mtu": 9000, "tti": 5}}`))
+	assert.NoError(t, err)
+	assert.Equal(t, &api.TransportTuning{}, nodeInfo.TransportTuning)
+
+	nodeInfo, err = newParseClient("V2ray").parseNodeResponse(decodeServerConfig(t, `{"server_port": 443, "network": "tcp"}`))
+	assert.NoError(t, err)
+	assert.Nil(t, nodeInfo.TransportTuning)
+}
+
+func TestGetRoutingRules(t *testing.T) {
+	client := newParseClient("V2ray")
+	client.resp.Store(decodeServerConfig(t, `{"server_port": 443, "routes": [
+		{"id": 1, "match": ["netflix.com", "domain:nflxvideo.net"], "action": "route", "action_value": "hk_egress"},
+		{"id": 2, "match": ["example.com"], "action": "block"},
+		{"id": 3, "match": ["openai.com"], "action": "route"}
+	]}`))
+
+	ruleList, err := client.GetRoutingRules()
+	assert.NoError(t, err)
+	assert.Equal(t, []api.RoutingRule{
+		{ID: 1, Domain: []string{"netflix.com", "domain:nflxvideo.net"}, OutboundTag: "hk_egress"},
+	}, *ruleList)
+}
+
+func TestDecodeUsers(t *testing.T) {
+	users, err := decodeUsers(strings.NewReader(`{"meta": {"total": 2}, "users": [{"id": 1, "uuid": "a", "speed_limit": 10}, {"id": 2, "uuid": "b", "device_limit": 3}], "extra": [1, 2]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []*user{{Id: 1, Uuid: "a", SpeedLimit: 10}, {Id: 2, Uuid: "b", DeviceLimit: 3}}, users)
+
+	users, err = decodeUsers(strings.NewReader(`{"users": null}`))
+	assert.NoError(t, err)
+	assert.Empty(t, users)
+
+	for _, body := range []string{``, `[]`, `{"users": {}}`, `{"users": [{"id": "x"}]}`, `{"users": [{"id": 1}`} {
+		_, err = decodeUsers(strings.NewReader(body))
+		assert.Error(t, err, body)
+	}
+}
+
+func userListBody(n int) []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"users": [`)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, `{"id": %d, "uuid": "3b8c1a2e-5d4f-4e6a-9b7c-%012d", "speed_limit": 100, "device_limit": 3}`, i, i)
+	}
+	b.WriteString(`]}`)
+	return b.Bytes()
+}
+
+// BenchmarkDecodeUsersSimplejson is the former decoding, for comparison
+func BenchmarkDecodeUsersSimplejson(b *testing.B) {
+	body := userListBody(10000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var users []*user
+		resp, err := simplejson.NewJson(body)
+		if err != nil {
+			b.Fatal(err)
+		}
+		data, _ := resp.Get("users").Encode()
+		if err := json.Unmarshal(data, &users); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeUsers(b *testing.B) {
+	body := userListBody(10000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeUsers(bytes.NewReader(body)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestParseDNSConfig(t *testing.T) {
+	s := decodeServerConfig(t, `{"server_port": 443, "routes": [
+		{"id": 1, "match": ["netflix.com"], "action": "dns", "action_value": "1.1.1.1"},
+		{"id": 2, "match": ["example.com"], "action": "dns", "action_value": "{\"address\": \"8.8.8.8\", \"port\": 53, \"queryStrategy\": \"UseIPv4\", \"expectIps\": [\"geoip:us\"]}"},
+		{"id": 3, "match": ["example.org"], "action": "dns", "action_value": "{\"address\": \"9.9.9.9\", \"queryStrategy\": \"UseIPv5\"}"},
+		{"id": 4, "match": ["example.net"], "action": "dns", "action_value": "{\"port\": 53}"},
+		{"id": 5, "match": ["baidu.com"], "action": "block"}
+	]}`)
+	nameServers := s.parseDNSConfig()
+	assert.Len(t, nameServers, 2)
+
+	// Bare addresses as before
+	assert.Equal(t, "1.1.1.1", nameServers[0].Address.String())
+	assert.Equal(t, []string{"netflix.com"}, nameServers[0].Domains)
+	assert.Empty(t, nameServers[0].QueryStrategy)
+
+	assert.Equal(t, "8.8.8.8", nameServers[1].Address.String())
+	assert.Equal(t, uint16(53), nameServers[1].Port)
+	assert.Equal(t, "UseIPv4", nameServers[1].QueryStrategy)
+	assert.Equal(t, conf.StringList{"geoip:us"}, nameServers[1].ExpectIPs)
+	assert.Equal(t, []string{"example.com"}, nameServers[1].Domains)
+}
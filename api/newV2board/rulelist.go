@@ -0,0 +1,206 @@
+package newV2board
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-resty/resty/v2"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+// isRuleListURL reports whether the RuleListPath is to be fetched over HTTP
+func isRuleListURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// remoteRuleList is a rule list fetched from a URL, the last fetched rules are kept until a refresh succeeds
+type remoteRuleList struct {
+	url      string
+	client   *resty.Client
+	interval time.Duration // 0 means fetch once
+	maxSize  int64
+	mu       sync.RWMutex
+	rules    []api.DetectRule
+	eTag     string
+	done     chan struct{}
+}
+
+// newRemoteRuleList starts fetching the rule list at url in the background, it has no rules until the first fetch succeeds
+func newRemoteRuleList(url string, client *resty.Client, interval time.Duration, maxSize int64) *remoteRuleList {
+	if maxSize <= 0 {
+		maxSize = defaultRuleListMaxSize
+	}
+	r := &remoteRuleList{
+		url:      url,
+		client:   newRuleListClient(client),
+		interval: interval,
+		maxSize:  maxSize,
+		rules:    make([]api.DetectRule, 0),
+		done:     make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// newRuleListClient copies the timeout, retries and User-Agent of the panel client. The rule list may be
+// served by anyone, so the base URL, token, signature and client certificate of the panel are left out.
+func newRuleListClient(client *resty.Client) *resty.Client {
+	return resty.New().
+		SetTimeout(client.GetClient().Timeout).
+		SetRetryCount(client.RetryCount).
+		SetRetryWaitTime(client.RetryWaitTime).
+		SetRetryMaxWaitTime(client.RetryMaxWaitTime).
+		SetHeader("User-Agent", client.Header.Get("User-Agent"))
+}
+
+// run fetches the rule list, then again every refresh interval until close
+func (r *remoteRuleList) run() {
+	if err := r.fetch(); err != nil {
+		log.Printf("Fetch the rule list %s failed: %s", r.url, err)
+	}
+	if r.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.fetch(); err != nil {
+				log.Printf("Refresh the rule list %s failed, keep the last one: %s", r.url, err)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// fetch gets the rule list and swaps in its rules, the lock is only held for the swap
+func (r *remoteRuleList) fetch() error {
+	r.mu.RLock()
+	eTag := r.eTag
+	r.mu.RUnlock()
+	req := r.client.R().SetDoNotParseResponse(true)
+	if eTag != "" {
+		req.SetHeader("If-None-Match", eTag)
+	}
+	res, err := req.Get(r.url)
+	if err != nil {
+		return err
+	}
+	body := res.RawBody()
+	defer body.Close()
+	switch res.StatusCode() {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil
+	default:
+		return fmt.Errorf("unexpected status %d", res.StatusCode())
+	}
+	// A bad line must not take the node down, the list may come from anywhere
+	rules, err := readRuleList(body, r.maxSize, true)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.rules = rules
+	r.eTag = res.Header().Get("Etag")
+	r.mu.Unlock()
+	return nil
+}
+
+// get returns the last fetched rules
+func (r *remoteRuleList) get() []api.DetectRule {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return slices.Clone(r.rules)
+}
+
+// close stops the refresh
+func (r *remoteRuleList) close() {
+	close(r.done)
+}
+
+// ruleListReloadDelay lets an editor finish writing the rule list before it is read
+const ruleListReloadDelay = 500 * time.Millisecond
+
+// ReloadLocalRuleList reads the RuleListPath again and swaps in its rules, a failed read keeps the current ones
+func (c *APIClient) ReloadLocalRuleList() error {
+	if c.RuleListPath == "" || isRuleListURL(c.RuleListPath) {
+		return fmt.Errorf("no local rule list to reload: %q", c.RuleListPath)
+	}
+	ruleList, err := readRuleListFile(c.RuleListPath)
+	if err != nil {
+		return err
+	}
+	c.ruleListMu.Lock()
+	c.LocalRuleList = ruleList
+	c.ruleListMu.Unlock()
+	log.Printf("Reloaded %d rules from %s", len(ruleList), c.RuleListPath)
+	return nil
+}
+
+// watchLocalRuleList reloads the rule list whenever its file changes until Close. The directory is watched,
+// editors often replace the file instead of writing it.
+func (c *APIClient) watchLocalRuleList() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	path := filepath.Clean(c.RuleListPath)
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	c.ruleListWatcher = watcher
+	go func() {
+		var reload *time.Timer
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					if reload != nil {
+						reload.Stop()
+					}
+					return
+				}
+				if filepath.Clean(event.Name) != path || event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				if reload != nil {
+					reload.Stop()
+				}
+				reload = time.AfterFunc(ruleListReloadDelay, func() {
+					if err := c.ReloadLocalRuleList(); err != nil {
+						log.Printf("Reload the rule list %s failed, keep the current one: %s", path, err)
+					}
+				})
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Watch the rule list %s failed: %s", path, err)
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops refreshing and watching the rule list
+func (c *APIClient) Close() error {
+	if c.remoteRuleList != nil {
+		c.remoteRuleList.close()
+	}
+	if c.ruleListWatcher != nil {
+		return c.ruleListWatcher.Close()
+	}
+	return nil
+}
@@ -2,11 +2,27 @@ package newV2board
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/url"
 	"os"
 	"regexp"
+	"regexp/syntax"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -16,34 +32,96 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/bitly/go-simplejson"
+	"github.com/fsnotify/fsnotify"
 	"github.com/go-resty/resty/v2"
 	"github.com/xtls/xray-core/common/net"
 	"github.com/xtls/xray-core/infra/conf"
 
 	"github.com/XrayR-project/XrayR/api"
+	"github.com/XrayR-project/XrayR/common/geoip"
 )
 
 // APIClient create an api client to the panel.
 type APIClient struct {
-	client           *resty.Client
-	APIHost          string
-	NodeID           int
-	Key              string
-	NodeType         string
-	EnableVless      bool
-	VlessFlow        string
-	SpeedLimit       float64
-	DeviceLimit      int
-	LocalRuleList    []api.DetectRule
-	LastReportOnline map[int]int
-	resp             atomic.Value
-	eTags            map[string]string
+	client            *resty.Client
+	doer              httpDoer
+	APIHost           string
+	NodeID            int
+	Key               string
+	NodeType          string
+	NodeTypeAliases   map[string]string // Key: lower case panel node type, value: XrayR node type
+	EnableVless       bool
+	VlessFlow         string
+	SpeedLimit        float64
+	DeviceLimit       int
+	DeviceMultiplier  float64
+	LocalRuleList     []api.DetectRule
+	RuleListPath      string
+	ruleListMu        sync.RWMutex // Guards LocalRuleList, the file may be reloaded meanwhile
+	ruleListWatcher   *fsnotify.Watcher
+	remoteRuleList    *remoteRuleList // When the RuleListPath is a URL
+	RuleMaxLength     int
+	RuleMaxComplexity int
+	SuppressOnlineIP  bool
+	OnlineByIP        bool // Report the online users as { IP1:[UID1,UID2] }, the panel must support it
+	OnlineDelta       bool // Report only the online IPs changed since the last report, the panel must support it
+	OnlineFullSync    int  // Reports between full snapshots in delta mode
+	ReportVersion     int  // Shape of the traffic and online reports, reportV1 or reportV2
+	TrafficMultiplier float64
+	MinReportInterval time.Duration
+	MinTrafficReport  int64 // Byte
+	TrafficBatchSize  int   // Users in each traffic report request, 0 means all in one
+	CompressReports   bool  // gzip the traffic and online reports
+	FullRefresh       int
+	LifecycleEndpoint string
+	KeyFile           string
+	Endpoints         map[string]string // Key: operation, value: path
+	keyMu             sync.Mutex
+	LastReportOnline  map[int]int
+	lastOnline        map[int]map[string]bool // Key: UID, value: the IPs in the last accepted online report, nil to send a full snapshot
+	onlineReports     int
+	geoIP             countryResolver
+	resp              atomic.Value
+	eTagMu            sync.Mutex // Guards eTags, pullCounts and cachedBodies, the pulls may run concurrently
+	eTags             map[string]string
+	pullCounts        map[string]int             // Key: ETag key, value: pulls since start
+	ETagCachePath     string                     // Keeps the ETags and bodies across restarts
+	NodeConfigPath    string                     // Keeps the last node config to start from when the panel is unreachable
+	eTagCacheMu       sync.Mutex                 // Guards eTagCache and the file at ETagCachePath
+	eTagCache         map[string]*eTagCacheEntry // Key: ETag key, value: the entry in the file at ETagCachePath
+	cachedBodies      map[string][]byte          // Key: ETag key, value: the body loaded from ETagCachePath, until served
+	usersLoaded       atomic.Bool
+	paused            atomic.Bool
+	trafficMu         sync.Mutex
+	pendingTraffic    map[int][2]int64 // Key: UID, value: [upload, download] not yet accepted by the panel
+	lastReport        time.Time
+	reportTimer       *time.Timer
 }
 
 // New create an api instance
 func New(apiConfig *api.Config) *APIClient {
 	client := resty.New()
 	client.SetRetryCount(3)
+	if apiConfig.RetryWaitMin > 0 {
+		client.SetRetryWaitTime(time.Duration(apiConfig.RetryWaitMin) * time.Millisecond)
+	}
+	if apiConfig.RetryWaitMax > 0 {
+		client.SetRetryMaxWaitTime(time.Duration(apiConfig.RetryWaitMax) * time.Millisecond)
+	}
+	// A rate limited request is retried after the wait the panel asks for
+	maxWait := maxRetryAfter(apiConfig)
+	client.AddRetryCondition(func(res *resty.Response, _ error) bool {
+		return retryTooManyRequests(res, maxWait)
+	})
+	client.SetRetryAfter(func(c *resty.Client, res *resty.Response) (time.Duration, error) {
+		if wait, ok := retryAfter(res, time.Now()); ok {
+			return waitRetryAfter(c, res, wait)
+		}
+		if apiConfig.RetryJitter {
+			return retryJitter(c, res)
+		}
+		return 0, nil // The default backoff
+	})
 	if apiConfig.Timeout > 0 {
 		client.SetTimeout(time.Duration(apiConfig.Timeout) * time.Second)
 	} else {
@@ -57,39 +135,217 @@ func New(apiConfig *api.Config) *APIClient {
 		}
 	})
 	client.SetBaseURL(apiConfig.APIHost)
+	// Present a client certificate to panels requiring mutual TLS
+	var certs []tls.Certificate
+	if apiConfig.ClientCertPath != "" || apiConfig.ClientKeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(apiConfig.ClientCertPath, apiConfig.ClientKeyPath)
+		if err != nil {
+			log.Panicf("Load client certificate %s and key %s failed: %s", apiConfig.ClientCertPath, apiConfig.ClientKeyPath, err)
+		}
+		certs = append(certs, cert)
+		client.SetCertificates(cert)
+	}
+	// Sign every request so the panel can verify it was not tampered with
+	if apiConfig.SigningSecret != "" {
+		secret := []byte(apiConfig.SigningSecret)
+		client.SetPreRequestHook(func(_ *resty.Client, req *http.Request) error {
+			return signRequest(req, secret, time.Now())
+		})
+	}
+
+	// Panel specific node types map to the XrayR ones, the keys are case insensitive
+	nodeTypeAliases := make(map[string]string, len(apiConfig.NodeTypeAliases))
+	for alias, nodeType := range apiConfig.NodeTypeAliases {
+		nodeTypeAliases[strings.ToLower(alias)] = nodeType
+	}
+	nodeType := apiConfig.NodeType
+	if t, ok := nodeTypeAliases[strings.ToLower(nodeType)]; ok {
+		nodeType = t
+	}
 
 	// Create Key for each requests
 	nodeType_for_requests := func() string {
-		if apiConfig.NodeType == "V2ray" && apiConfig.EnableVless {
+		if nodeType == "V2ray" && apiConfig.EnableVless {
 			return "vless"
+		} else if nodeType == "Hysteria2" {
+			// V2board serves both versions as hysteria
+			return "hysteria"
+		} else if nodeType == "TUIC" {
+			return "tuic"
 		} else {
-			return apiConfig.NodeType
+			return nodeType
 		}
 	}()
 
-	client.SetQueryParams(map[string]string{
+	query := map[string]string{
 		"node_id":   strconv.Itoa(apiConfig.NodeID),
 		"node_type": strings.ToLower(nodeType_for_requests),
 		"token":     apiConfig.Key,
-	})
-	// Read local rule list
-	localRuleList := readLocalRuleList(apiConfig.RuleListPath)
+	}
+	client.SetQueryParams(query)
+	// Let the panel tell the versions and nodes apart
+	userAgent := apiConfig.UserAgent
+	if userAgent == "" {
+		userAgent = fmt.Sprintf("XrayR/%s", api.Version)
+	}
+	client.SetHeader("User-Agent", fmt.Sprintf("%s (node %d)", userAgent, apiConfig.NodeID))
+	for operation := range apiConfig.Endpoints {
+		if _, ok := defaultEndpoints[operation]; !ok {
+			log.Printf("Unknown endpoint %s, it is ignored", operation)
+		}
+	}
+	// Read local rule list, or fetch it
+	var localRuleList []api.DetectRule
+	var remoteRules *remoteRuleList
+	if isRuleListURL(apiConfig.RuleListPath) {
+		remoteRules = newRemoteRuleList(apiConfig.RuleListPath, client, time.Duration(apiConfig.RuleListRefreshInterval)*time.Second, apiConfig.RuleListMaxSize*1024)
+	} else {
+		localRuleList = readLocalRuleList(apiConfig.RuleListPath)
+	}
+	// Load the mmdb to annotate online users with their country
+	var geoIP countryResolver
+	if apiConfig.GeoIPPath != "" {
+		if reader, err := geoip.Open(apiConfig.GeoIPPath); err != nil {
+			log.Printf("Error when opening geoip database: %s", err)
+		} else {
+			geoIP = reader
+		}
+	}
+	// A multiplier of 0 or less keeps the real traffic
+	trafficMultiplier := apiConfig.TrafficMultiplier
+	if trafficMultiplier < 0 {
+		log.Printf("Invalid traffic multiplier %v, use 1", trafficMultiplier)
+	}
+	if trafficMultiplier <= 0 {
+		trafficMultiplier = 1
+	}
+	onlineDelta := apiConfig.OnlineReportDelta
+	if onlineDelta && apiConfig.SuppressOnlineIP {
+		log.Print("OnlineReportDelta reports the IPs of online users, it is ignored with SuppressOnlineIP")
+		onlineDelta = false
+	}
+	onlineFullSync := apiConfig.OnlineFullSync
+	if onlineFullSync <= 0 {
+		onlineFullSync = defaultOnlineFullSync
+	}
+	reportVersion := apiConfig.ReportVersion
+	switch reportVersion {
+	case 0:
+		reportVersion = reportV1
+	case reportV1, reportV2:
+	default:
+		log.Printf("Unsupported report version %d, use 1", reportVersion)
+		reportVersion = reportV1
+	}
+	if reportVersion == reportV2 && (onlineDelta || strings.EqualFold(apiConfig.OnlineReportFormat, "ip")) {
+		log.Print("OnlineReportDelta and OnlineReportFormat are for report version 1, they are ignored")
+		onlineDelta = false
+	}
+	deviceMultiplier := apiConfig.DeviceLimitMultiplier
+	if deviceMultiplier < 0 {
+		log.Printf("Invalid device limit multiplier %v, use 1", deviceMultiplier)
+	}
+	if deviceMultiplier <= 0 {
+		deviceMultiplier = 1
+	}
 	apiClient := &APIClient{
-		client:        client,
-		NodeID:        apiConfig.NodeID,
-		Key:           apiConfig.Key,
-		APIHost:       apiConfig.APIHost,
-		NodeType:      apiConfig.NodeType,
-		EnableVless:   apiConfig.EnableVless,
-		VlessFlow:     apiConfig.VlessFlow,
-		SpeedLimit:    apiConfig.SpeedLimit,
-		DeviceLimit:   apiConfig.DeviceLimit,
-		LocalRuleList: localRuleList,
-		eTags:         make(map[string]string),
+		client:            client,
+		doer:              &restyDoer{client: client},
+		NodeID:            apiConfig.NodeID,
+		Key:               apiConfig.Key,
+		APIHost:           apiConfig.APIHost,
+		NodeType:          nodeType,
+		NodeTypeAliases:   nodeTypeAliases,
+		EnableVless:       apiConfig.EnableVless,
+		VlessFlow:         apiConfig.VlessFlow,
+		SpeedLimit:        apiConfig.SpeedLimit,
+		DeviceLimit:       apiConfig.DeviceLimit,
+		DeviceMultiplier:  deviceMultiplier,
+		LocalRuleList:     localRuleList,
+		RuleListPath:      apiConfig.RuleListPath,
+		remoteRuleList:    remoteRules,
+		RuleMaxLength:     apiConfig.RuleMaxLength,
+		RuleMaxComplexity: apiConfig.RuleMaxComplexity,
+		SuppressOnlineIP:  apiConfig.SuppressOnlineIP,
+		OnlineByIP:        strings.EqualFold(apiConfig.OnlineReportFormat, "ip") && reportVersion == reportV1,
+		OnlineDelta:       onlineDelta,
+		OnlineFullSync:    onlineFullSync,
+		ReportVersion:     reportVersion,
+		TrafficMultiplier: trafficMultiplier,
+		MinReportInterval: time.Duration(apiConfig.MinReportInterval) * time.Second,
+		MinTrafficReport:  apiConfig.MinTrafficReport * 1024,
+		TrafficBatchSize:  apiConfig.TrafficReportBatchSize,
+		CompressReports:   apiConfig.CompressTrafficReport,
+		LifecycleEndpoint: apiConfig.LifecycleEndpoint,
+		KeyFile:           apiConfig.KeyFile,
+		Endpoints:         apiConfig.Endpoints,
+		geoIP:             geoIP,
+		eTags:             make(map[string]string),
+		pullCounts:        make(map[string]int),
+		ETagCachePath:     apiConfig.ETagCachePath,
+		NodeConfigPath:    apiConfig.NodeConfigCachePath,
+		cachedBodies:      make(map[string][]byte),
+		eTagCache:         make(map[string]*eTagCacheEntry),
+		FullRefresh:       apiConfig.FullRefreshInterval,
+	}
+	if apiClient.ETagCachePath != "" {
+		apiClient.loadETagCache()
+	}
+	if apiConfig.WatchRuleList && apiConfig.RuleListPath != "" && remoteRules == nil {
+		if err := apiClient.watchLocalRuleList(); err != nil {
+			log.Printf("Watch the rule list %s failed: %s", apiConfig.RuleListPath, err)
+		}
+	}
+	switch strings.ToLower(apiConfig.Transport) {
+	case "", "rest":
+		if metricsEnabled {
+			apiClient.observeRequests(client)
+		}
+	case "grpc":
+		target, creds, err := grpcTarget(apiConfig.APIHost, certs)
+		if err != nil {
+			log.Panicf("Parse gRPC panel address failed: %s", err)
+		}
+		if err := apiClient.useGRPC(target, query, apiConfig, creds); err != nil {
+			log.Panicf("Create gRPC client failed: %s", err)
+		}
+	default:
+		log.Panicf("Unsupported transport: %s", apiConfig.Transport)
 	}
 	return apiClient
 }
 
+// signRequest sets the X-Timestamp header and the X-Signature header, a hex HMAC-SHA256 of
+// "method\npath\ntimestamp\nbody". The panel should reject stale timestamps to prevent replay.
+func signRequest(req *http.Request, secret []byte, now time.Time) error {
+	var body []byte
+	if req.GetBody != nil {
+		b, err := req.GetBody()
+		if err != nil {
+			return err
+		}
+		// A request without body may have no reader
+		if b != nil {
+			defer b.Close()
+			if body, err = io.ReadAll(b); err != nil {
+				return err
+			}
+		}
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req.Header.Set("X-Timestamp", timestamp)
+	req.Header.Set("X-Signature", signature(secret, req.Method, req.URL.Path, timestamp, body))
+	return nil
+}
+
+// signature returns the hex HMAC-SHA256 of "method\npath\ntimestamp\nbody"
+func signature(secret []byte, method string, path string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
 // readLocalRuleList reads the local rule list file
 func readLocalRuleList(path string) (LocalRuleList []api.DetectRule) {
 	LocalRuleList = make([]api.DetectRule, 0)
@@ -103,28 +359,222 @@ func readLocalRuleList(path string) (LocalRuleList []api.DetectRule) {
 			return LocalRuleList
 		}
 		defer file.Close()
-		fileScanner := bufio.NewScanner(file)
 
-		// read line by line
-		for fileScanner.Scan() {
-			LocalRuleList = append(LocalRuleList, api.DetectRule{
-				ID:      -1,
-				Pattern: regexp.MustCompile(fileScanner.Text()),
-			})
-		}
-		// handle first encountered error while reading
-		if err := fileScanner.Err(); err != nil {
+		ruleList, err := readRuleList(file, 0, false)
+		if err != nil {
 			log.Fatalf("Error while reading file: %s", err)
 			return
 		}
+		LocalRuleList = ruleList
 	}
 
 	return LocalRuleList
 }
 
+// readRuleListFile reads the rule list file at path, whatever its size. A bad rule fails the read.
+func readRuleListFile(path string) ([]api.DetectRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readRuleList(file, 0, false)
+}
+
+// readRuleList reads the rule list line by line, gzip content is decompressed first.
+// With a maxSize above 0 it fails once the decompressed content exceeds maxSize bytes, so a gzip bomb
+// can not exhaust the memory. The local file of the operator is read whole.
+// A line that is not a valid regexp fails the read, unless skipInvalid, then it is logged and skipped.
+func readRuleList(r io.Reader, maxSize int64, skipInvalid bool) ([]api.DetectRule, error) {
+	if maxSize <= 0 {
+		maxSize = math.MaxInt64 - 1
+	}
+	reader := bufio.NewReader(r)
+	var content io.Reader = reader
+	if magic, err := reader.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		content = gzipReader
+	}
+
+	limitedReader := &io.LimitedReader{R: content, N: maxSize + 1}
+	ruleList := make([]api.DetectRule, 0)
+	fileScanner := bufio.NewScanner(limitedReader)
+	// read line by line
+	for fileScanner.Scan() {
+		if limitedReader.N <= 0 {
+			break
+		}
+		pattern, err := regexp.Compile(fileScanner.Text())
+		if err != nil {
+			if !skipInvalid {
+				return nil, err
+			}
+			log.Printf("Skip rule %q: %s", fileScanner.Text(), err)
+			continue
+		}
+		ruleList = append(ruleList, api.DetectRule{
+			ID:      -1,
+			Pattern: pattern,
+		})
+	}
+	if limitedReader.N <= 0 {
+		return nil, fmt.Errorf("rule list is larger than %d bytes", maxSize)
+	}
+	// handle first encountered error while reading
+	if err := fileScanner.Err(); err != nil {
+		return nil, err
+	}
+	return ruleList, nil
+}
+
+// retryBackoff is the wait before the retry after attempt, doubled from min on each attempt up to max
+func retryBackoff(min, max time.Duration, attempt int) time.Duration {
+	backoff := min
+	for i := 1; i < attempt && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// retryJitter draws the wait between RetryWaitTime and the backoff, the nodes hit by the same panel failure
+// spread their retries even once the backoff reached RetryMaxWaitTime
+func retryJitter(client *resty.Client, res *resty.Response) (time.Duration, error) {
+	attempt := 1
+	if res != nil && res.Request != nil {
+		attempt = res.Request.Attempt
+	}
+	return jitterWait(client.RetryWaitTime, retryBackoff(client.RetryWaitTime, client.RetryMaxWaitTime, attempt)), nil
+}
+
+// jitterWait returns a random wait in [waitMin, backoff], it never goes over the backoff
+func jitterWait(waitMin, backoff time.Duration) time.Duration {
+	if backoff <= 0 {
+		return 0
+	}
+	waitMin = max(min(waitMin, backoff), 0)
+	return waitMin + time.Duration(rand.Int63n(int64(backoff-waitMin)+1))
+}
+
+// retryAfter returns the wait of the Retry-After header of a 429 response, in delta-seconds or HTTP-date
+func retryAfter(res *resty.Response, now time.Time) (time.Duration, bool) {
+	if res == nil || res.StatusCode() != http.StatusTooManyRequests {
+		return 0, false
+	}
+	return parseRetryAfter(res.Header().Get("Retry-After"), now)
+}
+
+// parseRetryAfter parses a Retry-After value in delta-seconds or HTTP-date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// maxRetryAfter returns the longest Retry-After waited out, MaxRetryAfter or defaultMaxRetryAfter
+func maxRetryAfter(apiConfig *api.Config) time.Duration {
+	if apiConfig.MaxRetryAfter > 0 {
+		return time.Duration(apiConfig.MaxRetryAfter) * time.Second
+	}
+	return defaultMaxRetryAfter
+}
+
+// retryTooManyRequests reports whether a 429 response is retried. A wait longer than maxWait is not
+// cut short, the request fails and the next pull or report tries again.
+func retryTooManyRequests(res *resty.Response, maxWait time.Duration) bool {
+	if res == nil || res.StatusCode() != http.StatusTooManyRequests {
+		return false
+	}
+	wait, ok := retryAfter(res, time.Now())
+	return !ok || wait <= maxWait
+}
+
+// waitRetryAfter waits out the part of the Retry-After over RetryMaxWaitTime and leaves the rest to resty,
+// which clamps the wait it returns to RetryMaxWaitTime
+func waitRetryAfter(client *resty.Client, res *resty.Response, wait time.Duration) (time.Duration, error) {
+	if over := wait - client.RetryMaxWaitTime; over > 0 {
+		timer := time.NewTimer(over)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-res.Request.Context().Done():
+			return 0, res.Request.Context().Err()
+		}
+		return client.RetryMaxWaitTime, nil
+	}
+	return wait, nil
+}
+
+// ifNoneMatch returns the ETag to send for the resource. Every FullRefresh pulls it is left out and the
+// resource is fetched in full, so a panel serving a stale ETag can not hide a change forever.
+func (c *APIClient) ifNoneMatch(key string) string {
+	c.eTagMu.Lock()
+	defer c.eTagMu.Unlock()
+	if c.FullRefresh > 0 {
+		count, ok := c.pullCounts[key]
+		if !ok {
+			// Jitter the first full refresh, so the nodes do not refresh at the same time
+			count = rand.Intn(c.FullRefresh)
+		}
+		count++
+		c.pullCounts[key] = count
+		if count%c.FullRefresh == 0 {
+			return ""
+		}
+	}
+	return c.eTags[key]
+}
+
+// getETag returns the last ETag of the resource
+func (c *APIClient) getETag(key string) string {
+	c.eTagMu.Lock()
+	defer c.eTagMu.Unlock()
+	return c.eTags[key]
+}
+
+// setETag keeps the ETag of the resource, an empty one is ignored
+func (c *APIClient) setETag(key string, eTag string) {
+	if eTag == "" {
+		return
+	}
+	c.eTagMu.Lock()
+	defer c.eTagMu.Unlock()
+	c.eTags[key] = eTag
+}
+
+// endpoint returns the path of the operation, the configured one or the UniProxy default
+func (c *APIClient) endpoint(operation string) string {
+	if path := c.Endpoints[operation]; path != "" {
+		return path
+	}
+	return defaultEndpoints[operation]
+}
+
 // Describe return a description of the client
 func (c *APIClient) Describe() api.ClientInfo {
-	return api.ClientInfo{APIHost: c.APIHost, NodeID: c.NodeID, Key: c.Key, NodeType: c.NodeType}
+	info := api.ClientInfo{APIHost: c.APIHost, NodeID: c.NodeID, Key: c.Key, NodeType: c.NodeType, Name: strconv.Itoa(c.NodeID)}
+	// The name and region are known once the node info is pulled
+	if s, ok := c.resp.Load().(*serverConfig); ok {
+		if s.Name != "" {
+			info.Name = s.Name
+		}
+		info.Region = s.Region
+	}
+	return info
 }
 
 // Debug set the client debug for client
@@ -132,111 +582,352 @@ func (c *APIClient) Debug() {
 	c.client.SetDebug(true)
 }
 
+// do sends the request, and on 401 or 403 reloads the key from KeyFile and retries once
+func (c *APIClient) do(method string, path string, header map[string]string, body any) (*httpResponse, error) {
+	c.keyMu.Lock()
+	usedKey := c.Key
+	c.keyMu.Unlock()
+
+	res, err := c.doer.Do(method, path, header, body)
+	if res.StatusCode != http.StatusUnauthorized && res.StatusCode != http.StatusForbidden {
+		return res, err
+	}
+	if c.KeyFile == "" {
+		log.Printf("Bad token: %s %s returned %d, check the ApiKey or set KeyFile to reload it", method, c.assembleURL(path), res.StatusCode)
+		return res, err
+	}
+	// The key may have been reloaded by another request meanwhile
+	if key, keyErr := c.reloadKey(); keyErr != nil {
+		log.Printf("Bad token: reload the key from %s failed: %s", c.KeyFile, keyErr)
+		return res, err
+	} else if key == usedKey {
+		log.Printf("Bad token: %s %s returned %d and the key in %s is unchanged", method, c.assembleURL(path), res.StatusCode, c.KeyFile)
+		return res, err
+	}
+	return c.doer.Do(method, path, header, body)
+}
+
+// get sends a GET request, a 200 with an empty or invalid JSON body is retried as a panel being deployed
+// sends them. The same invalid body twice is malformed content and returned as is.
+func (c *APIClient) get(path string, header map[string]string) (*httpResponse, error) {
+	res, err := c.do(http.MethodGet, path, header, nil)
+	for i := 0; i < transientRetryCount && err == nil && res.StatusCode == http.StatusOK && transientBody(res); i++ {
+		log.Printf("Request %s returned an invalid body (%s), retry %d/%d", c.assembleURL(path), bodySnippet(res.Body), i+1, transientRetryCount)
+		time.Sleep(transientRetryWait)
+		last := res.Body
+		res, err = c.do(http.MethodGet, path, header, nil)
+		if err == nil && len(last) > 0 && bytes.Equal(res.Body, last) {
+			break
+		}
+	}
+	return res, err
+}
+
+// transientBody reports whether the body of a 200 may be a transient failure, error pages are not
+func transientBody(res *httpResponse) bool {
+	return jsonContentType(res.Header.Get("Content-Type")) && !json.Valid(res.Body)
+}
+
+// reloadKey reads the key from KeyFile and sends it from now on
+func (c *APIClient) reloadKey() (string, error) {
+	b, err := os.ReadFile(c.KeyFile)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(b))
+	if key == "" {
+		return "", fmt.Errorf("%s is empty", c.KeyFile)
+	}
+
+	c.keyMu.Lock()
+	defer c.keyMu.Unlock()
+	if key != c.Key {
+		c.Key = key
+		c.doer.SetToken(key)
+	}
+	return key, nil
+}
+
 func (c *APIClient) assembleURL(path string) string {
 	return c.APIHost + path
 }
 
-func (c *APIClient) parseResponse(res *resty.Response, path string, err error) (*simplejson.Json, error) {
+func (c *APIClient) parseResponse(res *httpResponse, path string, err error) (*simplejson.Json, error) {
+	if err := c.checkResponse(res, path, err); err != nil {
+		return nil, err
+	}
+
+	rtn, err := simplejson.NewJson(res.Body)
 	if err != nil {
-		return nil, fmt.Errorf("request %s failed: %v", c.assembleURL(path), err)
+		return nil, fmt.Errorf("ret %s invalid", string(res.Body))
 	}
 
-	if res.StatusCode() > 399 {
-		return nil, fmt.Errorf("request %s failed: %s, %v", c.assembleURL(path), res.String(), err)
+	return rtn, nil
+}
+
+// checkResponse returns the error of a failed request
+func (c *APIClient) checkResponse(res *httpResponse, path string, err error) error {
+	if err != nil {
+		return fmt.Errorf("request %s failed: %v", c.assembleURL(path), err)
+	}
+
+	if res.StatusCode > 399 {
+		return fmt.Errorf("request %s failed: %s, %v", c.assembleURL(path), string(res.Body), err)
+	}
+	if contentType := res.Header.Get("Content-Type"); !jsonContentType(contentType) {
+		return fmt.Errorf("request %s returned %s instead of JSON, check the ApiHost: %s", c.assembleURL(path), contentType, bodySnippet(res.Body))
 	}
+	return nil
+}
 
-	rtn, err := simplejson.NewJson(res.Body())
+// jsonContentType reports whether a body of the content type may be JSON,
+// only the HTML and XML pages of misconfigured panels or proxies are refused
+func jsonContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
 	if err != nil {
-		return nil, fmt.Errorf("ret %s invalid", res.String())
+		return true
+	}
+	switch {
+	case mediaType == "text/html", mediaType == "application/xhtml+xml",
+		strings.HasSuffix(mediaType, "/xml"), strings.HasSuffix(mediaType, "+xml"):
+		return false
 	}
+	return true
+}
 
-	return rtn, nil
+// bodySnippet returns the start of the body for the error messages
+func bodySnippet(body []byte) string {
+	const maxSnippet = 200
+	if len(body) > maxSnippet {
+		return strings.TrimSpace(string(body[:maxSnippet])) + "..."
+	}
+	return strings.TrimSpace(string(body))
+}
+
+// decodeUsers decodes the users array of the response one user at a time,
+// without building the whole document first.
+func decodeUsers(r io.Reader) ([]*user, error) {
+	dec := json.NewDecoder(r)
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, errors.New("not a json object")
+	}
+	var users []*user
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if t != "users" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		t, err = dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if t == nil { // "users": null
+			continue
+		}
+		if t != json.Delim('[') {
+			return nil, errors.New("users is not an array")
+		}
+		for dec.More() {
+			u := new(user)
+			if err := dec.Decode(u); err != nil {
+				return nil, err
+			}
+			users = append(users, u)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
 }
 
 // GetNodeInfo will pull NodeInfo Config from panel
 func (c *APIClient) GetNodeInfo() (nodeInfo *api.NodeInfo, err error) {
-	server := new(serverConfig)
-	path := "/api/v1/server/UniProxy/config"
+	nodeInfos, err := c.GetNodeInfos()
+	if err != nil {
+		return nil, err
+	}
+	return nodeInfos[0], nil
+}
 
-	res, err := c.client.R().
-		SetHeader("If-None-Match", c.eTags["node"]).
-		ForceContentType("application/json").
-		Get(path)
+// GetNodeInfos will pull all inbounds of the node, the panel may return an array of configs for mixed inbounds
+func (c *APIClient) GetNodeInfos() (nodeInfos []*api.NodeInfo, err error) {
+	path := c.endpoint("config")
+
+	res, err := c.get(path, map[string]string{"If-None-Match": c.ifNoneMatch("node")})
+
+	// Start from the last config rather than not at all, a 4xx is a real answer of the panel
+	if c.NodeConfigPath != "" && c.resp.Load() == nil && (res.StatusCode == 0 || res.StatusCode >= 500) {
+		if nodeInfos, cacheErr := c.loadNodeConfigCache(); cacheErr == nil {
+			log.Warnf("Get node info failed: %s, use the cached node config in %s", c.checkResponse(res, path, err), c.NodeConfigPath)
+			return nodeInfos, nil
+		} else if !errors.Is(cacheErr, fs.ErrNotExist) {
+			log.Printf("Load the node config cache %s failed: %s", c.NodeConfigPath, cacheErr)
+		}
+	}
+
+	if res.StatusCode == 304 && c.resp.Load() == nil {
+		if body, ok := c.takeCachedBody("node"); ok {
+			// Unchanged since the last run
+			res = &httpResponse{StatusCode: http.StatusOK, Header: res.Header, Body: body}
+		} else {
+			// Nothing is cached to fall back on, retry once without the ETag
+			res, err = c.get(path, nil)
+			if res.StatusCode == 304 {
+				return nil, errors.New("node not modified but no node info is cached")
+			}
+		}
+	}
 
 	// Etag identifier for a specific version of a resource. StatusCode = 304 means no changed
-	if res.StatusCode() == 304 {
+	if res.StatusCode == 304 {
 		return nil, errors.New(api.NodeNotModified)
 	}
 	// update etag
-	if res.Header().Get("Etag") != "" && res.Header().Get("Etag") != c.eTags["node"] {
-		c.eTags["node"] = res.Header().Get("Etag")
-	}
+	c.setETag("node", res.Header.Get("Etag"))
 
 	nodeInfoResp, err := c.parseResponse(res, path, err)
 	if err != nil {
 		return nil, err
 	}
 	b, _ := nodeInfoResp.Encode()
-	json.Unmarshal(b, server)
+	nodeInfos, err = c.applyNodeConfig(b)
+	if err != nil {
+		return nil, err
+	}
+	c.saveETagCache("node", c.getETag("node"), res.Body)
+	c.saveNodeConfigCache(b)
+	return nodeInfos, nil
+}
+
+// applyNodeConfig parses the config of every inbound and keeps the first one for the routes and intervals
+func (c *APIClient) applyNodeConfig(b []byte) (nodeInfos []*api.NodeInfo, err error) {
+	servers, err := decodeServerConfigs(b)
+	if err != nil {
+		return nil, err
+	}
 
-	if server.ServerPort == 0 {
-		return nil, errors.New("server port must > 0")
+	for _, server := range servers {
+		nodeInfo, err := c.parseNodeResponse(server)
+		if err != nil {
+			return nil, fmt.Errorf("parse node info failed: %s, \nError: %w", string(b), err)
+		}
+		nodeInfos = append(nodeInfos, nodeInfo)
 	}
 
-	c.resp.Store(server)
+	// The first config carries the routes and intervals
+	c.resp.Store(servers[0])
+	api.PushInterval = servers[0].BaseConfig.PushInterval
+	api.PullInterval = servers[0].BaseConfig.PullInterval
+	return nodeInfos, nil
+}
 
-	switch c.NodeType {
+// decodeServerConfigs decodes a single config object or an array of configs
+func decodeServerConfigs(b []byte) ([]*serverConfig, error) {
+	var servers []*serverConfig
+	if data := bytes.TrimSpace(b); len(data) > 0 && data[0] == '[' {
+		if err := json.Unmarshal(data, &servers); err != nil {
+			return nil, err
+		}
+	} else {
+		server := new(serverConfig)
+		if err := json.Unmarshal(data, server); err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("empty node config")
+	}
+	return servers, nil
+}
+
+// parseNodeResponse parses the config with its own node type, falling back to the configured one
+func (c *APIClient) parseNodeResponse(s *serverConfig) (nodeInfo *api.NodeInfo, err error) {
+	nodeType := c.NodeType
+	if t, ok := c.NodeTypeAliases[strings.ToLower(s.NodeType)]; ok {
+		nodeType = t
+	} else if t, ok := nodeTypes[strings.ToLower(s.NodeType)]; ok {
+		nodeType = t
+	}
+	if err := s.validate(nodeType); err != nil {
+		return nil, err
+	}
+
+	switch nodeType {
 	case "V2ray", "Vmess", "Vless":
-		nodeInfo, err = c.parseV2rayNodeResponse(server)
+		nodeInfo, err = c.parseV2rayNodeResponse(s)
 	case "Trojan":
-		nodeInfo, err = c.parseTrojanNodeResponse(server)
+		nodeInfo, err = c.parseTrojanNodeResponse(s)
 	case "Shadowsocks":
-		nodeInfo, err = c.parseSSNodeResponse(server)
+		nodeInfo, err = c.parseSSNodeResponse(s)
+	case "Hysteria2":
+		nodeInfo, err = c.parseHysteria2NodeResponse(s)
+	case "TUIC":
+		nodeInfo, err = c.parseTUICNodeResponse(s)
 	default:
-		return nil, fmt.Errorf("unsupported node type: %s", c.NodeType)
+		return nil, fmt.Errorf("unsupported node type: %s", nodeType)
 	}
-
 	if err != nil {
-		return nil, fmt.Errorf("parse node info failed: %s, \nError: %v", res.String(), err)
+		return nil, err
 	}
-
-	api.PushInterval = server.BaseConfig.PushInterval
-	api.PullInterval = server.BaseConfig.PullInterval
+	nodeInfo.NodeType = nodeType
+	nodeInfo.Name = s.Name
+	if nodeInfo.Name == "" {
+		nodeInfo.Name = strconv.Itoa(c.NodeID)
+	}
+	nodeInfo.Region = s.Region
+	nodeInfo.TransportTuning = parseTransportTuning(s.TransportTuning)
 	return nodeInfo, nil
 }
 
 // GetUserList will pull user form panel
 func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 	var users []*user
-	path := "/api/v1/server/UniProxy/user"
+	path := c.endpoint("user")
 
 	switch c.NodeType {
-	case "V2ray", "Trojan", "Shadowsocks", "Vmess", "Vless":
+	case "V2ray", "Trojan", "Shadowsocks", "Vmess", "Vless", "Hysteria2", "TUIC":
 		break
 	default:
 		return nil, fmt.Errorf("unsupported node type: %s", c.NodeType)
 	}
 
-	res, err := c.client.R().
-		SetHeader("If-None-Match", c.eTags["users"]).
-		ForceContentType("application/json").
-		Get(path)
+	res, err := c.get(path, map[string]string{"If-None-Match": c.ifNoneMatch("users")})
 
+	// The first pull has no users to keep
+	if res.StatusCode == 304 && !c.usersLoaded.Load() {
+		if body, ok := c.takeCachedBody("users"); ok {
+			res = &httpResponse{StatusCode: http.StatusOK, Header: res.Header, Body: body}
+		} else {
+			res, err = c.get(path, nil)
+		}
+	}
 	// Etag identifier for a specific version of a resource. StatusCode = 304 means no changed
-	if res.StatusCode() == 304 {
+	if res.StatusCode == 304 {
 		return nil, errors.New(api.UserNotModified)
 	}
 	// update etag
-	if res.Header().Get("Etag") != "" && res.Header().Get("Etag") != c.eTags["users"] {
-		c.eTags["users"] = res.Header().Get("Etag")
-	}
+	c.setETag("users", res.Header.Get("Etag"))
 
-	usersResp, err := c.parseResponse(res, path, err)
-	if err != nil {
+	if err := c.checkResponse(res, path, err); err != nil {
 		return nil, err
 	}
-	b, _ := usersResp.Get("users").Encode()
-	json.Unmarshal(b, &users)
+	users, err = decodeUsers(bytes.NewReader(res.Body))
+	if err != nil {
+		// e.g. the connection was reset mid-body
+		return nil, fmt.Errorf("malformed user list from %s: %w", c.assembleURL(path), err)
+	}
 	if len(users) == 0 {
 		return nil, errors.New("users is null")
 	}
@@ -250,9 +941,9 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 		}
 		// Support 1.7.1 speed limit
 		if c.SpeedLimit > 0 {
-			u.SpeedLimit = uint64(c.SpeedLimit * 1000000 / 8)
+			u.SpeedLimitMbps = c.SpeedLimit
 		} else {
-			u.SpeedLimit = uint64(user.SpeedLimit * 1000000 / 8)
+			u.SpeedLimitMbps = float64(user.SpeedLimit)
 		}
 		//Prefer local config
 		if c.DeviceLimit > 0 {
@@ -261,14 +952,27 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 			deviceLimit = user.DeviceLimit
 		}
 
-		u.DeviceLimit = deviceLimit
+		u.DeviceLimit = c.multiplyDeviceLimit(deviceLimit)
+		u.IdleTimeout = user.IdleTimeout
+		u.PolicyID = user.PolicyID
+		u.BurstCredit = user.BurstCredit
+		u.ResetDay = user.ResetDay
+		u.TrafficQuota = user.TrafficQuota
+		u.MaxUploadRatio = user.MaxUploadRatio
 		u.Email = u.UUID + "@v2board.user"
-		if c.NodeType == "Shadowsocks" {
+		if user.Username != "" {
+			u.Username = user.Username
+			u.Passwd = user.Password
+		}
+		// These authenticate with the UUID as the password, TUIC sends both
+		if c.NodeType == "Shadowsocks" || c.NodeType == "Hysteria2" || c.NodeType == "TUIC" {
 			u.Passwd = u.UUID
 		}
 
 		userList = append(userList, u)
 	}
+	c.usersLoaded.Store(true)
+	c.saveETagCache("users", c.getETag("users"), res.Body)
 
 	return &userList, nil
 }
@@ -276,28 +980,23 @@ func (c *APIClient) GetUserList() (UserList *[]api.UserInfo, err error) {
 // GetIpsList will pull user form panel
 func (c *APIClient) GetIpsList() error {
 	var users []*aips
-	path := "/api/v1/server/UniProxy/aips"
+	path := c.endpoint("aips")
 
 	switch c.NodeType {
-	case "V2ray", "Trojan", "Shadowsocks", "Vmess", "Vless":
+	case "V2ray", "Trojan", "Shadowsocks", "Vmess", "Vless", "Hysteria2", "TUIC":
 		break
 	default:
 		return fmt.Errorf("unsupported node type: %s", c.NodeType)
 	}
 
-	res, err := c.client.R().
-		SetHeader("If-None-Match", c.eTags["users"]).
-		ForceContentType("application/json").
-		Get(path)
+	res, err := c.do(http.MethodGet, path, map[string]string{"If-None-Match": c.getETag("users")}, nil)
 
 	// Etag identifier for a specific version of a resource. StatusCode = 304 means no changed
-	if res.StatusCode() == 304 {
+	if res.StatusCode == 304 {
 		return errors.New("AliveIPs same")
 	}
 	// update etag
-	if res.Header().Get("Etag") != "" && res.Header().Get("Etag") != c.eTags["users"] {
-		c.eTags["users"] = res.Header().Get("Etag")
-	}
+	c.setETag("users", res.Header.Get("Etag"))
 
 	usersResp, err := c.parseResponse(res, path, err)
 	if err != nil {
@@ -319,17 +1018,202 @@ func (c *APIClient) GetIpsList() error {
 	return nil
 }
 
+// GetBannedUsers will pull the UIDs of banned users from panel
+func (c *APIClient) GetBannedUsers() (*[]int, error) {
+	bannedList := new(banned)
+	path := c.endpoint("banned")
+
+	res, err := c.do(http.MethodGet, path, map[string]string{"If-None-Match": c.ifNoneMatch("banned")}, nil)
+
+	// Etag identifier for a specific version of a resource. StatusCode = 304 means no changed
+	if res.StatusCode == 304 {
+		return nil, errors.New(api.BannedNotModified)
+	}
+	// 面板无对应接口时视为没有封禁用户
+	if res.StatusCode == 404 {
+		return &[]int{}, nil
+	}
+	// update etag
+	c.setETag("banned", res.Header.Get("Etag"))
+
+	bannedResp, err := c.parseResponse(res, path, err)
+	if err != nil {
+		return nil, err
+	}
+	b, _ := bannedResp.Encode()
+	if err := json.Unmarshal(b, bannedList); err != nil {
+		return nil, fmt.Errorf("unmarshal banned users failed: %s", err)
+	}
+
+	return &bannedList.Users, nil
+}
+
 // ReportUserTraffic reports the user traffic
 func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
-	path := "/api/v1/server/UniProxy/push"
+	c.trafficMu.Lock()
+	defer c.trafficMu.Unlock()
 
-	// json structure: {uid1: [u, d], uid2: [u, d], uid1: [u, d], uid3: [u, d]}
-	data := make(map[int][]int64, len(*userTraffic))
+	// Keep the traffic while paused, it is sent on resume
+	if c.paused.Load() {
+		c.mergeTraffic(userTraffic)
+		return nil
+	}
+	// Coalesce the reports arriving faster than MinReportInterval, they are sent together at the end of the interval
+	if wait := c.MinReportInterval - time.Since(c.lastReport); c.MinReportInterval > 0 && wait > 0 {
+		c.mergeTraffic(userTraffic)
+		if c.reportTimer == nil {
+			c.reportTimer = time.AfterFunc(wait, c.flushPendingTraffic)
+		}
+		return nil
+	}
+	return c.flushTraffic(userTraffic)
+}
+
+// flushPendingTraffic sends the coalesced traffic, it is kept for the next report on error
+func (c *APIClient) flushPendingTraffic() {
+	c.trafficMu.Lock()
+	defer c.trafficMu.Unlock()
+
+	c.reportTimer = nil
+	if c.paused.Load() {
+		return
+	}
+	if err := c.flushTraffic(nil); err != nil {
+		log.Print(err)
+	}
+}
+
+// PauseReporting stops sending reports to the panel, user traffic is kept until ResumeReporting
+func (c *APIClient) PauseReporting() {
+	c.paused.Store(true)
+}
+
+// ResumeReporting starts sending reports again and sends the traffic kept while paused
+func (c *APIClient) ResumeReporting() error {
+	c.trafficMu.Lock()
+	defer c.trafficMu.Unlock()
+
+	c.paused.Store(false)
+	return c.flushTraffic(nil)
+}
+
+// mergeTraffic adds the user traffic to the pending traffic
+func (c *APIClient) mergeTraffic(userTraffic *[]api.UserTraffic) {
+	if c.pendingTraffic == nil {
+		c.pendingTraffic = make(map[int][2]int64)
+	}
 	for _, traffic := range *userTraffic {
-		data[traffic.UID] = []int64{traffic.Upload, traffic.Download}
+		t := c.pendingTraffic[traffic.UID]
+		c.pendingTraffic[traffic.UID] = [2]int64{t[0] + traffic.Upload, t[1] + traffic.Download}
+	}
+}
+
+// flushTraffic sends the pending traffic along with the user traffic. The pending traffic is
+// cleared once the panel accepts it, the user traffic is left to the caller on error.
+// Users below MinTrafficReport are carried to the next report.
+func (c *APIClient) flushTraffic(userTraffic *[]api.UserTraffic) error {
+	traffic := make(map[int][2]int64, len(c.pendingTraffic))
+	for uid, t := range c.pendingTraffic {
+		traffic[uid] = t
+	}
+	if userTraffic != nil {
+		for _, t := range *userTraffic {
+			traffic[t.UID] = [2]int64{traffic[t.UID][0] + t.Upload, traffic[t.UID][1] + t.Download}
+		}
+	}
+
+	var carried map[int][2]int64
+	if c.MinTrafficReport > 0 {
+		for uid, t := range traffic {
+			if t[0]+t[1] < c.MinTrafficReport {
+				if carried == nil {
+					carried = make(map[int][2]int64)
+				}
+				carried[uid] = t
+				delete(traffic, uid)
+			}
+		}
+	}
+	if len(traffic) == 0 {
+		c.pendingTraffic = carried
+		return nil
+	}
+
+	c.lastReport = time.Now()
+	if failed, err := c.postTrafficBatches(traffic); err != nil {
+		if len(failed) == len(traffic) {
+			return err
+		}
+		// The accepted batches can not be taken back, the users of the others are sent with the next report
+		log.Printf("Report the traffic of %d of %d users failed, it is kept for the next report: %s", len(failed), len(traffic), err)
+		if carried == nil {
+			carried = make(map[int][2]int64, len(failed))
+		}
+		for uid, t := range failed {
+			carried[uid] = t
+		}
 	}
+	c.pendingTraffic = carried
+	return nil
+}
 
-	res, err := c.client.R().SetBody(data).ForceContentType("application/json").Post(path)
+// postTrafficBatches sends the traffic in requests of TrafficBatchSize users, one after another.
+// It returns the traffic of the failed requests along with their errors.
+func (c *APIClient) postTrafficBatches(traffic map[int][2]int64) (map[int][2]int64, error) {
+	if c.TrafficBatchSize <= 0 || len(traffic) <= c.TrafficBatchSize {
+		if err := c.postTraffic(traffic); err != nil {
+			return traffic, err
+		}
+		return nil, nil
+	}
+	uids := make([]int, 0, len(traffic))
+	for uid := range traffic {
+		uids = append(uids, uid)
+	}
+	sort.Ints(uids)
+
+	failed := make(map[int][2]int64)
+	var errs []error
+	for start := 0; start < len(uids); start += c.TrafficBatchSize {
+		batch := make(map[int][2]int64, c.TrafficBatchSize)
+		for _, uid := range uids[start:min(start+c.TrafficBatchSize, len(uids))] {
+			batch[uid] = traffic[uid]
+		}
+		if err := c.postTraffic(batch); err != nil {
+			errs = append(errs, err)
+			for uid, t := range batch {
+				failed[uid] = t
+			}
+		}
+	}
+	return failed, errors.Join(errs...)
+}
+
+// postReport posts the report as JSON, gzipped with CompressReports
+func (c *APIClient) postReport(path string, data any) (*httpResponse, error) {
+	if !c.CompressReports {
+		return c.do(http.MethodPost, path, nil, data)
+	}
+	// The gRPC transport gzips the call itself
+	if _, ok := c.doer.(*grpcDoer); ok {
+		return c.do(http.MethodPost, path, map[string]string{"Content-Encoding": "gzip"}, data)
+	}
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if err := json.NewEncoder(w).Encode(data); err != nil {
+		return &httpResponse{}, err
+	}
+	if err := w.Close(); err != nil {
+		return &httpResponse{}, err
+	}
+	return c.do(http.MethodPost, path, map[string]string{"Content-Type": "application/json", "Content-Encoding": "gzip"}, b.Bytes())
+}
+
+// postTraffic sends the traffic to the panel
+func (c *APIClient) postTraffic(traffic map[int][2]int64) error {
+	path := c.endpoint("push")
+
+	res, err := c.postReport(path, c.buildTrafficData(traffic))
 	_, err = c.parseResponse(res, path, err)
 	if err != nil {
 		return err
@@ -338,17 +1222,68 @@ func (c *APIClient) ReportUserTraffic(userTraffic *[]api.UserTraffic) error {
 	return nil
 }
 
+// buildTrafficData builds the traffic report in the shape of the report version
+func (c *APIClient) buildTrafficData(traffic map[int][2]int64) any {
+	if c.ReportVersion == reportV2 {
+		// json structure: {"traffics": [{"uid": uid1, "upload": u, "download": d}]}, sorted by uid
+		data := &trafficV2{Traffics: make([]userTrafficV2, 0, len(traffic))}
+		for uid, t := range traffic {
+			data.Traffics = append(data.Traffics, userTrafficV2{UID: uid, Upload: c.multiplyTraffic(t[0]), Download: c.multiplyTraffic(t[1])})
+		}
+		sort.Slice(data.Traffics, func(i, j int) bool { return data.Traffics[i].UID < data.Traffics[j].UID })
+		return data
+	}
+
+	// json structure: {uid1: [u, d], uid2: [u, d], uid1: [u, d], uid3: [u, d]}
+	data := make(map[int][]int64, len(traffic))
+	for uid, t := range traffic {
+		data[uid] = []int64{c.multiplyTraffic(t[0]), c.multiplyTraffic(t[1])}
+	}
+	return data
+}
+
+// multiplyTraffic applies the traffic multiplier, rounded to the nearest byte
+func (c *APIClient) multiplyTraffic(traffic int64) int64 {
+	if c.TrafficMultiplier <= 0 || c.TrafficMultiplier == 1 {
+		return traffic
+	}
+	if t := int64(math.Round(float64(traffic) * c.TrafficMultiplier)); t > 0 {
+		return t
+	}
+	return 0
+}
+
+// multiplyDeviceLimit applies the device limit multiplier rounded down, a limited user keeps at least one device
+func (c *APIClient) multiplyDeviceLimit(limit int) int {
+	// 0 is unlimited
+	if limit <= 0 || c.DeviceMultiplier <= 0 || c.DeviceMultiplier == 1 {
+		return limit
+	}
+	return max(int(math.Floor(float64(limit)*c.DeviceMultiplier)), 1)
+}
+
 // GetNodeRule implements the API interface
 func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
 	routes := c.resp.Load().(*serverConfig).Routes
 
-	ruleList := c.LocalRuleList
+	// A copy, the block rules of the panel must not land in the shared backing array
+	c.ruleListMu.RLock()
+	ruleList := slices.Clone(c.LocalRuleList)
+	c.ruleListMu.RUnlock()
+	if c.remoteRuleList != nil {
+		ruleList = c.remoteRuleList.get()
+	}
 
 	for i := range routes {
 		if routes[i].Action == "block" {
+			pattern, err := c.compileRule(strings.Join(routes[i].Match, "|"))
+			if err != nil {
+				log.Printf("Skip block rule %d: %s", i, err)
+				continue
+			}
 			ruleList = append(ruleList, api.DetectRule{
 				ID:      i,
-				Pattern: regexp.MustCompile(strings.Join(routes[i].Match, "|")),
+				Pattern: pattern,
 			})
 		}
 	}
@@ -356,38 +1291,250 @@ func (c *APIClient) GetNodeRule() (*[]api.DetectRule, error) {
 	return &ruleList, nil
 }
 
+// GetRoutingRules returns the routes of the panel sending domains to a named outbound
+func (c *APIClient) GetRoutingRules() (*[]api.RoutingRule, error) {
+	routes := c.resp.Load().(*serverConfig).Routes
+
+	var ruleList []api.RoutingRule
+	for i := range routes {
+		if routes[i].Action == "route" {
+			if routes[i].ActionValue == "" || len(routes[i].Match) == 0 {
+				log.Printf("Skip route rule %d: missing outbound or match", i)
+				continue
+			}
+			ruleList = append(ruleList, api.RoutingRule{
+				ID:          routes[i].Id,
+				Domain:      routes[i].Match,
+				OutboundTag: routes[i].ActionValue,
+			})
+		}
+	}
+
+	return &ruleList, nil
+}
+
+// compileRule compiles a rule pattern, refusing the ones over the configured length or complexity
+func (c *APIClient) compileRule(pattern string) (*regexp.Regexp, error) {
+	if c.RuleMaxLength > 0 && len(pattern) > c.RuleMaxLength {
+		return nil, fmt.Errorf("pattern length %d exceeds the limit %d", len(pattern), c.RuleMaxLength)
+	}
+	if c.RuleMaxComplexity > 0 {
+		re, err := syntax.Parse(pattern, syntax.Perl)
+		if err != nil {
+			return nil, err
+		}
+		prog, err := syntax.Compile(re.Simplify())
+		if err != nil {
+			return nil, err
+		}
+		// The number of instructions bounds the matching cost of every input byte
+		if len(prog.Inst) > c.RuleMaxComplexity {
+			return nil, fmt.Errorf("pattern complexity %d exceeds the limit %d", len(prog.Inst), c.RuleMaxComplexity)
+		}
+	}
+	return regexp.Compile(pattern)
+}
+
 // ReportNodeStatus implements the API interface
 func (c *APIClient) ReportNodeStatus(nodeStatus *api.NodeStatus) (err error) {
-	return nil
+	if c.paused.Load() {
+		return nil
+	}
+	path := c.endpoint("status")
+	data := &statusReport{CPU: nodeStatus.CPU, Mem: nodeStatus.Mem, Disk: nodeStatus.Disk, Uptime: nodeStatus.Uptime}
+	res, err := c.do(http.MethodPost, path, nil, data)
+	// The panel may not have the endpoint
+	if res.StatusCode == 404 {
+		return nil
+	}
+	_, err = c.parseResponse(res, path, err)
+	return err
+}
+
+// ReportNodeOnline tells the panel the node started
+func (c *APIClient) ReportNodeOnline() error {
+	return c.reportLifecycle("online")
+}
+
+// ReportNodeOffline tells the panel the node stopped
+func (c *APIClient) ReportNodeOffline() error {
+	return c.reportLifecycle("offline")
+}
+
+func (c *APIClient) reportLifecycle(event string) error {
+	if c.LifecycleEndpoint == "" {
+		return nil
+	}
+	path := c.LifecycleEndpoint
+	data := &lifecycleEvent{Event: event, Timestamp: time.Now().Unix(), Version: api.Version}
+	res, err := c.do(http.MethodPost, path, nil, data)
+	// The panel may not have the endpoint
+	if res.StatusCode == 404 {
+		return nil
+	}
+	_, err = c.parseResponse(res, path, err)
+	return err
 }
 
 // ReportNodeOnlineUsers implements the API interface
 func (c *APIClient) ReportNodeOnlineUsers(onlineUserList *[]api.OnlineUser) error {
+	if c.paused.Load() {
+		return nil
+	}
 	reportOnline := make(map[int]int)
-	data := make(map[int][]string)
 	for _, onlineuser := range *onlineUserList {
-		// json structure: { UID1:["ip1","ip2"],UID2:["ip3","ip4"] }
-		data[onlineuser.UID] = append(data[onlineuser.UID], onlineuser.IP)
 		if onlineuser.IP != "" {
 			reportOnline[onlineuser.UID]++
 		}
 	}
 	c.LastReportOnline = reportOnline // Update LastReportOnline
 
-	path := "/api/v1/server/UniProxy/alive"
-	res, err := c.client.R().SetBody(data).ForceContentType("application/json").Post(path)
+	path := c.endpoint("alive")
+	var data any
+	var current map[int]map[string]bool
+	if c.OnlineDelta {
+		data, current = c.buildOnlineDelta(onlineUserList)
+	} else {
+		data = c.buildOnlineData(onlineUserList)
+	}
+	res, err := c.postReport(path, data)
 	_, err = c.parseResponse(res, path, err)
 	// 面板无对应接口时先不报错
 	if err != nil {
+		// The panel may have missed the change, resync with a full snapshot
+		c.lastOnline = nil
 		return nil
 	}
+	if c.OnlineDelta {
+		c.lastOnline = current
+		c.onlineReports++
+	}
 
 	return nil
 }
 
+// buildOnlineDelta builds the IPs added and removed since the last report, or a full snapshot every
+// OnlineFullSync reports and when the last report failed. It returns the online IPs by user too.
+func (c *APIClient) buildOnlineDelta(onlineUserList *[]api.OnlineUser) (any, map[int]map[string]bool) {
+	current := make(map[int]map[string]bool)
+	for _, onlineuser := range *onlineUserList {
+		if current[onlineuser.UID] == nil {
+			current[onlineuser.UID] = make(map[string]bool)
+		}
+		current[onlineuser.UID][onlineuser.IP] = true
+	}
+	if c.lastOnline == nil || c.onlineReports%c.OnlineFullSync == 0 {
+		return c.buildOnlineData(onlineUserList), current
+	}
+
+	delta := &onlineDelta{Added: make(map[int][]string), Removed: make(map[int][]string)}
+	for uid, ips := range current {
+		for ip := range ips {
+			if !c.lastOnline[uid][ip] {
+				delta.Added[uid] = append(delta.Added[uid], ip)
+			}
+		}
+	}
+	for uid, ips := range c.lastOnline {
+		for ip := range ips {
+			if !current[uid][ip] {
+				delta.Removed[uid] = append(delta.Removed[uid], ip)
+			}
+		}
+	}
+	return delta, current
+}
+
+// buildOnlineData builds the payload of the online users
+func (c *APIClient) buildOnlineData(onlineUserList *[]api.OnlineUser) any {
+	if c.ReportVersion == reportV2 {
+		// json structure: {"online": [{"uid": UID1, "ip": "ip1", "cc": "US"}]}, ip is omitted when suppressed
+		data := &onlineV2{Online: make([]onlineUserV2, 0, len(*onlineUserList))}
+		for _, onlineuser := range *onlineUserList {
+			user := onlineUserV2{UID: onlineuser.UID, IP: onlineuser.IP}
+			if c.geoIP != nil && onlineuser.IP != "" {
+				user.CC = c.geoIP.Country(onlineuser.IP)
+			}
+			if c.SuppressOnlineIP {
+				user.IP = ""
+			}
+			data.Online = append(data.Online, user)
+		}
+		return data
+	}
+
+	// Many users behind a CGNAT share a few IPs, group the users by IP to cut the payload
+	if c.OnlineByIP && !c.SuppressOnlineIP {
+		// json structure: { IP1:[UID1,UID2],IP2:[UID3] }
+		data := make(map[string][]int)
+		for _, onlineuser := range *onlineUserList {
+			data[onlineuser.IP] = append(data[onlineuser.IP], onlineuser.UID)
+		}
+		return data
+	}
+
+	if c.geoIP == nil && !c.SuppressOnlineIP {
+		// json structure: { UID1:["ip1","ip2"],UID2:["ip3","ip4"] }
+		data := make(map[int][]string)
+		for _, onlineuser := range *onlineUserList {
+			data[onlineuser.UID] = append(data[onlineuser.UID], onlineuser.IP)
+		}
+		return data
+	}
+
+	// json structure: { UID1:[{"ip":"ip1","cc":"US"}],UID2:[{"cc":"JP"}] }, ip is omitted when suppressed
+	data := make(map[int][]onlineDevice)
+	for _, onlineuser := range *onlineUserList {
+		device := onlineDevice{IP: onlineuser.IP}
+		if c.geoIP != nil && onlineuser.IP != "" {
+			device.CC = c.geoIP.Country(onlineuser.IP)
+		}
+		if c.SuppressOnlineIP {
+			device.IP = ""
+		}
+		data[onlineuser.UID] = append(data[onlineuser.UID], device)
+	}
+	return data
+}
+
 // ReportIllegal implements the API interface
 func (c *APIClient) ReportIllegal(detectResultList *[]api.DetectResult) error {
-	return nil
+	if len(*detectResultList) == 0 {
+		return nil
+	}
+	// All the hits in one request, {uid: [rule ids]}
+	data := make(map[int][]int)
+	for _, r := range *detectResultList {
+		data[r.UID] = append(data[r.UID], r.RuleID)
+	}
+	path := c.endpoint("illegal")
+	res, err := c.do(http.MethodPost, path, nil, data)
+	// The panel may not support it
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusMethodNotAllowed {
+		return nil
+	}
+	_, err = c.parseResponse(res, path, err)
+	return err
+}
+
+// ReportDeviceHours implements the API interface
+func (c *APIClient) ReportDeviceHours(deviceHours *[]api.DeviceHours) error {
+	if len(*deviceHours) == 0 || c.paused.Load() {
+		return nil
+	}
+	// {uid: hours}
+	data := make(map[int]float64, len(*deviceHours))
+	for _, d := range *deviceHours {
+		data[d.UID] = d.Hours
+	}
+	path := c.endpoint("devicehours")
+	res, err := c.do(http.MethodPost, path, nil, data)
+	// The panel may not support it
+	if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusMethodNotAllowed {
+		return nil
+	}
+	_, err = c.parseResponse(res, path, err)
+	return err
 }
 
 // parseTrojanNodeResponse parse the response for the given nodeInfo format
@@ -430,14 +1577,88 @@ func (c *APIClient) parseTrojanNodeResponse(s *serverConfig) (*api.NodeInfo, err
 		TransportProtocol: transportProtocol,
 		Path:              s.NetworkSettings.Path,
 		EnableTLS:         true,
+		AllowInsecure:     s.TlsSettings.AllowInsecure,
+		TCPFastOpen:       parseTCPFastOpen(s.TCPFastOpen),
 		Host:              host,
 		Header:            header,
 		ServiceName:       s.NetworkSettings.ServiceName,
 		NameServerConfig:  s.parseDNSConfig(),
+		Transport:         s.parseTransportConfig(transportProtocol, host, header),
+		Alpn:              s.Alpn,
+	}
+	for _, f := range s.Fallbacks {
+		nodeInfo.Fallbacks = append(nodeInfo.Fallbacks, &api.FallbackConfig{
+			SNI:              f.SNI,
+			Alpn:             f.Alpn,
+			Path:             f.Path,
+			Dest:             f.Dest,
+			ProxyProtocolVer: f.Xver,
+		})
 	}
 	return nodeInfo, nil
 }
 
+// parseHysteria2NodeResponse parse the response for the given nodeInfo format, Hysteria2 runs on QUIC with TLS
+func (c *APIClient) parseHysteria2NodeResponse(s *serverConfig) (*api.NodeInfo, error) {
+	host := s.ServerName
+	if host == "" {
+		host = s.Host
+	}
+	return &api.NodeInfo{
+		NodeType:          c.NodeType,
+		NodeID:            c.NodeID,
+		Port:              uint32(s.ServerPort),
+		TransportProtocol: "udp",
+		EnableTLS:         true,
+		AllowInsecure:     s.TlsSettings.AllowInsecure,
+		Host:              host,
+		NameServerConfig:  s.parseDNSConfig(),
+		Hysteria2Config: &api.Hysteria2Config{
+			UpMbps:                s.UpMbps,
+			DownMbps:              s.DownMbps,
+			IgnoreClientBandwidth: s.IgnoreClientBandwidth,
+			Obfs:                  s.Obfs,
+			ObfsPassword:          s.ObfsPassword,
+		},
+	}, nil
+}
+
+// parseTUICNodeResponse parse the response for the given nodeInfo format, TUIC runs on QUIC with TLS
+func (c *APIClient) parseTUICNodeResponse(s *serverConfig) (*api.NodeInfo, error) {
+	host := s.ServerName
+	if host == "" {
+		host = s.Host
+	}
+	congestionControl := s.CongestionControl
+	if congestionControl == "" {
+		congestionControl = "bbr"
+	}
+	udpRelayMode := s.UDPRelayMode
+	if udpRelayMode == "" {
+		udpRelayMode = "native"
+	}
+	alpn := s.Alpn
+	if len(alpn) == 0 {
+		alpn = []string{"h3"}
+	}
+	return &api.NodeInfo{
+		NodeType:          c.NodeType,
+		NodeID:            c.NodeID,
+		Port:              uint32(s.ServerPort),
+		TransportProtocol: "udp",
+		EnableTLS:         true,
+		AllowInsecure:     s.TlsSettings.AllowInsecure,
+		Host:              host,
+		Alpn:              alpn,
+		NameServerConfig:  s.parseDNSConfig(),
+		TUICConfig: &api.TUICConfig{
+			CongestionControl: congestionControl,
+			UDPRelayMode:      udpRelayMode,
+			ZeroRTTHandshake:  s.ZeroRTTHandshake,
+		},
+	}, nil
+}
+
 // parseSSNodeResponse parse the response for the given nodeInfo format
 func (c *APIClient) parseSSNodeResponse(s *serverConfig) (*api.NodeInfo, error) {
 	var header json.RawMessage
@@ -457,7 +1678,7 @@ func (c *APIClient) parseSSNodeResponse(s *serverConfig) (*api.NodeInfo, error)
 		header, _ = h.Encode()
 	}
 	// Create GeneralNodeInfo
-	return &api.NodeInfo{
+	nodeInfo := &api.NodeInfo{
 		NodeType:          c.NodeType,
 		NodeID:            c.NodeID,
 		Port:              uint32(s.ServerPort),
@@ -466,7 +1687,26 @@ func (c *APIClient) parseSSNodeResponse(s *serverConfig) (*api.NodeInfo, error)
 		ServerKey:         s.ServerKey, // shadowsocks2022 share key
 		NameServerConfig:  s.parseDNSConfig(),
 		Header:            header,
-	}, nil
+		Transport:         &api.TransportConfig{Network: "tcp", Header: header},
+	}
+
+	// A cipher per port, the first port is the main one if server_port is absent
+	for _, p := range s.Ports {
+		if p.Port <= 0 || p.Cipher == "" {
+			return nil, fmt.Errorf("invalid shadowsocks port: %d, cipher: %s", p.Port, p.Cipher)
+		}
+		nodeInfo.SSPorts = append(nodeInfo.SSPorts, &api.SSPortConfig{
+			Port:         uint32(p.Port),
+			CypherMethod: p.Cipher,
+			ServerKey:    p.ServerKey,
+		})
+	}
+	if nodeInfo.Port == 0 && len(nodeInfo.SSPorts) > 0 {
+		nodeInfo.Port = nodeInfo.SSPorts[0].Port
+		nodeInfo.CypherMethod = nodeInfo.SSPorts[0].CypherMethod
+		nodeInfo.ServerKey = nodeInfo.SSPorts[0].ServerKey
+	}
+	return nodeInfo, nil
 }
 
 // parseV2rayNodeResponse parse the response for the given nodeInfo format
@@ -478,17 +1718,33 @@ func (c *APIClient) parseV2rayNodeResponse(s *serverConfig) (*api.NodeInfo, erro
 		enableREALITY bool
 		dest          string
 	)
+	serverNames := s.TlsSettings.Sni.nonEmpty()
 	if s.TlsSettings.Dest != "" {
 		dest = s.TlsSettings.Dest
-	} else {
-		dest = s.TlsSettings.Sni
+	} else if len(serverNames) > 0 {
+		dest = serverNames[0]
+	}
+	// No short ID accepts the clients without one
+	shortIds := []string(s.TlsSettings.ShortId)
+	if len(shortIds) == 0 {
+		shortIds = []string{""}
 	}
 	realityconfig := api.REALITYConfig{
 		Dest:             dest + ":" + s.TlsSettings.ServerPort,
 		ProxyProtocolVer: s.TlsSettings.Xver,
-		ServerNames:      []string{s.TlsSettings.Sni},
+		ServerNames:      serverNames,
 		PrivateKey:       s.TlsSettings.PrivateKey,
-		ShortIds:         []string{s.TlsSettings.ShortId},
+		ShortIds:         shortIds,
+		Fingerprint:      s.TlsSettings.Fingerprint,
+		SpiderX:          s.TlsSettings.SpiderX,
+		Mldsa65Seed:      s.TlsSettings.Mldsa65Seed,
+		Mldsa65Verify:    s.TlsSettings.Mldsa65Verify,
+	}
+	if realityconfig.Fingerprint == "" {
+		realityconfig.Fingerprint = defaultFingerprint
+	}
+	if realityconfig.SpiderX == "" {
+		realityconfig.SpiderX = defaultSpiderX
 	}
 	switch s.Network {
 	case "ws":
@@ -537,6 +1793,11 @@ func (c *APIClient) parseV2rayNodeResponse(s *serverConfig) (*api.NodeInfo, erro
 		AlterID:           0,
 		TransportProtocol: s.Network,
 		EnableTLS:         enableTLS,
+		AllowInsecure:     s.TlsSettings.AllowInsecure,
+		Alpn:              s.TlsSettings.Alpn,
+		MinTLSVersion:     s.TlsSettings.MinVersion,
+		MaxTLSVersion:     s.TlsSettings.MaxVersion,
+		TCPFastOpen:       parseTCPFastOpen(s.TCPFastOpen),
 		Path:              s.NetworkSettings.Path,
 		Host:              host,
 		EnableVless:       c.EnableVless,
@@ -546,17 +1807,202 @@ func (c *APIClient) parseV2rayNodeResponse(s *serverConfig) (*api.NodeInfo, erro
 		EnableREALITY:     enableREALITY,
 		REALITYConfig:     &realityconfig,
 		NameServerConfig:  s.parseDNSConfig(),
+		Transport:         s.parseTransportConfig(s.Network, host, header),
 	}, nil
 }
 
+// validate checks the fields required by the node type, the error lists every missing or invalid field
+func (s *serverConfig) validate(nodeType string) error {
+	invalid := &api.NodeConfigError{NodeType: nodeType}
+	// Only shadowsocks may run on the ports list instead of server_port
+	if s.ServerPort <= 0 && (nodeType != "Shadowsocks" || len(s.Ports) == 0) {
+		invalid.Add("server_port", "server_port must > 0")
+	}
+	if s.ServerPort > 65535 {
+		invalid.Add("server_port", fmt.Sprintf("invalid server_port: %d", s.ServerPort))
+	}
+
+	switch nodeType {
+	case "V2ray", "Vmess", "Vless":
+		if s.Network == "" {
+			invalid.Add("network", "missing network")
+		} else if !supportedNetworks[s.Network] {
+			invalid.Add("network", fmt.Sprintf("invalid network: %s", s.Network))
+		}
+		// REALITY, the server_name is the only one the inbound accepts, a dest does not stand for it
+		if s.Tls == 2 {
+			if strings.TrimSpace(s.TlsSettings.PrivateKey) == "" {
+				invalid.Add("tls_settings.private_key", "missing tls_settings.private_key")
+			}
+			if len(s.TlsSettings.Sni.nonEmpty()) == 0 {
+				invalid.Add("tls_settings.server_name", "missing tls_settings.server_name")
+			}
+		}
+		minVersion, maxVersion := s.TlsSettings.MinVersion, s.TlsSettings.MaxVersion
+		if minVersion != "" && !tlsVersions[minVersion] {
+			invalid.Add("tls_settings.min_version", fmt.Sprintf("invalid tls_settings.min_version: %s", minVersion))
+		}
+		if maxVersion != "" && !tlsVersions[maxVersion] {
+			invalid.Add("tls_settings.max_version", fmt.Sprintf("invalid tls_settings.max_version: %s", maxVersion))
+		}
+		// The versions have one digit each, so they compare as strings
+		if tlsVersions[minVersion] && tlsVersions[maxVersion] && minVersion > maxVersion {
+			invalid.Add("tls_settings.min_version", fmt.Sprintf("tls_settings.min_version %s is above max_version %s", minVersion, maxVersion))
+		}
+	case "Trojan":
+		if s.Network != "" && !supportedNetworks[s.Network] {
+			invalid.Add("network", fmt.Sprintf("invalid network: %s", s.Network))
+		}
+	case "Hysteria2":
+		if s.Version != 0 && s.Version != 2 {
+			invalid.Add("version", fmt.Sprintf("unsupported hysteria version: %d", s.Version))
+		}
+		switch s.Obfs {
+		case "":
+		case "salamander":
+			if s.ObfsPassword == "" {
+				invalid.Add("obfs-password", "missing obfs-password")
+			}
+		default:
+			invalid.Add("obfs", fmt.Sprintf("invalid obfs: %s", s.Obfs))
+		}
+		if s.UpMbps < 0 || s.DownMbps < 0 {
+			invalid.Add("up_mbps", fmt.Sprintf("invalid bandwidth: up_mbps %d, down_mbps %d", s.UpMbps, s.DownMbps))
+		}
+	case "TUIC":
+		switch s.CongestionControl {
+		case "", "cubic", "new_reno", "bbr":
+		default:
+			invalid.Add("congestion_control", fmt.Sprintf("invalid congestion_control: %s", s.CongestionControl))
+		}
+		switch s.UDPRelayMode {
+		case "", "native", "quic":
+		default:
+			invalid.Add("udp_relay_mode", fmt.Sprintf("invalid udp_relay_mode: %s", s.UDPRelayMode))
+		}
+	case "Shadowsocks":
+		if s.Cipher == "" && len(s.Ports) == 0 {
+			invalid.Add("cipher", "missing cipher")
+		}
+		for i, p := range s.Ports {
+			if p.Port <= 0 || p.Port > 65535 {
+				invalid.Add(fmt.Sprintf("ports[%d].port", i), fmt.Sprintf("invalid ports[%d].port: %d", i, p.Port))
+			}
+			if p.Cipher == "" {
+				invalid.Add(fmt.Sprintf("ports[%d].cipher", i), fmt.Sprintf("missing ports[%d].cipher", i))
+			}
+		}
+	}
+
+	if len(invalid.Problems) > 0 {
+		return invalid
+	}
+	return nil
+}
+
+// parseTransportTuning drops the out of range values, they are left to the xray defaults
+func parseTransportTuning(t *transportTuning) *api.TransportTuning {
+	if t == nil {
+		return nil
+	}
+	inRange := func(name string, value uint32, min uint32, max uint32) uint32 {
+		if value != 0 && (value < min || value > max) {
+			log.Printf("Ignore transport_tuning.%s %d, it must be in [%d, %d]", name, value, min, max)
+			return 0
+		}
+		return value
+	}
+	tuning := &api.TransportTuning{
+		KCPMtu:              inRange("mtu", t.Mtu, 576, 1460),
+		KCPTti:              inRange("tti", t.Tti, 10, 100),
+		KCPUplinkCapacity:   inRange("uplink_capacity", t.UplinkCapacity, 1, 10000),
+		KCPDownlinkCapacity: inRange("downlink_capacity", t.DownlinkCapacity, 1, 10000),
+		KCPReadBufferSize:   inRange("read_buffer_size", t.ReadBufferSize, 1, 1024),
+		KCPWriteBufferSize:  inRange("write_buffer_size", t.WriteBufferSize, 1, 1024),
+		TCPWindowClamp:      t.TCPWindowClamp,
+	}
+	if tuning.TCPWindowClamp < 0 {
+		log.Printf("Ignore transport_tuning.tcp_window_clamp %d, it must not be negative", t.TCPWindowClamp)
+		tuning.TCPWindowClamp = 0
+	}
+	return tuning
+}
+
+// parseTCPFastOpen returns the tcp_fast_open of the panel as sockopt.tcpFastOpen, nil when unset or invalid
+func parseTCPFastOpen(raw json.RawMessage) interface{} {
+	if len(raw) == 0 {
+		return nil
+	}
+	var tfo interface{}
+	if err := json.Unmarshal(raw, &tfo); err != nil {
+		log.Printf("Ignore tcp_fast_open %s: %s", raw, err)
+		return nil
+	}
+	switch v := tfo.(type) {
+	case nil, bool:
+		return v
+	case float64:
+		if v >= 0 && v == math.Trunc(v) && v <= math.MaxInt32 {
+			return v
+		}
+	}
+	log.Printf("Ignore tcp_fast_open %s, it must be a bool or a queue length", raw)
+	return nil
+}
+
+// parseTransportConfig collects the settings of the given network
+func (s *serverConfig) parseTransportConfig(network string, host string, header json.RawMessage) *api.TransportConfig {
+	transport := &api.TransportConfig{Network: network}
+	switch network {
+	case "tcp":
+		transport.Header = header
+	case "ws":
+		transport.Host = host
+		transport.Path = s.NetworkSettings.Path
+		if u, err := url.Parse(s.NetworkSettings.Path); err == nil {
+			if ed, err := strconv.ParseUint(u.Query().Get("ed"), 10, 32); err == nil {
+				transport.Ed = uint32(ed)
+			}
+		}
+	case "grpc":
+		transport.ServiceName = s.NetworkSettings.ServiceName
+		transport.MultiMode = s.NetworkSettings.MultiMode
+	case "httpupgrade", "xhttp":
+		transport.Host = host
+		transport.Path = s.NetworkSettings.Path
+	}
+	return transport
+}
+
 func (s *serverConfig) parseDNSConfig() (nameServerList []*conf.NameServerConfig) {
 	for i := range s.Routes {
-		if s.Routes[i].Action == "dns" {
+		if s.Routes[i].Action != "dns" {
+			continue
+		}
+		// A bare address, or a name server object such as {"address": "8.8.8.8", "queryStrategy": "UseIPv4", "expectIps": ["geoip:us"]}
+		value := strings.TrimSpace(s.Routes[i].ActionValue)
+		if !strings.HasPrefix(value, "{") {
 			nameServerList = append(nameServerList, &conf.NameServerConfig{
-				Address: &conf.Address{Address: net.ParseAddress(s.Routes[i].ActionValue)},
+				Address: &conf.Address{Address: net.ParseAddress(value)},
 				Domains: s.Routes[i].Match,
 			})
+			continue
+		}
+		nameServer := new(conf.NameServerConfig)
+		if err := json.Unmarshal([]byte(value), nameServer); err != nil || nameServer.Address == nil {
+			log.Printf("Skip dns route %d: invalid name server %s", s.Routes[i].Id, value)
+			continue
+		}
+		switch strings.ToLower(nameServer.QueryStrategy) {
+		case "", "useip", "useipv4", "useipv6":
+		default:
+			log.Printf("Skip dns route %d: invalid query strategy %s, it must be UseIP, UseIPv4 or UseIPv6", s.Routes[i].Id, nameServer.QueryStrategy)
+			continue
+		}
+		if len(nameServer.Domains) == 0 {
+			nameServer.Domains = s.Routes[i].Match
 		}
+		nameServerList = append(nameServerList, nameServer)
 	}
 
 	return
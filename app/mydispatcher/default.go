@@ -168,7 +168,9 @@ func (d *DefaultDispatcher) getLink(ctx context.Context) (*transport.Link, *tran
 
 	if user != nil && len(user.Email) > 0 {
 		// Speed Limit and Device Limit
-		bucket, ok, reject := d.Limiter.GetUserBucket(sessionInbound.Tag, user.Email, sessionInbound.Source.Address.IP().String(), sessionInbound.Source.Network == net.Network_TCP)
+		ip := sessionInbound.Source.Address.IP().String()
+		isSourceTCP := sessionInbound.Source.Network == net.Network_TCP
+		bucket, ok, reject := d.Limiter.GetUserBucket(sessionInbound.Tag, user.Email, ip, isSourceTCP)
 		if reject {
 			errors.LogWarning(ctx, "Devices reach the limit: ", user.Email)
 			common.Close(outboundLink.Writer)
@@ -177,9 +179,14 @@ func (d *DefaultDispatcher) getLink(ctx context.Context) (*transport.Link, *tran
 			common.Interrupt(inboundLink.Reader)
 			return nil, nil, newError("Devices reach the limit: ", user.Email)
 		}
+		// Give back the connection slot when the outbound closes its writer
+		outboundLink.Writer = d.Limiter.ConnWriter(outboundLink.Writer, func() {
+			d.Limiter.ReleaseConn(sessionInbound.Tag, user.Email, ip, isSourceTCP)
+		})
 		if ok {
-			inboundLink.Writer = d.Limiter.RateWriter(inboundLink.Writer, bucket)
-			outboundLink.Writer = d.Limiter.RateWriter(outboundLink.Writer, bucket)
+			credit := d.Limiter.GetUserBurstCredit(sessionInbound.Tag, user.Email)
+			inboundLink.Writer = d.Limiter.RateWriter(inboundLink.Writer, bucket, credit)
+			outboundLink.Writer = d.Limiter.RateWriter(outboundLink.Writer, bucket, credit)
 		}
 
 		p := d.policy.ForLevel(user.Level)
@@ -16,6 +16,7 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/XrayR-project/XrayR/api"
 	"github.com/XrayR-project/XrayR/panel"
 )
 
@@ -69,6 +70,7 @@ func getConfig() *viper.Viper {
 
 func run() error {
 	showVersion()
+	api.Version = version
 
 	config := getConfig()
 	panelConfig := &panel.Config{}
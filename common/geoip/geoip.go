@@ -0,0 +1,44 @@
+// Package geoip resolves the country of an IP from a MaxMind mmdb database
+package geoip
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+type Reader struct {
+	db *maxminddb.Reader
+}
+
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// Open loads the mmdb database, the file is read once and kept in memory
+func Open(path string) (*Reader, error) {
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{db: db}, nil
+}
+
+// Country returns the ISO country code of the ip, or an empty string if it is unknown
+func (r *Reader) Country(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+	var rec record
+	if err := r.db.Lookup(addr, &rec); err != nil {
+		return ""
+	}
+	return rec.Country.ISOCode
+}
+
+func (r *Reader) Close() error {
+	return r.db.Close()
+}
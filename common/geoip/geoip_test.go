@@ -0,0 +1,28 @@
+package geoip
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testdata/country.mmdb maps 1.1.1.0/24 to AU and nothing else
+const testDB = "testdata/country.mmdb"
+
+func TestCountry(t *testing.T) {
+	r, err := Open(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	assert.Equal(t, "AU", r.Country("1.1.1.1"))
+	assert.Equal(t, "", r.Country("8.8.8.8"))
+	assert.Equal(t, "", r.Country("not an ip"))
+}
+
+func TestOpenMissingFile(t *testing.T) {
+	_, err := Open(filepath.Join(t.TempDir(), "missing.mmdb"))
+	assert.Error(t, err)
+}
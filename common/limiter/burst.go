@@ -0,0 +1,60 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// BurstCredit is the bytes a user may send above the speed limit, it is refilled every BurstRefillInterval
+type BurstCredit struct {
+	sync.Mutex
+	total      int64
+	remaining  int64
+	lastRefill time.Time
+}
+
+// take uses up to n bytes of the credit, it returns the bytes taken
+func (c *BurstCredit) take(n int64) int64 {
+	c.Lock()
+	defer c.Unlock()
+	if n > c.remaining {
+		n = c.remaining
+	}
+	c.remaining -= n
+	return n
+}
+
+// refill restores the credit once the interval passed, a changed total applies at once
+func (c *BurstCredit) refill(total int64, interval time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	if total != c.total {
+		c.total = total
+		c.remaining = min(c.remaining, total)
+	}
+	if interval > 0 && now().Sub(c.lastRefill) >= interval {
+		c.remaining = c.total
+		c.lastRefill = now()
+	}
+}
+
+// GetUserBurstCredit returns the burst credit of the user, nil if the user has none
+func (l *Limiter) GetUserBurstCredit(tag string, email string) *BurstCredit {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return nil
+	}
+	inboundInfo := value.(*InboundInfo)
+	v, ok := inboundInfo.UserInfo.Load(email)
+	if !ok || v.(UserInfo).BurstCredit <= 0 {
+		return nil
+	}
+	total := v.(UserInfo).BurstCredit
+
+	c, loaded := inboundInfo.BurstCredits.LoadOrStore(email, &BurstCredit{total: total, remaining: total, lastRefill: now()})
+	credit := c.(*BurstCredit)
+	if loaded {
+		credit.refill(total, time.Duration(inboundInfo.config.BurstRefillInterval)*time.Second)
+	}
+	return credit
+}
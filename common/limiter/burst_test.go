@@ -0,0 +1,68 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xtls/xray-core/common/buf"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func writeBytes(t *testing.T, writer buf.Writer, n int) {
+	for ; n > 0; n -= buf.Size {
+		b := buf.New()
+		b.Extend(int32(min(n, buf.Size)))
+		assert.NoError(t, writer.WriteMultiBuffer(buf.MultiBuffer{b}))
+	}
+}
+
+func TestBurstCredit(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test", SpeedLimit: 4096, BurstCredit: 64 * 1024}
+	l := newTestLimiter(t, nil, u)
+
+	bucket, speedLimit, _ := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+	assert.True(t, speedLimit)
+	credit := l.GetUserBurstCredit(testTag, testEmail(u))
+	writer := l.RateWriter(buf.Discard, bucket, credit)
+
+	// The credit passes without taking from the bucket, 16 times the speed limit.
+	// A zero time reads the tokens left by the last write, without the refill since.
+	writeBytes(t, writer, 64*1024)
+	assert.Equal(t, 4096.0, bucket.TokensAt(time.Time{}))
+	assert.Zero(t, credit.take(1))
+
+	// Then the speed limit applies, the bucket starts full
+	writeBytes(t, writer, 4096)
+	assert.Zero(t, bucket.TokensAt(time.Time{}))
+
+	// No credit for the users without one
+	u2 := api.UserInfo{UID: 2, Email: "b@test", SpeedLimit: 4096}
+	assert.NoError(t, l.UpdateInboundLimiter(testTag, &[]api.UserInfo{u2}))
+	assert.Nil(t, l.GetUserBurstCredit(testTag, testEmail(u2)))
+}
+
+func TestBurstCreditRefill(t *testing.T) {
+	clock := time.Now()
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = time.Now })
+
+	u := api.UserInfo{UID: 1, Email: "a@test", BurstCredit: 1000}
+	l := newTestLimiter(t, &LimitConfig{BurstRefillInterval: 3600}, u)
+
+	credit := l.GetUserBurstCredit(testTag, testEmail(u))
+	assert.Equal(t, int64(1000), credit.take(1500))
+	assert.Zero(t, credit.take(1))
+
+	clock = clock.Add(time.Minute)
+	assert.Zero(t, l.GetUserBurstCredit(testTag, testEmail(u)).take(1))
+
+	clock = clock.Add(time.Hour)
+	assert.Equal(t, int64(600), l.GetUserBurstCredit(testTag, testEmail(u)).take(600))
+
+	// A lower credit from the panel applies at once
+	u.BurstCredit = 100
+	assert.NoError(t, l.UpdateInboundLimiter(testTag, &[]api.UserInfo{u}))
+	assert.Equal(t, int64(100), l.GetUserBurstCredit(testTag, testEmail(u)).take(1000))
+}
@@ -0,0 +1,193 @@
+package limiter
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/xtls/xray-core/common"
+	"github.com/xtls/xray-core/common/buf"
+)
+
+const (
+	DeviceCountByIP   = "ip"
+	DeviceCountByConn = "conn"
+
+	DeviceLimitReject   = "reject"
+	DeviceLimitThrottle = "throttle"
+
+	defaultThrottleRate = 8 * 1024 // Byte/s
+	defaultGraceWindow  = time.Minute
+	minRatioTraffic     = 10 * 1024 * 1024 // Byte, the upload ratio of users with less traffic is not enforced
+
+	OnlineByTraffic = "traffic"
+	OnlineByConn    = "conn"
+
+	DeviceCheckLocalFirst  = "local"
+	DeviceCheckGlobalFirst = "global"
+
+	TrackedIPsReject = "reject"
+	TrackedIPsIgnore = "ignore"
+)
+
+// now is the clock of the limiter, tests may replace it
+var now = time.Now
+
+// connCounter counts the active connections of a user, grouped by source IP
+type connCounter struct {
+	sync.Mutex
+	ips       map[string]int
+	idleSince map[string]time.Time // Key: IP, value: when its last connection closed
+}
+
+func newConnCounter() *connCounter {
+	return &connCounter{ips: make(map[string]int), idleSince: make(map[string]time.Time)}
+}
+
+// acquire adds a connection from ip, it fails when the user already holds limit connections.
+func (c *connCounter) acquire(ip string, limit int) bool {
+	c.Lock()
+	defer c.Unlock()
+	if limit > 0 && c.total() >= limit {
+		return false
+	}
+	c.ips[ip]++
+	delete(c.idleSince, ip)
+	return true
+}
+
+// release gives back a connection from ip, with trackIdle the IP is remembered as idle once its last connection closes
+func (c *connCounter) release(ip string, trackIdle bool) {
+	c.Lock()
+	defer c.Unlock()
+	if c.ips[ip] > 1 {
+		c.ips[ip]--
+	} else {
+		delete(c.ips, ip)
+		if trackIdle {
+			c.idleSince[ip] = now()
+		}
+	}
+}
+
+// pruneIdle forgets the idle IPs no longer online, they have no device slot left to replace
+func (c *connCounter) pruneIdle(ipMap *sync.Map) {
+	c.Lock()
+	defer c.Unlock()
+	for ip := range c.idleSince {
+		if ipMap != nil {
+			if _, ok := ipMap.Load(ip); ok {
+				continue
+			}
+		}
+		delete(c.idleSince, ip)
+	}
+}
+
+// evictIdle picks one of ips idle for longer than idle and forgets it
+func (c *connCounter) evictIdle(ips []string, idle time.Duration) (string, bool) {
+	c.Lock()
+	defer c.Unlock()
+	for _, ip := range ips {
+		if since, ok := c.idleSince[ip]; ok && c.ips[ip] == 0 && now().Sub(since) > idle {
+			delete(c.idleSince, ip)
+			return ip, true
+		}
+	}
+	return "", false
+}
+
+// activeIPs returns the IPs holding at least one connection
+func (c *connCounter) activeIPs() []string {
+	c.Lock()
+	defer c.Unlock()
+	ips := make([]string, 0, len(c.ips))
+	for ip := range c.ips {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	return ips
+}
+
+func (c *connCounter) total() (n int) {
+	for _, count := range c.ips {
+		n += count
+	}
+	return n
+}
+
+// normalizeIP turns an IPv4-mapped IPv6 address such as ::ffff:1.2.3.4 into 1.2.3.4, so a device
+// is keyed and matched against the alive IPs by the same address whatever the listener family
+func normalizeIP(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() != nil {
+		return parsed.To4().String()
+	}
+	return ip
+}
+
+// privateIP reports whether ip is a private (RFC 1918 or ULA) or loopback address
+func privateIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && (parsed.IsPrivate() || parsed.IsLoopback())
+}
+
+func acquireConn(inboundInfo *InboundInfo, email string, ip string, limit int) bool {
+	v, _ := inboundInfo.ActiveConn.LoadOrStore(email, newConnCounter())
+	return v.(*connCounter).acquire(ip, limit)
+}
+
+// ReleaseConn gives back the connection slot taken by GetUserBucket
+func (l *Limiter) ReleaseConn(tag string, email string, ip string, isSourceTCP bool) {
+	// Only TCP connections are counted
+	if !isSourceTCP {
+		return
+	}
+	ip = normalizeIP(ip)
+	if value, ok := l.InboundInfo.Load(tag); ok {
+		inboundInfo := value.(*InboundInfo)
+		if v, ok := inboundInfo.ActiveConn.Load(email); ok {
+			v.(*connCounter).release(ip, inboundInfo.config.IdleDeviceReplace > 0)
+		}
+	}
+}
+
+// pruneIdleSince forgets the idle IPs that went offline in this report, so idleSince holds online IPs only
+func pruneIdleSince(inboundInfo *InboundInfo) {
+	inboundInfo.ActiveConn.Range(func(key, value interface{}) bool {
+		var ipMap *sync.Map
+		if v, ok := inboundInfo.UserOnlineIP.Load(key); ok {
+			ipMap = v.(*sync.Map)
+		}
+		value.(*connCounter).pruneIdle(ipMap)
+		return true
+	})
+}
+
+type ConnWriter struct {
+	writer  buf.Writer
+	once    sync.Once
+	release func()
+}
+
+// ConnWriter calls release once the writer is closed or interrupted
+func (l *Limiter) ConnWriter(writer buf.Writer, release func()) buf.Writer {
+	return &ConnWriter{
+		writer:  writer,
+		release: release,
+	}
+}
+
+func (w *ConnWriter) WriteMultiBuffer(mb buf.MultiBuffer) error {
+	return w.writer.WriteMultiBuffer(mb)
+}
+
+func (w *ConnWriter) Close() error {
+	w.once.Do(w.release)
+	return common.Close(w.writer)
+}
+
+func (w *ConnWriter) Interrupt() {
+	w.once.Do(w.release)
+	common.Interrupt(w.writer)
+}
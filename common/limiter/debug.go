@@ -0,0 +1,84 @@
+package limiter
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// InboundStats is the state of an inbound served on /stats of the debug server
+type InboundStats struct {
+	OnlineUsers   int               `json:"online_users"`
+	OnlineDevices int               `json:"online_devices"`
+	Rejects       RejectStats       `json:"rejects"`                // Since the last RejectStats call
+	GlobalCache   *GlobalCacheStats `json:"global_cache,omitempty"` // Only with the global device limit
+}
+
+// Stats returns the state of every inbound by tag, it resets no counter
+func (l *Limiter) Stats() map[string]*InboundStats {
+	stats := make(map[string]*InboundStats)
+	l.InboundInfo.Range(func(key, value interface{}) bool {
+		inboundInfo := value.(*InboundInfo)
+		s := &InboundStats{
+			Rejects: RejectStats{
+				Banned: inboundInfo.rejects.banned.Load(),
+				Ratio:  inboundInfo.rejects.ratio.Load(),
+				Quota:  inboundInfo.rejects.quota.Load(),
+				Device: inboundInfo.rejects.device.Load(),
+				Global: inboundInfo.rejects.global.Load(),
+				Conn:   inboundInfo.rejects.conn.Load(),
+			},
+		}
+		inboundInfo.UserOnlineIP.Range(func(key, value interface{}) bool {
+			s.OnlineUsers++
+			value.(*sync.Map).Range(func(key, value interface{}) bool {
+				s.OnlineDevices++
+				return true
+			})
+			return true
+		})
+		if inboundInfo.GlobalLimit.config != nil {
+			s.GlobalCache = &GlobalCacheStats{
+				Hits:   inboundInfo.GlobalLimit.stats.hits.Load(),
+				Misses: inboundInfo.GlobalLimit.stats.misses.Load(),
+				Errors: inboundInfo.GlobalLimit.stats.errors.Load(),
+			}
+		}
+		stats[key.(string)] = s
+		return true
+	})
+	return stats
+}
+
+// DebugHandler serves /healthz and /stats, the JSON of Stats
+func (l *Limiter) DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(l.Stats())
+	})
+	return mux
+}
+
+// StartDebugServer serves DebugHandler on addr until the returned server is closed, and metrics on /metrics unless it is nil
+func (l *Limiter) StartDebugServer(addr string, metrics http.Handler) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	handler := l.DebugHandler()
+	if metrics != nil {
+		mux := http.NewServeMux()
+		mux.Handle("/", handler)
+		mux.Handle("GET /metrics", metrics)
+		handler = mux
+	}
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 5 * time.Second}
+	go server.Serve(listener)
+	return server, nil
+}
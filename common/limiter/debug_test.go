@@ -0,0 +1,59 @@
+package limiter
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestDebugHandler(t *testing.T) {
+	u1 := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 1}
+	u2 := api.UserInfo{UID: 2, Email: "b@test"}
+	l := newTestLimiter(t, nil, u1, u2)
+	l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	l.GetUserBucket(testTag, testEmail(u1), "2.2.2.2", true)
+	l.GetUserBucket(testTag, testEmail(u2), "3.3.3.3", true)
+	l.GetUserBucket(testTag, testEmail(u2), "4.4.4.4", true)
+
+	server := httptest.NewServer(l.DebugHandler())
+	t.Cleanup(server.Close)
+
+	res, err := http.Get(server.URL + "/healthz")
+	assert.NoError(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "ok", string(body))
+
+	for i := 0; i < 2; i++ {
+		res, err = http.Get(server.URL + "/stats")
+		assert.NoError(t, err)
+		stats := make(map[string]*InboundStats)
+		assert.NoError(t, json.NewDecoder(res.Body).Decode(&stats))
+		res.Body.Close()
+		// Scraping resets nothing
+		assert.Equal(t, map[string]*InboundStats{
+			testTag: {OnlineUsers: 2, OnlineDevices: 3, Rejects: RejectStats{Device: 1}},
+		}, stats)
+	}
+
+	res, err = http.Post(server.URL+"/stats", "application/json", nil)
+	assert.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, res.StatusCode)
+}
+
+func TestStartDebugServer(t *testing.T) {
+	server, err := New().StartDebugServer("127.0.0.1:0", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, server.Close())
+
+	_, err = New().StartDebugServer("256.0.0.1:0", nil)
+	assert.Error(t, err)
+}
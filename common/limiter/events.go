@@ -0,0 +1,63 @@
+package limiter
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const eventQueueSize = 1024
+
+type EventType string
+
+const (
+	EventDeviceReject     EventType = "device_reject"      // A connection over a device limit is rejected
+	EventNewOnlineIP      EventType = "new_online_ip"      // A new IP of a user is counted as a device
+	EventGlobalCacheError EventType = "global_cache_error" // The global device limit store failed
+	EventQuotaExceeded    EventType = "quota_exceeded"     // A connection over the MaxUploadRatio or TrafficQuota of the user is rejected
+)
+
+// LimiterEvent is something that happened on an inbound, the fields a type has no use for are zero
+type LimiterEvent struct {
+	Type EventType
+	Time time.Time
+	Tag  string
+	UID  int
+	IP   string
+	Err  error // Only for EventGlobalCacheError
+}
+
+// eventQueue hands the events to the consumer of Limiter.Events, an event is dropped when the queue is full
+// so the connections never wait on the consumer. Nothing is queued before Events is called.
+type eventQueue struct {
+	ch      chan LimiterEvent
+	enabled atomic.Bool
+	dropped atomic.Uint64
+}
+
+func newEventQueue(size int) *eventQueue {
+	return &eventQueue{ch: make(chan LimiterEvent, size)}
+}
+
+func (q *eventQueue) emit(e LimiterEvent) {
+	if q == nil || !q.enabled.Load() {
+		return
+	}
+	e.Time = now()
+	select {
+	case q.ch <- e:
+	default:
+		q.dropped.Add(1)
+	}
+}
+
+// Events returns the events of every inbound of the limiter. There is a single channel, the consumers
+// share it, and the events are dropped while it is full.
+func (l *Limiter) Events() <-chan LimiterEvent {
+	l.events.enabled.Store(true)
+	return l.events.ch
+}
+
+// DroppedEvents returns the count of events dropped by a full channel
+func (l *Limiter) DroppedEvents() uint64 {
+	return l.events.dropped.Load()
+}
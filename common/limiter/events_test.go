@@ -0,0 +1,92 @@
+package limiter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func nextEvent(t *testing.T, events <-chan LimiterEvent) LimiterEvent {
+	t.Helper()
+	select {
+	case e := <-events:
+		return e
+	default:
+		t.Fatal("no event")
+		return LimiterEvent{}
+	}
+}
+
+func TestEvents(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 1}
+	seeder := api.UserInfo{UID: 2, Email: "b@test", MaxUploadRatio: 2}
+	l := newTestLimiter(t, nil, u, seeder)
+
+	// Nothing is queued without a consumer
+	l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+	assert.Zero(t, len(l.events.ch))
+
+	events := l.Events()
+	_, _, reject := l.GetUserBucket(testTag, testEmail(u), "2.2.2.2", true)
+	assert.True(t, reject)
+	e := nextEvent(t, events)
+	assert.Equal(t, EventDeviceReject, e.Type)
+	assert.Equal(t, testTag, e.Tag)
+	assert.Equal(t, 1, e.UID)
+	assert.Equal(t, "2.2.2.2", e.IP)
+	assert.False(t, e.Time.IsZero())
+
+	// Admitted, only a new IP is an event
+	l.GetUserBucket(testTag, testEmail(seeder), "3.3.3.3", true)
+	l.GetUserBucket(testTag, testEmail(seeder), "3.3.3.3", true)
+	e = nextEvent(t, events)
+	assert.Equal(t, EventNewOnlineIP, e.Type)
+	assert.Equal(t, 2, e.UID)
+	assert.Equal(t, "3.3.3.3", e.IP)
+	assert.Empty(t, events)
+
+	l.AddUserTraffic(testTag, testEmail(seeder), 30*1024*1024, 10*1024*1024)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(seeder), "3.3.3.3", true)
+	assert.True(t, reject)
+	assert.Equal(t, EventQuotaExceeded, nextEvent(t, events).Type)
+
+	// The events go on after a reload
+	assert.NoError(t, l.ReloadInboundLimiter(testTag, 0, &[]api.UserInfo{u}, nil, nil))
+	l.GetUserBucket(testTag, testEmail(u), "2.2.2.2", true)
+	assert.Equal(t, EventDeviceReject, nextEvent(t, events).Type)
+}
+
+func TestGlobalCacheErrorEvent(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 1}
+	l := New()
+	globalLimit := &GlobalDeviceLimitConfig{Enable: true, RedisAddr: "127.0.0.1:1", Timeout: 1, Expiry: 60}
+	assert.NoError(t, l.AddInboundLimiter(testTag, 0, &[]api.UserInfo{u}, globalLimit, nil))
+	events := l.Events()
+
+	_, _, reject := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", false)
+	assert.False(t, reject)
+	e := nextEvent(t, events)
+	assert.Equal(t, EventGlobalCacheError, e.Type)
+	assert.Equal(t, "1.1.1.1", e.IP)
+	assert.Error(t, e.Err)
+}
+
+func TestEventsDropOnFull(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test"}
+	l := newTestLimiter(t, nil, u)
+	l.events = newEventQueue(2)
+	value, _ := l.InboundInfo.Load(testTag)
+	value.(*InboundInfo).events = l.events
+	events := l.Events()
+
+	// The connections never wait on the consumer
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3", "4.4.4.4"} {
+		_, _, reject := l.GetUserBucket(testTag, testEmail(u), ip, true)
+		assert.False(t, reject)
+	}
+	assert.Len(t, events, 2)
+	assert.Equal(t, uint64(2), l.DroppedEvents())
+	assert.Equal(t, "1.1.1.1", nextEvent(t, events).IP)
+}
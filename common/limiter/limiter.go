@@ -4,9 +4,12 @@ package limiter
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/eko/gocache/lib/v4/cache"
@@ -23,83 +26,284 @@ import (
 )
 
 type UserInfo struct {
-	UID         int
-	SpeedLimit  uint64
-	DeviceLimit int
+	UID            int
+	UUID           string
+	SpeedLimit     uint64
+	DeviceLimit    int
+	IdleTimeout    int
+	PolicyID       int
+	BurstCredit    int64
+	ResetDay       int
+	TrafficQuota   int64
+	MaxUploadRatio float64
 }
 
 type InboundInfo struct {
 	Tag            string
-	NodeSpeedLimit uint64
-	UserInfo       *sync.Map // Key: Email value: UserInfo
-	BucketHub      *sync.Map // key: Email, value: *rate.Limiter
-	UserOnlineIP   *sync.Map // Key: Email, value: {Key: IP, value: UID}
-	OnlineDevice   *sync.Map // Key: Email, value: {Key: UID, value: IP}
-	ipAllowedMap   *sync.Map // Key: Email, value: {Key: IP, value: status}
-	Otraffic       *sync.Map // Key: Email, value: {Key: UID, value: traffic}
+	NodeSpeedLimit atomic.Uint64 // Changed live by SetNodeSpeedLimit
+	UserInfo       *sync.Map     // Key: Email value: UserInfo
+	BucketHub      *sync.Map     // key: Email, value: *rate.Limiter
+	UserOnlineIP   *sync.Map     // Key: Email, value: {Key: IP, value: UID}
+	OnlineDevice   *sync.Map     // Key: UID, value: IP
+	ipAllowedMap   *sync.Map     // Key: IP, value: status
+	Otraffic       *sync.Map     // Key: UID, value: traffic
+	ActiveConn     *sync.Map     // Key: Email, value: *connCounter
+	BannedUsers    *sync.Map     // Key: UID, value: struct{}
+	BurstCredits   *sync.Map     // Key: Email, value: *BurstCredit
+	Usage          *sync.Map     // Key: Email, value: *userUsage
+	deviceUsage    *deviceUsage
+	deviceGrace    *sync.Map // Key: Email, value: *deviceGrace
+	ratio          *sync.Map // Key: Email, value: *trafficRatio
+	ipOrder        *sync.Map // Key: Email, value: *ipOrder
+	rejects        *rejectCounters
+	events         *eventQueue
+	config         LimitConfig
+	speedBypass    map[string]bool // Key: UUID of the users never speed limited
 	GlobalLimit    struct {
 		config         *GlobalDeviceLimitConfig
-		globalOnlineIP *marshaler.Marshaler
+		globalOnlineIP *atomic.Pointer[marshaler.Marshaler] // Swapped by SetGlobalLocalCache
+		remoteStore    store.StoreInterface
+		stats          *globalCacheStats
+		warnNoStore    *sync.Once
+		pusher         *pushPool
 	}
 }
 
 type Limiter struct {
 	InboundInfo *sync.Map // Key: Tag, Value: *InboundInfo
+	// OnDeviceLimitReject is called in a goroutine for each connection rejected over a device limit,
+	// e.g. to notify the user through the panel. Set it before the limiter is used.
+	OnDeviceLimitReject func(tag string, uid int, ip string)
+	events              *eventQueue
 }
 
 func New() *Limiter {
 	return &Limiter{
 		InboundInfo: new(sync.Map),
+		events:      newEventQueue(eventQueueSize),
 	}
 }
 
-func (l *Limiter) AddInboundLimiter(tag string, nodeSpeedLimit uint64, userList *[]api.UserInfo, globalLimit *GlobalDeviceLimitConfig) error {
+func (l *Limiter) AddInboundLimiter(tag string, nodeSpeedLimit uint64, userList *[]api.UserInfo, globalLimit *GlobalDeviceLimitConfig, limitConfig *LimitConfig) error {
+	inboundInfo, err := newInboundInfo(tag, nodeSpeedLimit, userList, globalLimit, limitConfig)
+	if err != nil {
+		return err
+	}
+	inboundInfo.events = l.events
+	// Replace the old inbound info, its writes to the global cache stop
+	if old, loaded := l.InboundInfo.Swap(tag, inboundInfo); loaded {
+		if pusher := old.(*InboundInfo).GlobalLimit.pusher; pusher != nil {
+			pusher.close()
+		}
+	}
+	return nil
+}
+
+// ReloadInboundLimiter replaces the users and limits of the inbound, but keeps the
+// speed buckets and online devices of the current session. It adds the inbound if it does not exist.
+func (l *Limiter) ReloadInboundLimiter(tag string, nodeSpeedLimit uint64, userList *[]api.UserInfo, globalLimit *GlobalDeviceLimitConfig, limitConfig *LimitConfig) error {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return l.AddInboundLimiter(tag, nodeSpeedLimit, userList, globalLimit, limitConfig)
+	}
+	oldInfo := value.(*InboundInfo)
+
+	// Keep the redis connection if the global limit is unchanged
+	keepGlobalLimit := oldInfo.GlobalLimit.config != nil && globalLimit != nil && reflect.DeepEqual(oldInfo.GlobalLimit.config, globalLimit)
+	if keepGlobalLimit {
+		globalLimit = nil
+	}
+	inboundInfo, err := newInboundInfo(tag, nodeSpeedLimit, userList, globalLimit, limitConfig)
+	if err != nil {
+		return err
+	}
+	if keepGlobalLimit {
+		inboundInfo.GlobalLimit = oldInfo.GlobalLimit
+	} else if oldInfo.GlobalLimit.pusher != nil {
+		oldInfo.GlobalLimit.pusher.close()
+	}
+
+	inboundInfo.BucketHub = oldInfo.BucketHub
+	inboundInfo.UserOnlineIP = oldInfo.UserOnlineIP
+	inboundInfo.OnlineDevice = oldInfo.OnlineDevice
+	inboundInfo.ipAllowedMap = oldInfo.ipAllowedMap
+	inboundInfo.Otraffic = oldInfo.Otraffic
+	inboundInfo.ActiveConn = oldInfo.ActiveConn
+	inboundInfo.BannedUsers = oldInfo.BannedUsers
+	inboundInfo.BurstCredits = oldInfo.BurstCredits
+	inboundInfo.Usage = oldInfo.Usage
+	inboundInfo.deviceUsage = oldInfo.deviceUsage
+	inboundInfo.deviceGrace = oldInfo.deviceGrace
+	inboundInfo.ratio = oldInfo.ratio
+	inboundInfo.ipOrder = oldInfo.ipOrder
+	inboundInfo.rejects = oldInfo.rejects
+	inboundInfo.events = l.events
+
+	// Apply the new limits to the kept buckets
+	refreshBuckets(inboundInfo)
+	l.InboundInfo.Store(tag, inboundInfo)
+	return nil
+}
+
+// SetNodeSpeedLimit changes the node speed limit of the inbound, the live buckets follow the new limit
+func (l *Limiter) SetNodeSpeedLimit(tag string, limit uint64) error {
+	if value, ok := l.InboundInfo.Load(tag); ok {
+		inboundInfo := value.(*InboundInfo)
+		inboundInfo.NodeSpeedLimit.Store(limit)
+		refreshBuckets(inboundInfo)
+	} else {
+		return fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+	return nil
+}
+
+// burst is the bytes a bucket may hold, the rate over the smoothing window or one second by default
+func (inboundInfo *InboundInfo) burst(limit uint64) int {
+	if window := inboundInfo.config.SmoothingWindowMs; window > 0 {
+		return max(int(limit*uint64(window)/1000), 1)
+	}
+	return int(limit)
+}
+
+// refreshBuckets recomputes the rate of every bucket, the buckets of unlimited or removed users are dropped
+func refreshBuckets(inboundInfo *InboundInfo) {
+	inboundInfo.BucketHub.Range(func(key, value interface{}) bool {
+		limit := uint64(0)
+		if v, ok := inboundInfo.UserInfo.Load(key); ok {
+			limit = determineRate(inboundInfo.NodeSpeedLimit.Load(), v.(UserInfo).SpeedLimit)
+		}
+		if limit > 0 {
+			limiter := value.(*rate.Limiter)
+			limiter.SetLimit(rate.Limit(limit))
+			limiter.SetBurst(inboundInfo.burst(limit))
+		} else {
+			inboundInfo.BucketHub.Delete(key)
+		}
+		return true
+	})
+}
+
+func newInboundInfo(tag string, nodeSpeedLimit uint64, userList *[]api.UserInfo, globalLimit *GlobalDeviceLimitConfig, limitConfig *LimitConfig) (*InboundInfo, error) {
 	inboundInfo := &InboundInfo{
-		Tag:            tag,
-		NodeSpeedLimit: nodeSpeedLimit,
-		BucketHub:      new(sync.Map),
-		UserOnlineIP:   new(sync.Map),
-		OnlineDevice:   new(sync.Map),
-		ipAllowedMap:   new(sync.Map),
-		Otraffic:       new(sync.Map),
+		Tag:          tag,
+		BucketHub:    new(sync.Map),
+		UserOnlineIP: new(sync.Map),
+		OnlineDevice: new(sync.Map),
+		ipAllowedMap: new(sync.Map),
+		Otraffic:     new(sync.Map),
+		ActiveConn:   new(sync.Map),
+		BannedUsers:  new(sync.Map),
+		BurstCredits: new(sync.Map),
+		Usage:        new(sync.Map),
+		deviceUsage:  newDeviceUsage(),
+		deviceGrace:  new(sync.Map),
+		ratio:        new(sync.Map),
+		ipOrder:      new(sync.Map),
+		rejects:      new(rejectCounters),
+	}
+	inboundInfo.NodeSpeedLimit.Store(nodeSpeedLimit)
+	inboundInfo.GlobalLimit.stats = new(globalCacheStats)
+	inboundInfo.GlobalLimit.globalOnlineIP = new(atomic.Pointer[marshaler.Marshaler])
+	inboundInfo.GlobalLimit.warnNoStore = new(sync.Once)
+
+	if limitConfig != nil {
+		inboundInfo.config = *limitConfig
+	}
+	switch inboundInfo.config.DeviceCountMode {
+	case DeviceCountByIP, DeviceCountByConn:
+	case "":
+		inboundInfo.config.DeviceCountMode = DeviceCountByIP
+	default:
+		return nil, fmt.Errorf("unsupported device count mode: %s", inboundInfo.config.DeviceCountMode)
+	}
+	switch inboundInfo.config.DeviceLimitAction {
+	case DeviceLimitReject, DeviceLimitThrottle:
+	case "":
+		inboundInfo.config.DeviceLimitAction = DeviceLimitReject
+	default:
+		return nil, fmt.Errorf("unsupported device limit action: %s", inboundInfo.config.DeviceLimitAction)
+	}
+	switch inboundInfo.config.OnlineMode {
+	case OnlineByTraffic, OnlineByConn:
+	case "":
+		inboundInfo.config.OnlineMode = OnlineByTraffic
+	default:
+		return nil, fmt.Errorf("unsupported online mode: %s", inboundInfo.config.OnlineMode)
+	}
+	switch inboundInfo.config.DeviceLimitCheckOrder {
+	case DeviceCheckLocalFirst, DeviceCheckGlobalFirst:
+	case "":
+		inboundInfo.config.DeviceLimitCheckOrder = DeviceCheckLocalFirst
+	default:
+		return nil, fmt.Errorf("unsupported device limit check order: %s", inboundInfo.config.DeviceLimitCheckOrder)
+	}
+	switch inboundInfo.config.TrackedIPsOverflow {
+	case TrackedIPsReject, TrackedIPsIgnore:
+	case "":
+		inboundInfo.config.TrackedIPsOverflow = TrackedIPsIgnore
+	default:
+		return nil, fmt.Errorf("unsupported tracked IPs overflow: %s", inboundInfo.config.TrackedIPsOverflow)
+	}
+	if inboundInfo.config.ThrottleRate == 0 {
+		inboundInfo.config.ThrottleRate = defaultThrottleRate
+	}
+	inboundInfo.speedBypass = make(map[string]bool, len(inboundInfo.config.SpeedLimitBypassUUIDs))
+	for _, uuid := range inboundInfo.config.SpeedLimitBypassUUIDs {
+		inboundInfo.speedBypass[uuid] = true
 	}
 
 	if globalLimit != nil && globalLimit.Enable {
 		inboundInfo.GlobalLimit.config = globalLimit
 
-		// init local store
-		gs := goCacheStore.NewGoCache(goCache.New(time.Duration(globalLimit.Expiry)*time.Second, 1*time.Minute))
-
 		// init redis store
-		rs := redisStore.NewRedis(redis.NewClient(
-			&redis.Options{
-				Network:  globalLimit.RedisNetwork,
-				Addr:     globalLimit.RedisAddr,
-				Username: globalLimit.RedisUsername,
-				Password: globalLimit.RedisPassword,
-				DB:       globalLimit.RedisDB,
-			}),
-			store.WithExpiration(time.Duration(globalLimit.Expiry)*time.Second))
-
-		// init chained cache. First use local go-cache, if go-cache is nil, then use redis cache
-		cacheManager := cache.NewChain(
-			cache.New[any](gs), // go-cache is priority
-			cache.New[any](rs),
-		)
-		inboundInfo.GlobalLimit.globalOnlineIP = marshaler.New(cacheManager)
+		addrs := globalLimit.RedisAddrs
+		if len(addrs) == 0 {
+			addrs = []string{globalLimit.RedisAddr}
+		}
+		clients := make(map[string]*redis.Client, len(addrs))
+		for _, addr := range addrs {
+			client, err := newRedisClient(globalLimit, addr)
+			if err != nil {
+				return nil, err
+			}
+			clients[addr] = client
+		}
+		var rs store.StoreInterface
+		if len(globalLimit.RedisAddrs) > 0 {
+			// Each user always goes to the same redis by consistent hashing
+			stores := make(map[string]store.StoreInterface, len(clients))
+			for addr, client := range clients {
+				stores[addr] = newRedisStore(globalLimit, client)
+			}
+			rs = newRingStore(stores)
+		} else {
+			rs = newRedisStore(globalLimit, clients[globalLimit.RedisAddr])
+		}
+
+		inboundInfo.GlobalLimit.remoteStore = rs
+		inboundInfo.GlobalLimit.globalOnlineIP.Store(newGlobalCache(globalLimit, rs, true))
+		inboundInfo.GlobalLimit.pusher = newPushPool(globalLimit.PushWorkers, func(key string, ipMap *map[string]int) {
+			pushIP(inboundInfo, key, ipMap)
+		})
 	}
 
 	userMap := new(sync.Map)
 	for _, u := range *userList {
 		userMap.Store(fmt.Sprintf("%s|%s|%d", tag, u.Email, u.UID), UserInfo{
-			UID:         u.UID,
-			SpeedLimit:  u.SpeedLimit,
-			DeviceLimit: u.DeviceLimit,
+			UID:            u.UID,
+			UUID:           u.UUID,
+			SpeedLimit:     userSpeedLimit(u),
+			DeviceLimit:    u.DeviceLimit,
+			IdleTimeout:    u.IdleTimeout,
+			PolicyID:       u.PolicyID,
+			BurstCredit:    u.BurstCredit,
+			ResetDay:       u.ResetDay,
+			TrafficQuota:   u.TrafficQuota,
+			MaxUploadRatio: u.MaxUploadRatio,
 		})
 	}
 	inboundInfo.UserInfo = userMap
-	l.InboundInfo.Store(tag, inboundInfo) // Replace the old inbound info
-	return nil
+	return inboundInfo, nil
 }
 
 func (l *Limiter) UpdateInboundLimiter(tag string, updatedUserList *[]api.UserInfo) error {
@@ -108,17 +312,24 @@ func (l *Limiter) UpdateInboundLimiter(tag string, updatedUserList *[]api.UserIn
 		// Update User info
 		for _, u := range *updatedUserList {
 			inboundInfo.UserInfo.Store(fmt.Sprintf("%s|%s|%d", tag, u.Email, u.UID), UserInfo{
-				UID:         u.UID,
-				SpeedLimit:  u.SpeedLimit,
-				DeviceLimit: u.DeviceLimit,
+				UID:            u.UID,
+				UUID:           u.UUID,
+				SpeedLimit:     userSpeedLimit(u),
+				DeviceLimit:    u.DeviceLimit,
+				IdleTimeout:    u.IdleTimeout,
+				PolicyID:       u.PolicyID,
+				BurstCredit:    u.BurstCredit,
+				ResetDay:       u.ResetDay,
+				TrafficQuota:   u.TrafficQuota,
+				MaxUploadRatio: u.MaxUploadRatio,
 			})
 			// Update old limiter bucket
-			limit := determineRate(inboundInfo.NodeSpeedLimit, u.SpeedLimit)
+			limit := determineRate(inboundInfo.NodeSpeedLimit.Load(), userSpeedLimit(u))
 			if limit > 0 {
 				if bucket, ok := inboundInfo.BucketHub.Load(fmt.Sprintf("%s|%s|%d", tag, u.Email, u.UID)); ok {
 					limiter := bucket.(*rate.Limiter)
 					limiter.SetLimit(rate.Limit(limit))
-					limiter.SetBurst(int(limit))
+					limiter.SetBurst(inboundInfo.burst(limit))
 				}
 			} else {
 				inboundInfo.BucketHub.Delete(fmt.Sprintf("%s|%s|%d", tag, u.Email, u.UID))
@@ -130,11 +341,106 @@ func (l *Limiter) UpdateInboundLimiter(tag string, updatedUserList *[]api.UserIn
 	return nil
 }
 
+// ReplaceInboundUsers makes users the whole user set of the inbound, the state of the users
+// no longer in it is dropped and the buckets of the others are kept
+func (l *Limiter) ReplaceInboundUsers(tag string, users *[]api.UserInfo) error {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+	inboundInfo := value.(*InboundInfo)
+	current := make(map[string]struct{}, len(*users))
+	for _, u := range *users {
+		current[fmt.Sprintf("%s|%s|%d", tag, u.Email, u.UID)] = struct{}{}
+	}
+	inboundInfo.UserInfo.Range(func(key, value interface{}) bool {
+		email := key.(string)
+		if _, ok := current[email]; !ok {
+			for _, m := range []*sync.Map{inboundInfo.UserInfo, inboundInfo.BucketHub, inboundInfo.UserOnlineIP,
+				inboundInfo.ActiveConn, inboundInfo.BurstCredits,
+				inboundInfo.Usage, inboundInfo.deviceGrace, inboundInfo.ratio, inboundInfo.ipOrder} {
+				m.Delete(email)
+			}
+			// The devices and traffic of the report cycle are keyed by UID
+			uid := value.(UserInfo).UID
+			inboundInfo.OnlineDevice.Delete(uid)
+			inboundInfo.Otraffic.Delete(uid)
+		}
+		return true
+	})
+	return l.UpdateInboundLimiter(tag, users)
+}
+
+// SetBannedUsers replaces the banned users of the inbound, their connections are rejected
+func (l *Limiter) SetBannedUsers(tag string, bannedList *[]int) error {
+	if value, ok := l.InboundInfo.Load(tag); ok {
+		inboundInfo := value.(*InboundInfo)
+		banned := make(map[int]struct{}, len(*bannedList))
+		for _, uid := range *bannedList {
+			banned[uid] = struct{}{}
+			inboundInfo.BannedUsers.Store(uid, struct{}{})
+		}
+		// Unban the users no longer in the list
+		inboundInfo.BannedUsers.Range(func(key, value interface{}) bool {
+			if _, ok := banned[key.(int)]; !ok {
+				inboundInfo.BannedUsers.Delete(key)
+			}
+			return true
+		})
+	} else {
+		return fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+	return nil
+}
+
 func (l *Limiter) DeleteInboundLimiter(tag string) error {
-	l.InboundInfo.Delete(tag)
+	if value, ok := l.InboundInfo.LoadAndDelete(tag); ok {
+		if pusher := value.(*InboundInfo).GlobalLimit.pusher; pusher != nil {
+			pusher.close()
+		}
+	}
 	return nil
 }
 
+// GetUserIdleTimeout returns the idle timeout hint of the user, zero means no hint
+func (l *Limiter) GetUserIdleTimeout(tag string, email string) time.Duration {
+	if value, ok := l.InboundInfo.Load(tag); ok {
+		inboundInfo := value.(*InboundInfo)
+		if v, ok := inboundInfo.UserInfo.Load(email); ok {
+			return time.Duration(v.(UserInfo).IdleTimeout) * time.Second
+		}
+	}
+	return 0
+}
+
+// GetUserPolicyID returns the routing policy of the user, zero means no policy
+func (l *Limiter) GetUserPolicyID(tag string, email string) int {
+	if value, ok := l.InboundInfo.Load(tag); ok {
+		inboundInfo := value.(*InboundInfo)
+		if v, ok := inboundInfo.UserInfo.Load(email); ok {
+			return v.(UserInfo).PolicyID
+		}
+	}
+	return 0
+}
+
+// Tags returns the sorted tags of all inbounds managed by the limiter
+func (l *Limiter) Tags() []string {
+	var tags []string
+	l.InboundInfo.Range(func(key, value interface{}) bool {
+		tags = append(tags, key.(string))
+		return true
+	})
+	sort.Strings(tags)
+	return tags
+}
+
+// HasInbound reports whether the limiter manages the inbound
+func (l *Limiter) HasInbound(tag string) bool {
+	_, ok := l.InboundInfo.Load(tag)
+	return ok
+}
+
 func (l *Limiter) ResetOtraffic(tag string) error {
 	if value, ok := l.InboundInfo.Load(tag); ok {
 		inboundInfo := value.(*InboundInfo)
@@ -151,6 +457,10 @@ func (l *Limiter) GetOnlineDevice(tag string, userTraffic map[int]int64, T int64
 	diff := false
 	if value, ok := l.InboundInfo.Load(tag); ok {
 		inboundInfo := value.(*InboundInfo)
+		// Forget the status of the IPs going offline in this report
+		defer pruneIPAllowed(inboundInfo)
+		defer pruneIdleSince(inboundInfo)
+		sampleDeviceMinutes(inboundInfo)
 		// Clear Speed Limiter bucket for users who are not online
 		inboundInfo.BucketHub.Range(func(key, value interface{}) bool {
 			email := key.(string)
@@ -169,45 +479,160 @@ func (l *Limiter) GetOnlineDevice(tag string, userTraffic map[int]int64, T int64
 		})
 		inboundInfo.OnlineDevice = new(sync.Map)
 		inboundInfo.Otraffic = new(sync.Map)
+		if inboundInfo.config.OnlineMode == OnlineByConn {
+			onlineUser, diff = onlineByConn(inboundInfo, userTraffic, PrevO)
+			return &onlineUser, diff, nil
+		}
+		onlineUser, diff = onlineByIP(inboundInfo, userTraffic, PrevT, PrevO, T)
+	} else {
+		return nil, false, fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+
+	return &onlineUser, diff, nil
+}
+
+// pruneIPAllowed deletes the status of the IPs no user is online with
+func pruneIPAllowed(inboundInfo *InboundInfo) {
+	online := make(map[string]bool)
+	inboundInfo.UserOnlineIP.Range(func(key, value interface{}) bool {
+		value.(*sync.Map).Range(func(key, value interface{}) bool {
+			online[key.(string)] = true
+			return true
+		})
+		return true
+	})
+	inboundInfo.ipAllowedMap.Range(func(key, value interface{}) bool {
+		if !online[key.(string)] {
+			inboundInfo.ipAllowedMap.Delete(key)
+		}
+		return true
+	})
+}
+
+// ClearIPAllowed forgets the status of all the IPs seen on the inbound, they are checked again on the next connection
+func (l *Limiter) ClearIPAllowed(tag string) error {
+	if value, ok := l.InboundInfo.Load(tag); ok {
+		value.(*InboundInfo).ipAllowedMap.Clear()
+		return nil
+	}
+	return fmt.Errorf("no such inbound in limiter: %s", tag)
+}
+
+// ResetDeviceState forgets the online devices of the users on the inbound, e.g. after the device limits changed.
+// The speed buckets are kept so throttling goes on, and the traffic is left to ResetOtraffic.
+func (l *Limiter) ResetDeviceState(tag string) error {
+	if value, ok := l.InboundInfo.Load(tag); ok {
+		inboundInfo := value.(*InboundInfo)
+		inboundInfo.UserOnlineIP.Clear()
+		inboundInfo.OnlineDevice.Clear()
+		inboundInfo.ipAllowedMap.Clear()
+		inboundInfo.ipOrder.Clear()
+		return nil
+	}
+	return fmt.Errorf("no such inbound in limiter: %s", tag)
+}
+
+// onlineByIP collects the online IPs of the users
+func onlineByIP(inboundInfo *InboundInfo, userTraffic map[int]int64, PrevT map[int]int64, PrevO map[int]string, T int64) (onlineUser []api.OnlineUser, diff bool) {
+	inboundInfo.UserOnlineIP.Range(func(key, value interface{}) bool {
+		online, changed := userOnlineIPs(inboundInfo, key.(string), value.(*sync.Map), userTraffic, PrevT, PrevO, T)
+		onlineUser = append(onlineUser, online...)
+		diff = diff || changed
+		return true
+	})
+	return onlineUser, diff
+}
+
+// userOnlineIPs collects the online IPs of a user, the user is reset when it sent no traffic
+// or its IPs are not alive
+func userOnlineIPs(inboundInfo *InboundInfo, email string, ipMap *sync.Map, userTraffic map[int]int64, PrevT map[int]int64, PrevO map[int]string, T int64) (onlineUser []api.OnlineUser, diff bool) {
+	var uid int
+	var X int64
+	var A int
+	var pip string
+	ipMap.Range(func(key, value interface{}) bool {
+		uid = value.(int)
+		ip := key.(string)
+		if a, aok := inboundInfo.ipAllowedMap.Load(ip); aok {
+			A = a.(int)
+		}
+		inboundInfo.Otraffic.Store(uid, userTraffic[uid])
+		X = userTraffic[uid] - PrevT[uid]
+		pip = PrevO[uid]
+		if A != 2 {
+			if X <= T {
+				ip = ""
+			}
+			if pip != ip {
+				diff = true
+			}
+			onlineUser = append(onlineUser, api.OnlineUser{UID: uid, IP: ip})
+			inboundInfo.OnlineDevice.Store(uid, ip)
+			// log.Printf("onlineUser Store,UID: %d,IP: %s", uid, ip)
+		}
+		return true
+	})
+	if A == 2 || X <= T {
+		inboundInfo.UserOnlineIP.Delete(email) // Reset online device
+	}
+	return onlineUser, diff
+}
+
+// onlineByConn takes the devices holding an active connection as online, whatever their traffic
+func onlineByConn(inboundInfo *InboundInfo, userTraffic map[int]int64, PrevO map[int]string) (onlineUser []api.OnlineUser, diff bool) {
+	active := make(map[string]bool)
+	inboundInfo.ActiveConn.Range(func(key, value interface{}) bool {
+		email := key.(string)
+		v, ok := inboundInfo.UserInfo.Load(email)
+		if !ok {
+			return true
+		}
+		uid := v.(UserInfo).UID
+		for _, ip := range value.(*connCounter).activeIPs() {
+			active[email] = true
+			if PrevO[uid] != ip {
+				diff = true
+			}
+			onlineUser = append(onlineUser, api.OnlineUser{UID: uid, IP: ip})
+			inboundInfo.OnlineDevice.Store(uid, ip)
+			inboundInfo.Otraffic.Store(uid, userTraffic[uid])
+		}
+		return true
+	})
+	// Reset the devices of users without connection
+	inboundInfo.UserOnlineIP.Range(func(key, value interface{}) bool {
+		if !active[key.(string)] {
+			inboundInfo.UserOnlineIP.Delete(key)
+		}
+		return true
+	})
+	return onlineUser, diff
+}
+
+// PeekOnlineDevice returns the devices currently online without resetting the state of the report cycle,
+// unlike GetOnlineDevice it does not filter by traffic.
+func (l *Limiter) PeekOnlineDevice(tag string) (*[]api.OnlineUser, error) {
+	var onlineUser []api.OnlineUser
+
+	if value, ok := l.InboundInfo.Load(tag); ok {
+		inboundInfo := value.(*InboundInfo)
 		inboundInfo.UserOnlineIP.Range(func(key, value interface{}) bool {
-			email := key.(string)
-			ipMap := value.(*sync.Map)
-			var uid int
-			var X int64
-			var A int
-			var pip string
-			ipMap.Range(func(key, value interface{}) bool {
-				uid = value.(int)
+			value.(*sync.Map).Range(func(key, value interface{}) bool {
 				ip := key.(string)
-				if a, aok := inboundInfo.ipAllowedMap.Load(ip); aok {
-					A = a.(int)
-				}
-				inboundInfo.Otraffic.Store(uid, userTraffic[uid])
-				X = userTraffic[uid] - PrevT[uid]
-				pip = PrevO[uid]
-				if A != 2 {
-					if X <= T {
-						ip = ""
-					}
-					if pip != ip {
-						diff = true
-					}
-					onlineUser = append(onlineUser, api.OnlineUser{UID: uid, IP: ip})
-					inboundInfo.OnlineDevice.Store(uid, ip)
-					// log.Printf("onlineUser Store,UID: %d,IP: %s", uid, ip)
+				// Skip the IPs not in the alive IPs of the panel
+				if a, ok := inboundInfo.ipAllowedMap.Load(ip); ok && a.(int) == 2 {
+					return true
 				}
+				onlineUser = append(onlineUser, api.OnlineUser{UID: value.(int), IP: ip})
 				return true
 			})
-			if A == 2 || X <= T {
-				inboundInfo.UserOnlineIP.Delete(email) // Reset online device
-			}
 			return true
 		})
 	} else {
-		return nil, false, fmt.Errorf("no such inbound in limiter: %s", tag)
+		return nil, fmt.Errorf("no such inbound in limiter: %s", tag)
 	}
 
-	return &onlineUser, diff, nil
+	return &onlineUser, nil
 }
 
 func GetUserAliveIPs(user int) []string {
@@ -222,68 +647,105 @@ func ipAllowed(ip string, aliveIPs []string) int {
 		return 0 // AliveIPs为空
 	}
 	for _, aliveIP := range aliveIPs {
-		if aliveIP == ip {
+		if normalizeIP(aliveIP) == ip {
 			return 1 // IP在AliveIPs中
 		}
 	}
 	return 2 // IP不在AliveIPs中
 }
 func (l *Limiter) GetUserBucket(tag string, email string, ip string, isSourceTCP bool) (limiter *rate.Limiter, SpeedLimit bool, Reject bool) {
+	ip = normalizeIP(ip)
 	if value, ok := l.InboundInfo.Load(tag); ok {
 		var (
 			userLimit        uint64 = 0
 			deviceLimit, uid int
+			uuid             string
 		)
 
 		inboundInfo := value.(*InboundInfo)
-		nodeLimit := inboundInfo.NodeSpeedLimit
+		nodeLimit := inboundInfo.NodeSpeedLimit.Load()
 
 		if v, ok := inboundInfo.UserInfo.Load(email); ok {
 			u := v.(UserInfo)
 			uid = u.UID
+			uuid = u.UUID
 			userLimit = u.SpeedLimit
 			deviceLimit = u.DeviceLimit
-		}
-		// Local device limit, only for TCP connection
-		if isSourceTCP {
-			ipMap := new(sync.Map)
-			aliveIPs := GetUserAliveIPs(uid)
-			ipStatus := ipAllowed(ip, aliveIPs)
-			inboundInfo.ipAllowedMap.Store(ip, ipStatus)
-			// log.Printf("Check: ipStatus=%d, userid=%d, aliveips=%s, devicelimit=%d, speedlimit=%d", ipStatus, uid, ip, deviceLimit, userLimit)
-			if ipStatus == 2 && deviceLimit > 0 && deviceLimit <= len(aliveIPs) {
+			// Banned by the panel
+			if _, banned := inboundInfo.BannedUsers.Load(uid); banned {
+				inboundInfo.rejects.banned.Add(1)
 				return nil, false, true
 			}
-			ipMap.Store(ip, uid)
-			// If any device is online
-			if v, ok := inboundInfo.UserOnlineIP.LoadOrStore(email, ipMap); ok {
-				ipMap := v.(*sync.Map)
-				// If this is a new ip
-				if _, ok := ipMap.LoadOrStore(ip, uid); !ok {
-					counter := 0
-					ipMap.Range(func(key, value interface{}) bool {
-						counter++
-						return true
-					})
-					if ipStatus != 1 && deviceLimit > 0 && deviceLimit < counter+len(aliveIPs) {
-						ipMap.Delete(ip)
-						return nil, false, true
-					}
-				}
+			// Uploads too much, e.g. seeding, until the downloads catch up
+			if u.MaxUploadRatio > 0 && overUploadRatio(inboundInfo, email, u.MaxUploadRatio) {
+				inboundInfo.rejects.ratio.Add(1)
+				inboundInfo.events.emit(LimiterEvent{Type: EventQuotaExceeded, Tag: tag, UID: uid, IP: ip})
+				return nil, false, true
+			}
+			// Used up the traffic of the period, until the next ResetDay
+			if u.TrafficQuota > 0 && overTrafficQuota(inboundInfo, email, u) {
+				inboundInfo.rejects.quota.Add(1)
+				inboundInfo.events.emit(LimiterEvent{Type: EventQuotaExceeded, Tag: tag, UID: uid, IP: ip})
+				return nil, false, true
+			}
+		}
+		// Local device limit, only for TCP connection unless UDP is tracked. A device is keyed by its IP,
+		// so TCP and UDP from the same IP count once.
+		// The IP of a proxy in front of the node is not a device
+		exempt := inboundInfo.config.ExemptPrivateIPs && privateIP(ip)
+		checkLocal := (isSourceTCP || inboundInfo.config.TrackUDPDevices) && inboundInfo.config.DeviceCountMode == DeviceCountByIP && !exempt
+		checkGlobal := inboundInfo.globalLimitEnabled() && !exempt
+		// The counter of the check the connection fails
+		var overLimit *atomic.Uint64
+		if inboundInfo.config.DeviceLimitCheckOrder == DeviceCheckGlobalFirst {
+			if checkGlobal && globalLimit(inboundInfo, email, uid, ip, deviceLimit) {
+				overLimit = &inboundInfo.rejects.global
+			} else if checkLocal && localLimit(inboundInfo, email, uid, ip, deviceLimit) {
+				overLimit = &inboundInfo.rejects.device
+			}
+		} else {
+			if checkLocal && localLimit(inboundInfo, email, uid, ip, deviceLimit) {
+				overLimit = &inboundInfo.rejects.device
+			} else if checkGlobal && globalLimit(inboundInfo, email, uid, ip, deviceLimit) {
+				overLimit = &inboundInfo.rejects.global
 			}
 		}
 
-		// GlobalLimit
-		if inboundInfo.GlobalLimit.config != nil && inboundInfo.GlobalLimit.config.Enable {
-			if reject := globalLimit(inboundInfo, email, uid, ip, deviceLimit); reject {
-				return nil, false, true
+		// Count the connection, in conn mode every connection is a device
+		if isSourceTCP && overLimit == nil {
+			connLimit := 0
+			if inboundInfo.config.DeviceCountMode == DeviceCountByConn && !exempt {
+				connLimit = deviceLimit
+			}
+			if !acquireConn(inboundInfo, email, ip, connLimit) {
+				overLimit = &inboundInfo.rejects.conn
+			}
+		}
+
+		if overLimit != nil {
+			if !graceAdmit(inboundInfo, email) {
+				limiter, speedLimit, reject := overDeviceLimit(inboundInfo, email, ip, isSourceTCP, overLimit)
+				if reject {
+					inboundInfo.events.emit(LimiterEvent{Type: EventDeviceReject, Tag: tag, UID: uid, IP: ip})
+					if l.OnDeviceLimitReject != nil {
+						go l.OnDeviceLimitReject(tag, uid, ip)
+					}
+				}
+				return limiter, speedLimit, reject
+			}
+			// Admitted within the grace count, it holds a slot like any connection
+			if isSourceTCP {
+				acquireConn(inboundInfo, email, ip, 0)
 			}
 		}
 
 		// Speed limit
+		if inboundInfo.config.DisableSpeedLimit || inboundInfo.speedBypass[uuid] {
+			return nil, false, false
+		}
 		limit := determineRate(nodeLimit, userLimit) // Determine the speed limit rate
 		if limit > 0 {
-			limiter := rate.NewLimiter(rate.Limit(limit), int(limit)) // Byte/s
+			limiter := rate.NewLimiter(rate.Limit(limit), inboundInfo.burst(limit)) // Byte/s
 			if v, ok := inboundInfo.BucketHub.LoadOrStore(email, limiter); ok {
 				bucket := v.(*rate.Limiter)
 				return bucket, true, false
@@ -300,6 +762,255 @@ func (l *Limiter) GetUserBucket(tag string, email string, ip string, isSourceTCP
 	}
 }
 
+// newRedisClient connects to redis over tcp or a unix socket. A unix socket is local, so it must be reachable at startup.
+func newRedisClient(globalLimit *GlobalDeviceLimitConfig, addr string) (*redis.Client, error) {
+	switch globalLimit.RedisNetwork {
+	case "", "tcp", "unix":
+	default:
+		return nil, fmt.Errorf("unsupported redis network: %s", globalLimit.RedisNetwork)
+	}
+	client := redis.NewClient(
+		&redis.Options{
+			Network:  globalLimit.RedisNetwork,
+			Addr:     addr,
+			Username: globalLimit.RedisUsername,
+			Password: globalLimit.RedisPassword,
+			DB:       globalLimit.RedisDB,
+		})
+	if globalLimit.RedisNetwork == "unix" {
+		timeout := time.Duration(globalLimit.Timeout) * time.Second
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := client.Ping(ctx).Err(); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("redis unix socket %s is unreachable: %w", addr, err)
+		}
+	}
+	return client, nil
+}
+
+func newRedisStore(globalLimit *GlobalDeviceLimitConfig, client *redis.Client) store.StoreInterface {
+	return redisStore.NewRedis(client, store.WithExpiration(time.Duration(globalLimit.Expiry)*time.Second))
+}
+
+// overDeviceLimit handles a connection of a user who reaches the device limit, rejects counts the rejection
+func overDeviceLimit(inboundInfo *InboundInfo, email string, ip string, isSourceTCP bool, rejects *atomic.Uint64) (limiter *rate.Limiter, SpeedLimit bool, Reject bool) {
+	if inboundInfo.config.DeviceLimitAction != DeviceLimitThrottle {
+		rejects.Add(1)
+		return nil, false, true
+	}
+	// The throttled connection still holds a slot, it is given back on close
+	if isSourceTCP {
+		acquireConn(inboundInfo, email, ip, 0)
+	}
+	throttleRate := inboundInfo.config.ThrottleRate
+	return rate.NewLimiter(rate.Limit(throttleRate), int(throttleRate)), true, false
+}
+
+// deviceGrace counts the over-limit connections of a user admitted in the current window
+type deviceGrace struct {
+	sync.Mutex
+	count       int
+	windowStart time.Time
+}
+
+// graceAdmit lets up to DeviceLimitGraceCount over-limit connections of the user through in each window,
+// so a device reconnecting from a new IP before its old one is gone is not rejected
+func graceAdmit(inboundInfo *InboundInfo, email string) bool {
+	if inboundInfo.config.DeviceLimitGraceCount <= 0 {
+		return false
+	}
+	window := time.Duration(inboundInfo.config.DeviceLimitGraceWindow) * time.Second
+	if window <= 0 {
+		window = defaultGraceWindow
+	}
+	v, _ := inboundInfo.deviceGrace.LoadOrStore(email, new(deviceGrace))
+	g := v.(*deviceGrace)
+	g.Lock()
+	defer g.Unlock()
+	if t := now(); t.Sub(g.windowStart) >= window {
+		g.count = 0
+		g.windowStart = t
+	}
+	if g.count >= inboundInfo.config.DeviceLimitGraceCount {
+		return false
+	}
+	g.count++
+	return true
+}
+
+// Local device limit, checks the ip against the alive IPs from the panel and the IPs online on this node
+func localLimit(inboundInfo *InboundInfo, email string, uid int, ip string, deviceLimit int) bool {
+	aliveIPs := GetUserAliveIPs(uid)
+	ipStatus := ipAllowed(ip, aliveIPs)
+	inboundInfo.ipAllowedMap.Store(ip, ipStatus)
+	// log.Printf("Check: ipStatus=%d, userid=%d, aliveips=%s, devicelimit=%d", ipStatus, uid, ip, deviceLimit)
+	if ipStatus == 2 && deviceLimit > 0 && deviceLimit <= len(aliveIPs) {
+		return true
+	}
+
+	ipMap := new(sync.Map)
+	ipMap.Store(ip, uid)
+	// If any device is online
+	if v, ok := inboundInfo.UserOnlineIP.LoadOrStore(email, ipMap); ok {
+		ipMap := v.(*sync.Map)
+		// If this is a new ip
+		if _, ok := ipMap.LoadOrStore(ip, uid); !ok {
+			counter := 0
+			ipMap.Range(func(key, value interface{}) bool {
+				counter++
+				return true
+			})
+			if ipStatus != 1 && deviceLimit > 0 && deviceLimit < counter+len(aliveIPs) {
+				// A reconnecting device with a new IP takes the slot of its idle old IP
+				if evictIdleDevice(inboundInfo, email, ip, ipMap) {
+					return newOnlineIP(inboundInfo, email, uid, ip, ipMap, counter-1)
+				}
+				ipMap.Delete(ip)
+				return true
+			}
+			return newOnlineIP(inboundInfo, email, uid, ip, ipMap, counter)
+		}
+		return false
+	}
+	return newOnlineIP(inboundInfo, email, uid, ip, ipMap, 1)
+}
+
+// newOnlineIP tracks the new IP of the user, there are count IPs with it. It reports whether ip is rejected.
+func newOnlineIP(inboundInfo *InboundInfo, email string, uid int, ip string, ipMap *sync.Map, count int) bool {
+	if trackIP(inboundInfo, email, ip, ipMap, count) {
+		return true
+	}
+	inboundInfo.events.emit(LimiterEvent{Type: EventNewOnlineIP, Tag: inboundInfo.Tag, UID: uid, IP: ip})
+	return false
+}
+
+// ipOrder keeps the online IPs of a user in the order they are added, it may hold IPs already gone
+type ipOrder struct {
+	sync.Mutex
+	ips []string
+}
+
+// trackIP bounds the online IPs of the user to MaxTrackedIPs after ip is added. Over the cap, the new IP
+// is rejected, or in ignore mode the oldest IP is forgotten. It reports whether ip is rejected.
+func trackIP(inboundInfo *InboundInfo, email string, ip string, ipMap *sync.Map, count int) bool {
+	maxIPs := inboundInfo.config.MaxTrackedIPs
+	if maxIPs <= 0 {
+		return false
+	}
+	if count > maxIPs && inboundInfo.config.TrackedIPsOverflow == TrackedIPsReject {
+		ipMap.Delete(ip)
+		return true
+	}
+	v, _ := inboundInfo.ipOrder.LoadOrStore(email, new(ipOrder))
+	order := v.(*ipOrder)
+	order.Lock()
+	defer order.Unlock()
+	for count > maxIPs && len(order.ips) > 0 {
+		oldest := order.ips[0]
+		order.ips = order.ips[1:]
+		if oldest == ip {
+			continue
+		}
+		if _, ok := ipMap.LoadAndDelete(oldest); ok {
+			count--
+		}
+	}
+	// The IPs added before the cap was set are not in the order
+	if count > maxIPs {
+		ipMap.Range(func(key, value interface{}) bool {
+			if key.(string) != ip {
+				ipMap.Delete(key)
+				count--
+			}
+			return count > maxIPs
+		})
+	}
+	order.ips = append(order.ips, ip)
+	// Drop the IPs removed by the online reports
+	if len(order.ips) > 2*maxIPs {
+		ips := make([]string, 0, maxIPs)
+		for _, ip := range order.ips {
+			if _, ok := ipMap.Load(ip); ok {
+				ips = append(ips, ip)
+			}
+		}
+		order.ips = ips
+	}
+	return false
+}
+
+// evictIdleDevice frees the slot of an online IP of the user without a connection for IdleDeviceReplace
+func evictIdleDevice(inboundInfo *InboundInfo, email string, ip string, ipMap *sync.Map) bool {
+	if inboundInfo.config.IdleDeviceReplace <= 0 {
+		return false
+	}
+	v, ok := inboundInfo.ActiveConn.Load(email)
+	if !ok {
+		return false
+	}
+	var ips []string
+	ipMap.Range(func(key, value interface{}) bool {
+		if key.(string) != ip {
+			ips = append(ips, key.(string))
+		}
+		return true
+	})
+	idleIP, ok := v.(*connCounter).evictIdle(ips, time.Duration(inboundInfo.config.IdleDeviceReplace)*time.Second)
+	if !ok {
+		return false
+	}
+	ipMap.Delete(idleIP)
+	return true
+}
+
+// newGlobalCache builds the cache of the global device limit over the redis store rs. With local, a go-cache is
+// looked up before redis, it saves round trips but may admit a device another node just added.
+func newGlobalCache(globalLimit *GlobalDeviceLimitConfig, rs store.StoreInterface, local bool) *marshaler.Marshaler {
+	if !local {
+		return marshaler.New(cache.New[any](rs))
+	}
+	gs := goCacheStore.NewGoCache(goCache.New(time.Duration(globalLimit.Expiry)*time.Second, 1*time.Minute))
+	// init chained cache. First use local go-cache, if go-cache is nil, then use redis cache
+	return marshaler.New(cache.NewChain(
+		cache.New[any](gs), // go-cache is priority
+		cache.New[any](rs),
+	))
+}
+
+// SetGlobalLocalCache turns the local go-cache of the global device limit of the inbound on or off, the
+// lookups go to redis alone while it is off. A cache turned on again starts empty.
+func (l *Limiter) SetGlobalLocalCache(tag string, enabled bool) error {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+	inboundInfo := value.(*InboundInfo)
+	if inboundInfo.GlobalLimit.remoteStore == nil {
+		return fmt.Errorf("global device limit is not enabled on inbound: %s", tag)
+	}
+	inboundInfo.GlobalLimit.globalOnlineIP.Store(newGlobalCache(inboundInfo.GlobalLimit.config, inboundInfo.GlobalLimit.remoteStore, enabled))
+	return nil
+}
+
+// globalLimitEnabled reports whether the global device limit is checked. An enabled limit without a store
+// is treated as disabled, with a warning once.
+func (i *InboundInfo) globalLimitEnabled() bool {
+	if i.GlobalLimit.config == nil || !i.GlobalLimit.config.Enable {
+		return false
+	}
+	if i.GlobalLimit.globalOnlineIP.Load() == nil {
+		i.GlobalLimit.warnNoStore.Do(func() {
+			errors.LogWarning(context.Background(), "Global device limit of ", i.Tag, " has no cache store, it is disabled")
+		})
+		return false
+	}
+	return true
+}
+
 // Global device limit
 func globalLimit(inboundInfo *InboundInfo, email string, uid int, ip string, deviceLimit int) bool {
 
@@ -309,16 +1020,21 @@ func globalLimit(inboundInfo *InboundInfo, email string, uid int, ip string, dev
 	// reformat email for unique key
 	uniqueKey := strings.Replace(email, inboundInfo.Tag, strconv.Itoa(deviceLimit), 1)
 
-	v, err := inboundInfo.GlobalLimit.globalOnlineIP.Get(ctx, uniqueKey, new(map[string]int))
+	stats := inboundInfo.GlobalLimit.stats
+	v, err := inboundInfo.GlobalLimit.globalOnlineIP.Load().Get(ctx, uniqueKey, new(map[string]int))
 	if err != nil {
 		if _, ok := err.(*store.NotFound); ok {
+			stats.misses.Add(1)
 			// If the email is a new device
-			go pushIP(inboundInfo, uniqueKey, &map[string]int{ip: uid})
+			queuePushIP(inboundInfo, uniqueKey, &map[string]int{ip: uid})
 		} else {
+			stats.errors.Add(1)
+			inboundInfo.events.emit(LimiterEvent{Type: EventGlobalCacheError, Tag: inboundInfo.Tag, UID: uid, IP: ip, Err: err})
 			errors.LogErrorInner(context.Background(), err, "cache service")
 		}
 		return false
 	}
+	stats.hits.Add(1)
 
 	ipMap := v.(*map[string]int)
 	// Reject device reach limit directly
@@ -329,22 +1045,74 @@ func globalLimit(inboundInfo *InboundInfo, email string, uid int, ip string, dev
 	// If the ip is not in cache
 	if _, ok := (*ipMap)[ip]; !ok {
 		(*ipMap)[ip] = uid
-		go pushIP(inboundInfo, uniqueKey, ipMap)
+		queuePushIP(inboundInfo, uniqueKey, ipMap)
 	}
 
 	return false
 }
 
+// GlobalCacheStats returns the cache stats of the global device limit of the inbound
+func (l *Limiter) GlobalCacheStats(tag string) (*GlobalCacheStats, error) {
+	if value, ok := l.InboundInfo.Load(tag); ok {
+		stats := value.(*InboundInfo).GlobalLimit.stats
+		return &GlobalCacheStats{
+			Hits:   stats.hits.Load(),
+			Misses: stats.misses.Load(),
+			Errors: stats.errors.Load(),
+		}, nil
+	}
+	return nil, fmt.Errorf("no such inbound in limiter: %s", tag)
+}
+
+// RejectStats returns the connections rejected on the inbound by reason since the last call
+func (l *Limiter) RejectStats(tag string) (*RejectStats, error) {
+	if value, ok := l.InboundInfo.Load(tag); ok {
+		rejects := value.(*InboundInfo).rejects
+		return &RejectStats{
+			Banned: rejects.banned.Swap(0),
+			Ratio:  rejects.ratio.Swap(0),
+			Quota:  rejects.quota.Swap(0),
+			Device: rejects.device.Swap(0),
+			Global: rejects.global.Swap(0),
+			Conn:   rejects.conn.Swap(0),
+		}, nil
+	}
+	return nil, fmt.Errorf("no such inbound in limiter: %s", tag)
+}
+
+// queuePushIP hands the write to the push workers, a write dropped by a full queue counts as an error
+func queuePushIP(inboundInfo *InboundInfo, uniqueKey string, ipMap *map[string]int) {
+	if !inboundInfo.GlobalLimit.pusher.enqueue(uniqueKey, ipMap) {
+		inboundInfo.GlobalLimit.stats.errors.Add(1)
+	}
+}
+
 // push the ip to cache
 func pushIP(inboundInfo *InboundInfo, uniqueKey string, ipMap *map[string]int) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(inboundInfo.GlobalLimit.config.Timeout)*time.Second)
 	defer cancel()
 
-	if err := inboundInfo.GlobalLimit.globalOnlineIP.Set(ctx, uniqueKey, ipMap); err != nil {
+	if err := inboundInfo.GlobalLimit.globalOnlineIP.Load().Set(ctx, uniqueKey, ipMap); err != nil {
+		inboundInfo.GlobalLimit.stats.errors.Add(1)
+		inboundInfo.events.emit(LimiterEvent{Type: EventGlobalCacheError, Tag: inboundInfo.Tag, Err: err})
 		errors.LogErrorInner(context.Background(), err, "cache service")
 	}
 }
 
+// mbpsToBps converts a speed limit in Mbps to Byte/s
+func mbpsToBps(mbps float64) uint64 {
+	return uint64(mbps * 1000000 / 8)
+}
+
+// userSpeedLimit is the speed limit of the user in Byte/s, SpeedLimit set by the controller
+// overrides the plan value
+func userSpeedLimit(u api.UserInfo) uint64 {
+	if u.SpeedLimit > 0 {
+		return u.SpeedLimit
+	}
+	return mbpsToBps(u.SpeedLimitMbps)
+}
+
 // determineRate returns the minimum non-zero rate
 func determineRate(nodeLimit, userLimit uint64) (limit uint64) {
 	if nodeLimit == 0 || userLimit == 0 {
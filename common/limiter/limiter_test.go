@@ -0,0 +1,971 @@
+package limiter
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eko/gocache/lib/v4/cache"
+	"github.com/eko/gocache/lib/v4/marshaler"
+	goCacheStore "github.com/eko/gocache/store/go_cache/v4"
+	goCache "github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+const testTag = "test_tag"
+
+func testEmail(u api.UserInfo) string {
+	return fmt.Sprintf("%s|%s|%d", testTag, u.Email, u.UID)
+}
+
+func newTestLimiter(t *testing.T, limitConfig *LimitConfig, users ...api.UserInfo) *Limiter {
+	l := New()
+	if err := l.AddInboundLimiter(testTag, 0, &users, nil, limitConfig); err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestDeviceCountByIP(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 2}
+	l := newTestLimiter(t, &LimitConfig{DeviceCountMode: DeviceCountByIP}, u)
+
+	// Many connections from one IP are a single device
+	for i := 0; i < 3; i++ {
+		_, _, reject := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+		assert.False(t, reject)
+	}
+	_, _, reject := l.GetUserBucket(testTag, testEmail(u), "2.2.2.2", true)
+	assert.False(t, reject)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "3.3.3.3", true)
+	assert.True(t, reject)
+}
+
+func TestDeviceCountByConn(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 2}
+	l := newTestLimiter(t, &LimitConfig{DeviceCountMode: DeviceCountByConn}, u)
+
+	for i := 0; i < 2; i++ {
+		_, _, reject := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+		assert.False(t, reject)
+	}
+	_, _, reject := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+	assert.True(t, reject)
+
+	// A closed connection frees its slot
+	l.ReleaseConn(testTag, testEmail(u), "1.1.1.1", true)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "2.2.2.2", true)
+	assert.False(t, reject)
+}
+
+func TestBannedUsers(t *testing.T) {
+	u1 := api.UserInfo{UID: 1, Email: "a@test"}
+	u2 := api.UserInfo{UID: 2, Email: "b@test"}
+	l := newTestLimiter(t, nil, u1, u2)
+
+	assert.NoError(t, l.SetBannedUsers(testTag, &[]int{1}))
+	_, _, reject := l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	assert.True(t, reject)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u2), "2.2.2.2", true)
+	assert.False(t, reject)
+
+	// Unban
+	assert.NoError(t, l.SetBannedUsers(testTag, &[]int{}))
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	assert.False(t, reject)
+
+	assert.Error(t, l.SetBannedUsers("no_such_tag", &[]int{1}))
+}
+
+func TestTags(t *testing.T) {
+	l := New()
+	assert.Empty(t, l.Tags())
+	for _, tag := range []string{"b_tag", "a_tag", "c_tag"} {
+		assert.NoError(t, l.AddInboundLimiter(tag, 0, &[]api.UserInfo{}, nil, nil))
+	}
+	assert.Equal(t, []string{"a_tag", "b_tag", "c_tag"}, l.Tags())
+	assert.True(t, l.HasInbound("a_tag"))
+
+	assert.NoError(t, l.DeleteInboundLimiter("a_tag"))
+	assert.False(t, l.HasInbound("a_tag"))
+	assert.Equal(t, []string{"b_tag", "c_tag"}, l.Tags())
+}
+
+func TestUserIdleTimeout(t *testing.T) {
+	u1 := api.UserInfo{UID: 1, Email: "a@test", IdleTimeout: 300}
+	u2 := api.UserInfo{UID: 2, Email: "b@test"}
+	l := newTestLimiter(t, nil, u1, u2)
+
+	assert.Equal(t, 300*time.Second, l.GetUserIdleTimeout(testTag, testEmail(u1)))
+	assert.Zero(t, l.GetUserIdleTimeout(testTag, testEmail(u2)))
+
+	u1.IdleTimeout = 60
+	assert.NoError(t, l.UpdateInboundLimiter(testTag, &[]api.UserInfo{u1}))
+	assert.Equal(t, 60*time.Second, l.GetUserIdleTimeout(testTag, testEmail(u1)))
+}
+
+func TestGlobalLimitWithoutStore(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 1}
+	l := New()
+	globalLimit := &GlobalDeviceLimitConfig{Enable: true, RedisAddr: "127.0.0.1:1", Timeout: 1, Expiry: 60}
+	assert.NoError(t, l.AddInboundLimiter(testTag, 0, &[]api.UserInfo{u}, globalLimit, nil))
+
+	// The store failed to build
+	value, _ := l.InboundInfo.Load(testTag)
+	value.(*InboundInfo).GlobalLimit.globalOnlineIP.Store(nil)
+
+	for _, ip := range []string{"1.1.1.1", "1.1.1.1"} {
+		_, _, reject := l.GetUserBucket(testTag, testEmail(u), ip, false)
+		assert.False(t, reject)
+	}
+	stats, err := l.GlobalCacheStats(testTag)
+	assert.NoError(t, err)
+	assert.Equal(t, &GlobalCacheStats{}, stats)
+}
+
+func TestAddInboundLimiterClosesPusher(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 1}
+	l := New()
+	globalLimit := &GlobalDeviceLimitConfig{Enable: true, RedisAddr: "127.0.0.1:1", Timeout: 1, Expiry: 60}
+	assert.NoError(t, l.AddInboundLimiter(testTag, 0, &[]api.UserInfo{u}, globalLimit, nil))
+	value, _ := l.InboundInfo.Load(testTag)
+	pusher := value.(*InboundInfo).GlobalLimit.pusher
+
+	// Adding the tag again replaces the inbound, the workers of the old one stop
+	assert.NoError(t, l.AddInboundLimiter(testTag, 0, &[]api.UserInfo{u}, globalLimit, nil))
+	assert.False(t, pusher.enqueue("a", &map[string]int{}))
+	value, _ = l.InboundInfo.Load(testTag)
+	assert.True(t, value.(*InboundInfo).GlobalLimit.pusher.enqueue("a", &map[string]int{}))
+	assert.NoError(t, l.DeleteInboundLimiter(testTag))
+}
+
+func TestSetGlobalLocalCache(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 2}
+	l := New()
+	globalLimit := &GlobalDeviceLimitConfig{Enable: true, RedisAddr: "127.0.0.1:1", Timeout: 1, Expiry: 60}
+	assert.NoError(t, l.AddInboundLimiter(testTag, 0, &[]api.UserInfo{u}, globalLimit, nil))
+	assert.NoError(t, l.AddInboundLimiter("no_global", 0, &[]api.UserInfo{u}, nil, nil))
+	assert.Error(t, l.SetGlobalLocalCache("no_global", false))
+	assert.Error(t, l.SetGlobalLocalCache("no_such_tag", false))
+
+	// A go-cache stands in for redis
+	value, _ := l.InboundInfo.Load(testTag)
+	inboundInfo := value.(*InboundInfo)
+	remote := goCacheStore.NewGoCache(goCache.New(time.Minute, time.Minute))
+	inboundInfo.GlobalLimit.remoteStore = remote
+	assert.NoError(t, l.SetGlobalLocalCache(testTag, true))
+	key := "2|a@test|1"
+	ctx := context.Background()
+	assert.NoError(t, marshaler.New(cache.New[any](remote)).Set(ctx, key, &map[string]int{"1.1.1.1": 1}))
+	lookup := func() *GlobalCacheStats {
+		before, _ := l.GlobalCacheStats(testTag)
+		l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", false)
+		after, _ := l.GlobalCacheStats(testTag)
+		return &GlobalCacheStats{Hits: after.Hits - before.Hits, Misses: after.Misses - before.Misses}
+	}
+
+	// The device is copied to the local layer, and found there once gone from redis
+	assert.Equal(t, &GlobalCacheStats{Hits: 1}, lookup())
+	assert.Eventually(t, func() bool {
+		remote.Delete(ctx, key)
+		return lookup().Hits == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// Redis alone
+	assert.NoError(t, l.SetGlobalLocalCache(testTag, false))
+	remote.Delete(ctx, key)
+	assert.Equal(t, &GlobalCacheStats{Misses: 1}, lookup())
+
+	// Safe with lookups in flight
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", false)
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, l.SetGlobalLocalCache(testTag, i%2 == 0))
+	}
+	wg.Wait()
+}
+
+func TestGlobalCacheStats(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 2}
+	l := New()
+	globalLimit := &GlobalDeviceLimitConfig{Enable: true, RedisAddr: "127.0.0.1:1", Timeout: 1, Expiry: 60}
+	assert.NoError(t, l.AddInboundLimiter(testTag, 0, &[]api.UserInfo{u}, globalLimit, nil))
+
+	// Back the global limit by go-cache only
+	value, _ := l.InboundInfo.Load(testTag)
+	inboundInfo := value.(*InboundInfo)
+	inboundInfo.GlobalLimit.globalOnlineIP.Store(marshaler.New(cache.New[any](goCacheStore.NewGoCache(goCache.New(time.Minute, time.Minute)))))
+
+	_, _, reject := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+	assert.False(t, reject)
+	stats, err := l.GlobalCacheStats(testTag)
+	assert.NoError(t, err)
+	assert.Equal(t, &GlobalCacheStats{Misses: 1}, stats)
+
+	// The device is pushed to cache asynchronously
+	assert.Eventually(t, func() bool {
+		l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+		stats, _ := l.GlobalCacheStats(testTag)
+		return stats.Hits > 0
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = l.GlobalCacheStats("no_such_tag")
+	assert.Error(t, err)
+}
+
+func TestGlobalCacheStatsErrors(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test"}
+	l := New()
+	// Redis is unreachable, the lookup falls through go-cache and fails
+	globalLimit := &GlobalDeviceLimitConfig{Enable: true, RedisAddr: "127.0.0.1:1", Timeout: 1, Expiry: 60}
+	assert.NoError(t, l.AddInboundLimiter(testTag, 0, &[]api.UserInfo{u}, globalLimit, nil))
+
+	_, _, reject := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+	assert.False(t, reject)
+	stats, err := l.GlobalCacheStats(testTag)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.Errors)
+	assert.Zero(t, stats.Hits)
+}
+
+func TestDeviceLimitAction(t *testing.T) {
+	testCases := []struct {
+		action   string
+		reject   bool
+		throttle bool
+	}{
+		{action: "", reject: true},
+		{action: DeviceLimitReject, reject: true},
+		{action: DeviceLimitThrottle, throttle: true},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.action, func(t *testing.T) {
+			u := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 1}
+			l := newTestLimiter(t, &LimitConfig{DeviceLimitAction: test.action, ThrottleRate: 1024}, u)
+
+			_, speedLimit, reject := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+			assert.False(t, reject)
+			assert.False(t, speedLimit)
+
+			bucket, speedLimit, reject := l.GetUserBucket(testTag, testEmail(u), "2.2.2.2", true)
+			assert.Equal(t, test.reject, reject)
+			assert.Equal(t, test.throttle, speedLimit)
+			if test.throttle {
+				assert.Equal(t, rate.Limit(1024), bucket.Limit())
+			}
+		})
+	}
+
+	l := New()
+	assert.Error(t, l.AddInboundLimiter(testTag, 0, &[]api.UserInfo{}, nil, &LimitConfig{DeviceLimitAction: "drop"}))
+}
+
+func TestReloadInboundLimiter(t *testing.T) {
+	u1 := api.UserInfo{UID: 1, Email: "a@test", SpeedLimit: 1000, DeviceLimit: 1}
+	u2 := api.UserInfo{UID: 2, Email: "b@test", SpeedLimit: 1000}
+	l := newTestLimiter(t, nil, u1, u2)
+
+	bucket1, ok, _ := l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	assert.True(t, ok)
+	_, ok, _ = l.GetUserBucket(testTag, testEmail(u2), "2.2.2.2", true)
+	assert.True(t, ok)
+
+	// u1 changes its limit and u2 is removed
+	u1.SpeedLimit = 2000
+	assert.NoError(t, l.ReloadInboundLimiter(testTag, 0, &[]api.UserInfo{u1}, nil, nil))
+
+	bucket, ok, reject := l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	assert.True(t, ok)
+	assert.False(t, reject)
+	assert.Same(t, bucket1, bucket)
+	assert.Equal(t, rate.Limit(2000), bucket.Limit())
+
+	// The online device survives the reload
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u1), "3.3.3.3", true)
+	assert.True(t, reject)
+
+	value, _ := l.InboundInfo.Load(testTag)
+	_, exists := value.(*InboundInfo).BucketHub.Load(testEmail(u2))
+	assert.False(t, exists)
+
+	// Reload adds a missing inbound
+	assert.NoError(t, l.ReloadInboundLimiter("new_tag", 0, &[]api.UserInfo{u1}, nil, nil))
+	assert.True(t, l.HasInbound("new_tag"))
+}
+
+func TestReplaceInboundUsers(t *testing.T) {
+	u1 := api.UserInfo{UID: 1, Email: "a@test", SpeedLimit: 1000}
+	u2 := api.UserInfo{UID: 2, Email: "b@test", SpeedLimit: 1000, DeviceLimit: 1}
+	l := newTestLimiter(t, nil, u1, u2)
+
+	bucket1, _, _ := l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	l.GetUserBucket(testTag, testEmail(u2), "2.2.2.2", true)
+	l.AddUserUsage(testTag, testEmail(u2), 100)
+	_, _, err := l.GetOnlineDevice(testTag, map[int]int64{1: 100, 2: 100}, 0)
+	assert.NoError(t, err)
+
+	// u2 is removed and u3 added
+	u3 := api.UserInfo{UID: 3, Email: "c@test", SpeedLimit: 3000}
+	assert.NoError(t, l.ReplaceInboundUsers(testTag, &[]api.UserInfo{u1, u3}))
+
+	value, _ := l.InboundInfo.Load(testTag)
+	inboundInfo := value.(*InboundInfo)
+	for _, m := range []*sync.Map{inboundInfo.UserInfo, inboundInfo.BucketHub, inboundInfo.UserOnlineIP, inboundInfo.ActiveConn, inboundInfo.Usage} {
+		_, exists := m.Load(testEmail(u2))
+		assert.False(t, exists)
+	}
+	// The devices and traffic are keyed by UID
+	for _, m := range []*sync.Map{inboundInfo.OnlineDevice, inboundInfo.Otraffic} {
+		_, exists := m.Load(u2.UID)
+		assert.False(t, exists)
+		_, exists = m.Load(u1.UID)
+		assert.True(t, exists)
+	}
+
+	// The bucket of the unchanged user is kept
+	bucket, ok, _ := l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	assert.True(t, ok)
+	assert.Same(t, bucket1, bucket)
+	bucket, ok, _ = l.GetUserBucket(testTag, testEmail(u3), "3.3.3.3", true)
+	assert.True(t, ok)
+	assert.Equal(t, rate.Limit(3000), bucket.Limit())
+
+	// u2 comes back with no state left
+	assert.NoError(t, l.ReplaceInboundUsers(testTag, &[]api.UserInfo{u1, u2, u3}))
+	assert.Zero(t, l.GetUserUsage(testTag, testEmail(u2)))
+	_, _, reject := l.GetUserBucket(testTag, testEmail(u2), "4.4.4.4", true)
+	assert.False(t, reject)
+
+	assert.Error(t, l.ReplaceInboundUsers("no_such_tag", &[]api.UserInfo{u1}))
+}
+
+func TestSetNodeSpeedLimit(t *testing.T) {
+	u1 := api.UserInfo{UID: 1, Email: "a@test", SpeedLimit: 1000}
+	u2 := api.UserInfo{UID: 2, Email: "b@test"}
+	l := newTestLimiter(t, nil, u1, u2)
+
+	bucket1, _, _ := l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	assert.Equal(t, rate.Limit(1000), bucket1.Limit())
+
+	assert.NoError(t, l.SetNodeSpeedLimit(testTag, 500))
+	assert.Equal(t, rate.Limit(500), bucket1.Limit())
+	assert.Equal(t, 500, bucket1.Burst())
+
+	// Users without a limit of their own get the node limit
+	bucket2, ok, _ := l.GetUserBucket(testTag, testEmail(u2), "2.2.2.2", true)
+	assert.True(t, ok)
+	assert.Equal(t, rate.Limit(500), bucket2.Limit())
+
+	// Removing the node limit drops the buckets of unlimited users
+	assert.NoError(t, l.SetNodeSpeedLimit(testTag, 0))
+	assert.Equal(t, rate.Limit(1000), bucket1.Limit())
+	_, ok, _ = l.GetUserBucket(testTag, testEmail(u2), "2.2.2.2", true)
+	assert.False(t, ok)
+
+	assert.Error(t, l.SetNodeSpeedLimit("no_such_tag", 500))
+}
+
+// Run with -race, the node limit is changed while connections look up their bucket
+func TestSetNodeSpeedLimitConcurrent(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test"}
+	l := newTestLimiter(t, nil, u)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", false)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert.NoError(t, l.SetNodeSpeedLimit(testTag, uint64(1000+j)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.NoError(t, l.SetNodeSpeedLimit(testTag, 500))
+	bucket, ok, _ := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", false)
+	assert.True(t, ok)
+	assert.Equal(t, rate.Limit(500), bucket.Limit())
+}
+
+func onlineDeviceCount(l *Limiter, email string) (n int) {
+	value, _ := l.InboundInfo.Load(testTag)
+	if v, ok := value.(*InboundInfo).UserOnlineIP.Load(email); ok {
+		v.(*sync.Map).Range(func(key, value interface{}) bool {
+			n++
+			return true
+		})
+	}
+	return n
+}
+
+func TestTrackUDPDevices(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 1}
+	l := newTestLimiter(t, &LimitConfig{TrackUDPDevices: true}, u)
+
+	// TCP and UDP from the same IP are one device
+	_, _, reject := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+	assert.False(t, reject)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", false)
+	assert.False(t, reject)
+	assert.Equal(t, 1, onlineDeviceCount(l, testEmail(u)))
+
+	// UDP from another IP is a new device
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "2.2.2.2", false)
+	assert.True(t, reject)
+	assert.Equal(t, 1, onlineDeviceCount(l, testEmail(u)))
+}
+
+func TestUntrackedUDPDevices(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 1}
+	l := newTestLimiter(t, nil, u)
+
+	_, _, reject := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+	assert.False(t, reject)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "2.2.2.2", false)
+	assert.False(t, reject)
+	assert.Equal(t, 1, onlineDeviceCount(l, testEmail(u)))
+}
+
+func TestPeekOnlineDevice(t *testing.T) {
+	u1 := api.UserInfo{UID: 1, Email: "a@test"}
+	u2 := api.UserInfo{UID: 2, Email: "b@test"}
+	l := newTestLimiter(t, nil, u1, u2)
+
+	l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	l.GetUserBucket(testTag, testEmail(u1), "2.2.2.2", true)
+	l.GetUserBucket(testTag, testEmail(u2), "3.3.3.3", true)
+	expected := []api.OnlineUser{{UID: 1, IP: "1.1.1.1"}, {UID: 1, IP: "2.2.2.2"}, {UID: 2, IP: "3.3.3.3"}}
+
+	// Peeking does not change the state
+	for i := 0; i < 2; i++ {
+		peek, err := l.PeekOnlineDevice(testTag)
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, expected, *peek)
+	}
+
+	// The report cycle sees the same devices, then forgets the idle ones
+	online, _, err := l.GetOnlineDevice(testTag, map[int]int64{1: 100}, 0)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []api.OnlineUser{{UID: 1, IP: "1.1.1.1"}, {UID: 1, IP: "2.2.2.2"}, {UID: 2, IP: ""}}, *online)
+
+	peek, err := l.PeekOnlineDevice(testTag)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []api.OnlineUser{{UID: 1, IP: "1.1.1.1"}, {UID: 1, IP: "2.2.2.2"}}, *peek)
+
+	_, err = l.PeekOnlineDevice("no_such_tag")
+	assert.Error(t, err)
+}
+
+func TestOnlineMode(t *testing.T) {
+	u1 := api.UserInfo{UID: 1, Email: "a@test"}
+	u2 := api.UserInfo{UID: 2, Email: "b@test"}
+	// u1 is idle but still connected, u2 used traffic and disconnected
+	userTraffic := map[int]int64{1: 0, 2: 1000}
+
+	l := newTestLimiter(t, &LimitConfig{OnlineMode: OnlineByTraffic}, u1, u2)
+	l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	l.GetUserBucket(testTag, testEmail(u2), "2.2.2.2", true)
+	l.ReleaseConn(testTag, testEmail(u2), "2.2.2.2", true)
+	online, _, err := l.GetOnlineDevice(testTag, userTraffic, 100)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []api.OnlineUser{{UID: 1, IP: ""}, {UID: 2, IP: "2.2.2.2"}}, *online)
+
+	l = newTestLimiter(t, &LimitConfig{OnlineMode: OnlineByConn}, u1, u2)
+	l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	l.GetUserBucket(testTag, testEmail(u2), "2.2.2.2", true)
+	l.ReleaseConn(testTag, testEmail(u2), "2.2.2.2", true)
+	online, diff, err := l.GetOnlineDevice(testTag, userTraffic, 100)
+	assert.NoError(t, err)
+	assert.True(t, diff)
+	assert.Equal(t, []api.OnlineUser{{UID: 1, IP: "1.1.1.1"}}, *online)
+
+	// Nothing changed since the last report
+	_, diff, _ = l.GetOnlineDevice(testTag, userTraffic, 100)
+	assert.False(t, diff)
+
+	assert.Error(t, New().AddInboundLimiter(testTag, 0, &[]api.UserInfo{}, nil, &LimitConfig{OnlineMode: "always"}))
+}
+
+func TestUserPolicyID(t *testing.T) {
+	u1 := api.UserInfo{UID: 1, Email: "a@test", PolicyID: 3}
+	u2 := api.UserInfo{UID: 2, Email: "b@test"}
+	l := newTestLimiter(t, nil, u1, u2)
+
+	assert.Equal(t, 3, l.GetUserPolicyID(testTag, testEmail(u1)))
+	assert.Zero(t, l.GetUserPolicyID(testTag, testEmail(u2)))
+	assert.Zero(t, l.GetUserPolicyID("no_such_tag", testEmail(u1)))
+
+	u2.PolicyID = 5
+	assert.NoError(t, l.UpdateInboundLimiter(testTag, &[]api.UserInfo{u2}))
+	assert.Equal(t, 5, l.GetUserPolicyID(testTag, testEmail(u2)))
+}
+
+func TestDeviceLimitCheckOrder(t *testing.T) {
+	testCases := []struct {
+		order      string
+		globalHits uint64 // The global check runs only when it goes first
+		localSeen  bool   // The local check records the ip it has seen
+	}{
+		{order: DeviceCheckLocalFirst, localSeen: true},
+		{order: DeviceCheckGlobalFirst, globalHits: 1},
+	}
+
+	for _, test := range testCases {
+		t.Run(test.order, func(t *testing.T) {
+			u := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 1}
+			l := New()
+			globalLimit := &GlobalDeviceLimitConfig{Enable: true, RedisAddr: "127.0.0.1:1", Timeout: 1, Expiry: 60}
+			assert.NoError(t, l.AddInboundLimiter(testTag, 0, &[]api.UserInfo{u}, globalLimit, &LimitConfig{DeviceLimitCheckOrder: test.order}))
+
+			value, _ := l.InboundInfo.Load(testTag)
+			inboundInfo := value.(*InboundInfo)
+			// Both layers are already over the limit
+			inboundInfo.GlobalLimit.globalOnlineIP.Store(marshaler.New(cache.New[any](goCacheStore.NewGoCache(goCache.New(time.Minute, time.Minute)))))
+			assert.NoError(t, inboundInfo.GlobalLimit.globalOnlineIP.Load().Set(context.Background(), "1|a@test|1", &map[string]int{"1.1.1.1": 1, "2.2.2.2": 1}))
+			ipMap := new(sync.Map)
+			ipMap.Store("1.1.1.1", 1)
+			inboundInfo.UserOnlineIP.Store(testEmail(u), ipMap)
+
+			_, _, reject := l.GetUserBucket(testTag, testEmail(u), "3.3.3.3", true)
+			assert.True(t, reject)
+			stats, _ := l.GlobalCacheStats(testTag)
+			assert.Equal(t, test.globalHits, stats.Hits)
+			_, seen := inboundInfo.ipAllowedMap.Load("3.3.3.3")
+			assert.Equal(t, test.localSeen, seen)
+		})
+	}
+
+	assert.Error(t, New().AddInboundLimiter(testTag, 0, &[]api.UserInfo{}, nil, &LimitConfig{DeviceLimitCheckOrder: "random"}))
+}
+
+func TestDisableSpeedLimit(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test", SpeedLimit: 1024, DeviceLimit: 1}
+	l := New()
+	assert.NoError(t, l.AddInboundLimiter(testTag, 2048, &[]api.UserInfo{u}, nil, &LimitConfig{DisableSpeedLimit: true}))
+
+	bucket, speedLimit, reject := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+	assert.Nil(t, bucket)
+	assert.False(t, speedLimit)
+	assert.False(t, reject)
+	value, _ := l.InboundInfo.Load(testTag)
+	_, ok := value.(*InboundInfo).BucketHub.Load(testEmail(u))
+	assert.False(t, ok)
+
+	// The device limit still applies
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "2.2.2.2", true)
+	assert.True(t, reject)
+}
+
+// serveFakeRedis answers PING, GET and SET like an empty redis on a unix socket
+func serveFakeRedis(t *testing.T, socket string) {
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					// A command is an array of bulk strings: *N, then $len and the arg for each
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					var args []string
+					for i := 0; i < n; i++ {
+						reader.ReadString('\n')
+						arg, _ := reader.ReadString('\n')
+						args = append(args, strings.TrimSpace(arg))
+					}
+					switch strings.ToUpper(args[0]) {
+					case "PING":
+						conn.Write([]byte("+PONG\r\n"))
+					case "GET":
+						conn.Write([]byte("$-1\r\n"))
+					case "SET":
+						conn.Write([]byte("+OK\r\n"))
+					default:
+						conn.Write([]byte("-ERR unknown command\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+}
+
+func TestRedisUnixSocket(t *testing.T) {
+	dir, err := os.MkdirTemp("", "redis")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "redis.sock")
+	serveFakeRedis(t, socket)
+
+	u := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 2}
+	globalLimit := &GlobalDeviceLimitConfig{Enable: true, RedisNetwork: "unix", RedisAddr: socket, Timeout: 1, Expiry: 60}
+	l := New()
+	assert.NoError(t, l.AddInboundLimiter(testTag, 0, &[]api.UserInfo{u}, globalLimit, nil))
+
+	// The lookup goes through the socket and misses
+	_, _, reject := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+	assert.False(t, reject)
+	stats, _ := l.GlobalCacheStats(testTag)
+	assert.Equal(t, &GlobalCacheStats{Misses: 1}, stats)
+
+	globalLimit = &GlobalDeviceLimitConfig{Enable: true, RedisNetwork: "unix", RedisAddr: filepath.Join(dir, "missing.sock"), Timeout: 1, Expiry: 60}
+	err = New().AddInboundLimiter(testTag, 0, &[]api.UserInfo{u}, globalLimit, nil)
+	assert.ErrorContains(t, err, "missing.sock is unreachable")
+
+	globalLimit = &GlobalDeviceLimitConfig{Enable: true, RedisNetwork: "udp", RedisAddr: socket}
+	assert.Error(t, New().AddInboundLimiter(testTag, 0, &[]api.UserInfo{u}, globalLimit, nil))
+}
+
+func TestIdleDeviceReplace(t *testing.T) {
+	clock := time.Now()
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = time.Now })
+
+	u := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 1}
+	l := newTestLimiter(t, &LimitConfig{IdleDeviceReplace: 30}, u)
+
+	_, _, reject := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+	assert.False(t, reject)
+	// The old IP holds a connection, it is never replaced
+	clock = clock.Add(time.Minute)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "2.2.2.2", true)
+	assert.True(t, reject)
+
+	// The phone drops the connection and reconnects from another network within the window
+	l.ReleaseConn(testTag, testEmail(u), "1.1.1.1", true)
+	clock = clock.Add(10 * time.Second)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "2.2.2.2", true)
+	assert.True(t, reject)
+
+	clock = clock.Add(30 * time.Second)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "2.2.2.2", true)
+	assert.False(t, reject)
+	assert.Equal(t, 1, onlineDeviceCount(l, testEmail(u)))
+
+	// The idle IPs are forgotten once the user goes offline
+	l.ReleaseConn(testTag, testEmail(u), "2.2.2.2", true)
+	assert.Equal(t, 1, idleIPCount(l, testEmail(u)))
+	_, _, err := l.GetOnlineDevice(testTag, map[int]int64{}, 0)
+	assert.NoError(t, err)
+	assert.Zero(t, idleIPCount(l, testEmail(u)))
+
+	// Disabled by default, the idle IPs are not tracked
+	l = newTestLimiter(t, nil, u)
+	l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+	l.ReleaseConn(testTag, testEmail(u), "1.1.1.1", true)
+	assert.Zero(t, idleIPCount(l, testEmail(u)))
+	clock = clock.Add(time.Hour)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "2.2.2.2", true)
+	assert.True(t, reject)
+}
+
+func idleIPCount(l *Limiter, email string) int {
+	value, _ := l.InboundInfo.Load(testTag)
+	v, ok := value.(*InboundInfo).ActiveConn.Load(email)
+	if !ok {
+		return 0
+	}
+	c := v.(*connCounter)
+	c.Lock()
+	defer c.Unlock()
+	return len(c.idleSince)
+}
+
+func TestPruneIPAllowed(t *testing.T) {
+	u1 := api.UserInfo{UID: 1, Email: "a@test"}
+	u2 := api.UserInfo{UID: 2, Email: "b@test"}
+	l := newTestLimiter(t, nil, u1, u2)
+	ipAllowedCount := func() (n int) {
+		value, _ := l.InboundInfo.Load(testTag)
+		value.(*InboundInfo).ipAllowedMap.Range(func(key, value interface{}) bool {
+			n++
+			return true
+		})
+		return n
+	}
+
+	for i := 0; i < 100; i++ {
+		l.GetUserBucket(testTag, testEmail(u1), fmt.Sprintf("10.0.0.%d", i), true)
+	}
+	l.GetUserBucket(testTag, testEmail(u2), "10.0.1.1", true)
+	assert.Equal(t, 101, ipAllowedCount())
+
+	// User 1 goes offline, user 2 stays
+	_, _, err := l.GetOnlineDevice(testTag, map[int]int64{2: 1024}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, ipAllowedCount())
+
+	assert.NoError(t, l.ClearIPAllowed(testTag))
+	assert.Zero(t, ipAllowedCount())
+	assert.Error(t, l.ClearIPAllowed("no_such_tag"))
+}
+
+func TestIPv4MappedIPv6(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 1}
+	l := newTestLimiter(t, nil, u)
+	api.UserAliveIPsMap.Store(u.UID, []string{"1.2.3.4"})
+	t.Cleanup(func() { api.UserAliveIPsMap.Delete(u.UID) })
+
+	// The same device as the alive IP from the panel
+	_, _, reject := l.GetUserBucket(testTag, testEmail(u), "::ffff:1.2.3.4", true)
+	assert.False(t, reject)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "1.2.3.4", true)
+	assert.False(t, reject)
+	assert.Equal(t, 1, onlineDeviceCount(l, testEmail(u)))
+
+	// The connection slot is given back whatever the form
+	l.ReleaseConn(testTag, testEmail(u), "::ffff:1.2.3.4", true)
+	l.ReleaseConn(testTag, testEmail(u), "1.2.3.4", true)
+	value, _ := l.InboundInfo.Load(testTag)
+	v, _ := value.(*InboundInfo).ActiveConn.Load(testEmail(u))
+	assert.Empty(t, v.(*connCounter).activeIPs())
+
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "::ffff:5.6.7.8", true)
+	assert.True(t, reject)
+	assert.Equal(t, "2001:db8::1", normalizeIP("2001:db8::1"))
+}
+
+func TestDeviceLimitGraceCount(t *testing.T) {
+	clock := time.Date(2024, 3, 8, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = time.Now })
+
+	u := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 1}
+	l := newTestLimiter(t, &LimitConfig{DeviceLimitGraceCount: 2, DeviceLimitGraceWindow: 30}, u)
+	_, _, reject := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+	assert.False(t, reject)
+
+	// Two over-limit connections are admitted, then rejected
+	for _, ip := range []string{"2.2.2.2", "3.3.3.3"} {
+		_, _, reject = l.GetUserBucket(testTag, testEmail(u), ip, true)
+		assert.False(t, reject, ip)
+	}
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "4.4.4.4", true)
+	assert.True(t, reject)
+	stats, _ := l.RejectStats(testTag)
+	assert.Equal(t, uint64(1), stats.Device)
+
+	// The next window
+	clock = clock.Add(30 * time.Second)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "4.4.4.4", true)
+	assert.False(t, reject)
+}
+
+func TestSpeedLimitBypass(t *testing.T) {
+	staff := api.UserInfo{UID: 1, UUID: "staff", Email: "a@test", SpeedLimit: 1024, DeviceLimit: 1}
+	u := api.UserInfo{UID: 2, UUID: "user", Email: "b@test", SpeedLimit: 1024, DeviceLimit: 1}
+	l := newTestLimiter(t, &LimitConfig{SpeedLimitBypassUUIDs: []string{"staff"}}, staff, u)
+
+	bucket, speedLimit, reject := l.GetUserBucket(testTag, testEmail(staff), "1.1.1.1", true)
+	assert.Nil(t, bucket)
+	assert.False(t, speedLimit)
+	assert.False(t, reject)
+	bucket, speedLimit, reject = l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+	assert.NotNil(t, bucket)
+	assert.True(t, speedLimit)
+	assert.False(t, reject)
+
+	// The devices of staff are still counted
+	_, _, reject = l.GetUserBucket(testTag, testEmail(staff), "2.2.2.2", true)
+	assert.True(t, reject)
+
+	// The UUID of a user may change on update
+	staff.UUID = "former-staff"
+	assert.NoError(t, l.UpdateInboundLimiter(testTag, &[]api.UserInfo{staff}))
+	_, speedLimit, _ = l.GetUserBucket(testTag, testEmail(staff), "1.1.1.1", true)
+	assert.True(t, speedLimit)
+}
+
+func TestResetDeviceState(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test", SpeedLimit: 1024, DeviceLimit: 1}
+	l := newTestLimiter(t, nil, u)
+
+	bucket, _, reject := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+	assert.False(t, reject)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "2.2.2.2", true)
+	assert.True(t, reject)
+
+	assert.NoError(t, l.ResetDeviceState(testTag))
+	assert.Error(t, l.ResetDeviceState("no_such_tag"))
+	value, _ := l.InboundInfo.Load(testTag)
+	inboundInfo := value.(*InboundInfo)
+	for _, m := range []*sync.Map{inboundInfo.UserOnlineIP, inboundInfo.OnlineDevice, inboundInfo.ipAllowedMap} {
+		m.Range(func(key, value interface{}) bool {
+			t.Errorf("%v is left after the reset", key)
+			return true
+		})
+	}
+	kept, ok := inboundInfo.BucketHub.Load(testEmail(u))
+	assert.True(t, ok)
+	assert.Same(t, bucket, kept)
+
+	// The new IP is the only device now, and shares the bucket
+	newBucket, _, reject := l.GetUserBucket(testTag, testEmail(u), "2.2.2.2", true)
+	assert.False(t, reject)
+	assert.Same(t, bucket, newBucket)
+}
+
+func TestSmoothingWindow(t *testing.T) {
+	testCases := []struct {
+		window int
+		burst  int
+	}{
+		{window: 0, burst: 4096},
+		{window: 250, burst: 1024},
+		{window: 3000, burst: 12288},
+	}
+
+	for _, test := range testCases {
+		t.Run(fmt.Sprint(test.window), func(t *testing.T) {
+			u := api.UserInfo{UID: 1, Email: "a@test", SpeedLimit: 4096}
+			l := newTestLimiter(t, &LimitConfig{SmoothingWindowMs: test.window}, u)
+
+			bucket, _, _ := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+			assert.Equal(t, test.burst, bucket.Burst())
+
+			// The burst follows a new limit
+			u.SpeedLimit = 8192
+			assert.NoError(t, l.UpdateInboundLimiter(testTag, &[]api.UserInfo{u}))
+			assert.Equal(t, test.burst*2, bucket.Burst())
+		})
+	}
+}
+
+func TestRejectStats(t *testing.T) {
+	u1 := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 1}
+	u2 := api.UserInfo{UID: 2, Email: "b@test"}
+	l := New()
+	globalLimit := &GlobalDeviceLimitConfig{Enable: true, RedisAddr: "127.0.0.1:1", Timeout: 1, Expiry: 60}
+	assert.NoError(t, l.AddInboundLimiter(testTag, 0, &[]api.UserInfo{u1, u2}, globalLimit, nil))
+	value, _ := l.InboundInfo.Load(testTag)
+	inboundInfo := value.(*InboundInfo)
+	inboundInfo.GlobalLimit.globalOnlineIP.Store(marshaler.New(cache.New[any](goCacheStore.NewGoCache(goCache.New(time.Minute, time.Minute)))))
+
+	// Device limit on this node
+	l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	l.GetUserBucket(testTag, testEmail(u1), "2.2.2.2", true)
+	l.GetUserBucket(testTag, testEmail(u1), "3.3.3.3", true)
+	// Global device limit, the other nodes see two devices
+	assert.NoError(t, inboundInfo.GlobalLimit.globalOnlineIP.Load().Set(context.Background(), "1|a@test|1", &map[string]int{"1.1.1.1": 1, "5.5.5.5": 1}))
+	l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	// Banned
+	assert.NoError(t, l.SetBannedUsers(testTag, &[]int{2}))
+	l.GetUserBucket(testTag, testEmail(u2), "1.1.1.1", true)
+
+	stats, err := l.RejectStats(testTag)
+	assert.NoError(t, err)
+	assert.Equal(t, &RejectStats{Banned: 1, Device: 2, Global: 1}, stats)
+
+	// Reset on each call
+	stats, _ = l.RejectStats(testTag)
+	assert.Equal(t, &RejectStats{}, stats)
+
+	// Connection limit in conn mode
+	l = newTestLimiter(t, &LimitConfig{DeviceCountMode: DeviceCountByConn}, u1)
+	l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	stats, _ = l.RejectStats(testTag)
+	assert.Equal(t, &RejectStats{Conn: 1}, stats)
+
+	_, err = l.RejectStats("no_such_tag")
+	assert.Error(t, err)
+}
+
+func TestExemptPrivateIPs(t *testing.T) {
+	u := api.UserInfo{UID: 1, Email: "a@test", SpeedLimit: 1024, DeviceLimit: 1}
+	l := newTestLimiter(t, &LimitConfig{ExemptPrivateIPs: true}, u)
+	_, _, reject := l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+	assert.False(t, reject)
+
+	// The private IPs of a reverse proxy are not devices, but still speed limited
+	for _, ip := range []string{"10.0.0.1", "192.168.1.1", "127.0.0.1", "fd00::1", "::1"} {
+		_, speedLimit, reject := l.GetUserBucket(testTag, testEmail(u), ip, true)
+		assert.False(t, reject, ip)
+		assert.True(t, speedLimit, ip)
+	}
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "2.2.2.2", true)
+	assert.True(t, reject)
+
+	// Counted by default
+	l = newTestLimiter(t, nil, u)
+	l.GetUserBucket(testTag, testEmail(u), "1.1.1.1", true)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "10.0.0.1", true)
+	assert.True(t, reject)
+}
+
+// newOnlineTestLimiter has n online users, user i sends i bytes and every tenth IP is not alive
+func newOnlineTestLimiter(tb testing.TB, n int) (*Limiter, map[int]int64) {
+	users := make([]api.UserInfo, n)
+	traffic := make(map[int]int64, n)
+	for i := range users {
+		users[i] = api.UserInfo{UID: i + 1, Email: fmt.Sprintf("%d@test", i+1)}
+		traffic[i+1] = int64(i % 3)
+	}
+	l := New()
+	if err := l.AddInboundLimiter(testTag, 0, &users, nil, nil); err != nil {
+		tb.Fatal(err)
+	}
+	value, _ := l.InboundInfo.Load(testTag)
+	inboundInfo := value.(*InboundInfo)
+	for i, u := range users {
+		ip := fmt.Sprintf("10.%d.%d.%d", i>>16&255, i>>8&255, i&255)
+		l.GetUserBucket(testTag, testEmail(u), ip, true)
+		if i%10 == 0 {
+			inboundInfo.ipAllowedMap.Store(ip, 2)
+		}
+	}
+	return l, traffic
+}
+
+func BenchmarkGetOnlineDevice(b *testing.B) {
+	l, traffic := newOnlineTestLimiter(b, 50000)
+	for i := 0; i < b.N; i++ {
+		// Every user sends traffic in each report, so it stays online
+		for uid := range traffic {
+			traffic[uid] += 1024
+		}
+		if _, _, err := l.GetOnlineDevice(testTag, traffic, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,12 +1,68 @@
 package limiter
 
+import "sync/atomic"
+
 type GlobalDeviceLimitConfig struct {
-	Enable        bool   `mapstructure:"Enable"`
-	RedisNetwork  string `mapstructure:"RedisNetwork"` // tcp or unix
-	RedisAddr     string `mapstructure:"RedisAddr"`    // host:port, or /path/to/unix.sock
-	RedisUsername string `mapstructure:"RedisUsername"`
-	RedisPassword string `mapstructure:"RedisPassword"`
-	RedisDB       int    `mapstructure:"RedisDB"`
-	Timeout       int    `mapstructure:"Timeout"`
-	Expiry        int    `mapstructure:"Expiry"` // second
+	Enable        bool     `mapstructure:"Enable"`
+	RedisNetwork  string   `mapstructure:"RedisNetwork"` // tcp or unix
+	RedisAddr     string   `mapstructure:"RedisAddr"`    // host:port, or /path/to/unix.sock
+	RedisAddrs    []string `mapstructure:"RedisAddrs"`   // Shard the users across these redis servers instead of RedisAddr
+	RedisUsername string   `mapstructure:"RedisUsername"`
+	RedisPassword string   `mapstructure:"RedisPassword"`
+	RedisDB       int      `mapstructure:"RedisDB"`
+	Timeout       int      `mapstructure:"Timeout"`
+	Expiry        int      `mapstructure:"Expiry"`      // second
+	PushWorkers   int      `mapstructure:"PushWorkers"` // Concurrent writes to the cache, 0 means 4
+}
+
+// GlobalCacheStats counts the lookups of the global device limit cache
+type GlobalCacheStats struct {
+	Hits   uint64 // Found in go-cache or redis
+	Misses uint64 // Not found in any store
+	Errors uint64 // Lookup or push failed
+}
+
+// RejectStats counts the rejected connections by reason
+type RejectStats struct {
+	Banned uint64 // Banned by the panel
+	Ratio  uint64 // Over the MaxUploadRatio of the user
+	Quota  uint64 // Over the TrafficQuota of the user
+	Device uint64 // Over the device limit on this node
+	Global uint64 // Over the global device limit
+	Conn   uint64 // Over the connection limit in conn mode
+}
+
+type rejectCounters struct {
+	banned atomic.Uint64
+	ratio  atomic.Uint64
+	quota  atomic.Uint64
+	device atomic.Uint64
+	global atomic.Uint64
+	conn   atomic.Uint64
+}
+
+type globalCacheStats struct {
+	hits   atomic.Uint64
+	misses atomic.Uint64
+	errors atomic.Uint64
+}
+
+type LimitConfig struct {
+	DeviceCountMode        string   `mapstructure:"DeviceCountMode"`        // ip or conn
+	DeviceLimitAction      string   `mapstructure:"DeviceLimitAction"`      // reject or throttle
+	ThrottleRate           uint64   `mapstructure:"ThrottleRate"`           // Byte/s, the speed of over-limit devices in throttle mode
+	TrackUDPDevices        bool     `mapstructure:"TrackUDPDevices"`        // Count UDP source IPs as devices too, only for ip mode
+	OnlineMode             string   `mapstructure:"OnlineMode"`             // traffic or conn
+	DeviceLimitCheckOrder  string   `mapstructure:"DeviceLimitCheckOrder"`  // local or global, which device limit is checked first
+	DisableSpeedLimit      bool     `mapstructure:"DisableSpeedLimit"`      // Never limit the speed on this inbound, the device limit still applies
+	IdleDeviceReplace      int      `mapstructure:"IdleDeviceReplace"`      // Second, a new IP over the device limit replaces an IP idle for longer
+	BurstRefillInterval    int      `mapstructure:"BurstRefillInterval"`    // Second, how often the burst credit of the users is refilled, 0 means never
+	SmoothingWindowMs      int      `mapstructure:"SmoothingWindowMs"`      // The speed limit bucket holds the bytes of this window, 0 means one second
+	SpeedLimitBypassUUIDs  []string `mapstructure:"SpeedLimitBypassUUIDs"`  // Users never speed limited, e.g. staff, the device limit still applies
+	DeviceLimitGraceCount  int      `mapstructure:"DeviceLimitGraceCount"`  // Over-limit connections of a user admitted per window before rejecting
+	DeviceLimitGraceWindow int      `mapstructure:"DeviceLimitGraceWindow"` // Second, 0 means 60
+	ExemptPrivateIPs       bool     `mapstructure:"ExemptPrivateIPs"`       // Private and loopback source IPs skip the device limits, e.g. a reverse proxy without PROXY protocol
+	MaxTrackedIPs          int      `mapstructure:"MaxTrackedIPs"`          // Online IPs tracked per user, 0 means unlimited
+	TrackedIPsOverflow     string   `mapstructure:"TrackedIPsOverflow"`     // reject or ignore, what a new IP over MaxTrackedIPs gets
+	TrackDeviceHours       bool     `mapstructure:"TrackDeviceHours"`       // Accumulate the device-hours of the users for the controller to report
 }
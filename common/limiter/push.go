@@ -0,0 +1,67 @@
+package limiter
+
+import (
+	"hash/crc32"
+	"sync"
+)
+
+const (
+	defaultPushWorkers = 4
+	pushQueueSize      = 256
+)
+
+type pushTask struct {
+	key   string
+	ipMap *map[string]int
+}
+
+// pushPool writes the devices to the global cache with a fixed number of workers. A key always goes to
+// the same worker, so the writes of a key keep their order.
+type pushPool struct {
+	queues []chan pushTask
+	stop   chan struct{}
+	once   sync.Once
+}
+
+func newPushPool(workers int, push func(key string, ipMap *map[string]int)) *pushPool {
+	if workers <= 0 {
+		workers = defaultPushWorkers
+	}
+	p := &pushPool{queues: make([]chan pushTask, workers), stop: make(chan struct{})}
+	for i := range p.queues {
+		queue := make(chan pushTask, pushQueueSize)
+		p.queues[i] = queue
+		go func() {
+			for {
+				select {
+				case task := <-queue:
+					push(task.key, task.ipMap)
+				case <-p.stop:
+					return
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// enqueue queues a write without blocking, it fails when the queue of the key is full or the pool is closed.
+func (p *pushPool) enqueue(key string, ipMap *map[string]int) bool {
+	queue := p.queues[crc32.ChecksumIEEE([]byte(key))%uint32(len(p.queues))]
+	select {
+	case <-p.stop:
+		return false
+	default:
+	}
+	select {
+	case queue <- pushTask{key: key, ipMap: ipMap}:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the workers, the queued writes are dropped
+func (p *pushPool) close() {
+	p.once.Do(func() { close(p.stop) })
+}
@@ -0,0 +1,69 @@
+package limiter
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushPoolBounded(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	var done sync.WaitGroup
+	pool := newPushPool(3, func(key string, ipMap *map[string]int) {
+		defer done.Done()
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+	})
+	t.Cleanup(pool.close)
+
+	// A burst of new devices
+	for i := 0; i < 200; i++ {
+		done.Add(1)
+		assert.True(t, pool.enqueue(fmt.Sprintf("key%d", i), &map[string]int{"1.1.1.1": i}))
+	}
+	done.Wait()
+	assert.LessOrEqual(t, maxInFlight.Load(), int32(3))
+}
+
+func TestPushPoolOrderPerKey(t *testing.T) {
+	var mu sync.Mutex
+	var done sync.WaitGroup
+	got := make(map[string][]int)
+	pool := newPushPool(4, func(key string, ipMap *map[string]int) {
+		defer done.Done()
+		mu.Lock()
+		got[key] = append(got[key], (*ipMap)["1.1.1.1"])
+		mu.Unlock()
+	})
+	t.Cleanup(pool.close)
+
+	for i := 0; i < 50; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			done.Add(1)
+			assert.True(t, pool.enqueue(key, &map[string]int{"1.1.1.1": i}))
+		}
+	}
+	done.Wait()
+	for _, key := range []string{"a", "b", "c"} {
+		assert.IsIncreasing(t, got[key])
+		assert.Len(t, got[key], 50)
+	}
+}
+
+func TestPushPoolClosed(t *testing.T) {
+	pool := newPushPool(1, func(key string, ipMap *map[string]int) {})
+	pool.close()
+	pool.close()
+	assert.False(t, pool.enqueue("a", &map[string]int{}))
+}
@@ -11,12 +11,15 @@ import (
 type Writer struct {
 	writer  buf.Writer
 	limiter *rate.Limiter
+	credit  *BurstCredit
 }
 
-func (l *Limiter) RateWriter(writer buf.Writer, limiter *rate.Limiter) buf.Writer {
+// RateWriter limits the writer to the bucket, the bytes covered by the burst credit pass without waiting. credit may be nil.
+func (l *Limiter) RateWriter(writer buf.Writer, limiter *rate.Limiter, credit *BurstCredit) buf.Writer {
 	return &Writer{
 		writer:  writer,
 		limiter: limiter,
+		credit:  credit,
 	}
 }
 
@@ -26,6 +29,19 @@ func (w *Writer) Close() error {
 
 func (w *Writer) WriteMultiBuffer(mb buf.MultiBuffer) error {
 	ctx := context.Background()
-	w.limiter.WaitN(ctx, int(mb.Len()))
+	n := int(mb.Len())
+	if w.credit != nil {
+		n -= int(w.credit.take(int64(n)))
+	}
+	if n == 0 {
+		return w.writer.WriteMultiBuffer(mb)
+	}
+	// WaitN fails for more than burst bytes, wait for them in chunks
+	if burst := w.limiter.Burst(); burst > 0 {
+		for ; n > burst; n -= burst {
+			w.limiter.WaitN(ctx, burst)
+		}
+	}
+	w.limiter.WaitN(ctx, n)
 	return w.writer.WriteMultiBuffer(mb)
 }
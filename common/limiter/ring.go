@@ -0,0 +1,108 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/eko/gocache/lib/v4/store"
+)
+
+const (
+	RingType         = "ring"
+	ringVirtualNodes = 160 // Virtual nodes of each store, spread the keys evenly
+)
+
+// hashRing maps a key to a node by consistent hashing, adding a node only moves the keys it takes over
+type hashRing struct {
+	hashes []uint32
+	nodes  map[uint32]string
+}
+
+func newHashRing(nodes ...string) *hashRing {
+	r := &hashRing{nodes: make(map[uint32]string)}
+	for _, node := range nodes {
+		for i := 0; i < ringVirtualNodes; i++ {
+			h := crc32.ChecksumIEEE([]byte(node + "#" + strconv.Itoa(i)))
+			r.hashes = append(r.hashes, h)
+			r.nodes[h] = node
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// get returns the node of the key, the first one clockwise on the ring
+func (r *hashRing) get(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.nodes[r.hashes[i]]
+}
+
+// ringStore shards the keys across several stores, each key always goes to the same store
+type ringStore struct {
+	ring   *hashRing
+	stores map[string]store.StoreInterface // Key: node name
+}
+
+func newRingStore(stores map[string]store.StoreInterface) *ringStore {
+	nodes := make([]string, 0, len(stores))
+	for node := range stores {
+		nodes = append(nodes, node)
+	}
+	return &ringStore{
+		ring:   newHashRing(nodes...),
+		stores: stores,
+	}
+}
+
+func (s *ringStore) storeOf(key any) store.StoreInterface {
+	return s.stores[s.ring.get(fmt.Sprint(key))]
+}
+
+func (s *ringStore) Get(ctx context.Context, key any) (any, error) {
+	return s.storeOf(key).Get(ctx, key)
+}
+
+func (s *ringStore) GetWithTTL(ctx context.Context, key any) (any, time.Duration, error) {
+	return s.storeOf(key).GetWithTTL(ctx, key)
+}
+
+func (s *ringStore) Set(ctx context.Context, key any, value any, options ...store.Option) error {
+	return s.storeOf(key).Set(ctx, key, value, options...)
+}
+
+func (s *ringStore) Delete(ctx context.Context, key any) error {
+	return s.storeOf(key).Delete(ctx, key)
+}
+
+func (s *ringStore) Invalidate(ctx context.Context, options ...store.InvalidateOption) error {
+	for _, st := range s.stores {
+		if err := st.Invalidate(ctx, options...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ringStore) Clear(ctx context.Context) error {
+	for _, st := range s.stores {
+		if err := st.Clear(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ringStore) GetType() string {
+	return RingType
+}
@@ -0,0 +1,73 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/eko/gocache/lib/v4/store"
+	goCacheStore "github.com/eko/gocache/store/go_cache/v4"
+	goCache "github.com/patrickmn/go-cache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashRingDistribution(t *testing.T) {
+	r := newHashRing("redis1:6379", "redis2:6379", "redis3:6379")
+
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		counts[r.get(fmt.Sprintf("2|user%d@v2board.user|%d", i, i))]++
+	}
+	assert.Len(t, counts, 3)
+	for node, count := range counts {
+		assert.Greater(t, count, 600, node)
+	}
+}
+
+func TestHashRingAddNode(t *testing.T) {
+	r := newHashRing("redis1:6379", "redis2:6379", "redis3:6379")
+	grown := newHashRing("redis1:6379", "redis2:6379", "redis3:6379", "redis4:6379")
+
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("2|user%d@v2board.user|%d", i, i)
+		// The same key always maps to the same node
+		assert.Equal(t, r.get(key), r.get(key))
+		if before, after := r.get(key), grown.get(key); before != after {
+			// Keys only move to the new node
+			assert.Equal(t, "redis4:6379", after)
+			moved++
+		}
+	}
+	assert.Less(t, moved, 3000*2/5)
+	assert.Greater(t, moved, 0)
+}
+
+func TestRingStore(t *testing.T) {
+	stores := make(map[string]store.StoreInterface)
+	for _, node := range []string{"a", "b", "c"} {
+		stores[node] = goCacheStore.NewGoCache(goCache.New(time.Minute, time.Minute))
+	}
+	s := newRingStore(stores)
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		assert.NoError(t, s.Set(ctx, fmt.Sprint("key", i), i))
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprint("key", i)
+		v, err := s.Get(ctx, key)
+		assert.NoError(t, err)
+		assert.Equal(t, i, v)
+		// The key only lives in its own store
+		for node, st := range stores {
+			_, err := st.Get(ctx, key)
+			assert.Equal(t, node == s.ring.get(key), err == nil)
+		}
+	}
+
+	assert.NoError(t, s.Clear(ctx))
+	_, err := s.Get(ctx, "key1")
+	assert.Error(t, err)
+}
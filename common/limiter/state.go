@@ -0,0 +1,76 @@
+package limiter
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// inboundState is the online state of an inbound kept across a restart
+type inboundState struct {
+	UserOnlineIP map[string]map[string]int `json:"user_online_ip"` // Key: Email, value: {Key: IP, value: UID}
+	OnlineDevice map[int]string            `json:"online_device"`  // Key: UID, value: IP
+	Otraffic     map[int]int64             `json:"otraffic"`       // Key: UID, value: traffic
+}
+
+// ExportState serializes the online devices of all inbounds, so a new process can pick them up with ImportState
+func (l *Limiter) ExportState() ([]byte, error) {
+	states := make(map[string]*inboundState)
+	l.InboundInfo.Range(func(key, value interface{}) bool {
+		inboundInfo := value.(*InboundInfo)
+		state := &inboundState{
+			UserOnlineIP: make(map[string]map[string]int),
+			OnlineDevice: make(map[int]string),
+			Otraffic:     make(map[int]int64),
+		}
+		inboundInfo.UserOnlineIP.Range(func(key, value interface{}) bool {
+			ips := make(map[string]int)
+			value.(*sync.Map).Range(func(ip, uid interface{}) bool {
+				ips[ip.(string)] = uid.(int)
+				return true
+			})
+			state.UserOnlineIP[key.(string)] = ips
+			return true
+		})
+		inboundInfo.OnlineDevice.Range(func(key, value interface{}) bool {
+			state.OnlineDevice[key.(int)] = value.(string)
+			return true
+		})
+		inboundInfo.Otraffic.Range(func(key, value interface{}) bool {
+			state.Otraffic[key.(int)] = value.(int64)
+			return true
+		})
+		states[key.(string)] = state
+		return true
+	})
+	return json.Marshal(states)
+}
+
+// ImportState loads the state from ExportState into the inbounds already added, the other inbounds are skipped
+func (l *Limiter) ImportState(data []byte) error {
+	states := make(map[string]*inboundState)
+	if err := json.Unmarshal(data, &states); err != nil {
+		return fmt.Errorf("invalid limiter state: %s", err)
+	}
+	for tag, state := range states {
+		value, ok := l.InboundInfo.Load(tag)
+		if !ok {
+			continue
+		}
+		inboundInfo := value.(*InboundInfo)
+		for email, ips := range state.UserOnlineIP {
+			ipMap := new(sync.Map)
+			for ip, uid := range ips {
+				ipMap.Store(ip, uid)
+			}
+			inboundInfo.UserOnlineIP.Store(email, ipMap)
+		}
+		for uid, ip := range state.OnlineDevice {
+			inboundInfo.OnlineDevice.Store(uid, ip)
+		}
+		for uid, traffic := range state.Otraffic {
+			inboundInfo.Otraffic.Store(uid, traffic)
+		}
+	}
+	return nil
+}
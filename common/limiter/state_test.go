@@ -0,0 +1,42 @@
+package limiter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestExportImportState(t *testing.T) {
+	u1 := api.UserInfo{UID: 1, Email: "a@test", DeviceLimit: 2}
+	u2 := api.UserInfo{UID: 2, Email: "b@test", DeviceLimit: 2}
+	l := newTestLimiter(t, nil, u1, u2)
+	l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	l.GetUserBucket(testTag, testEmail(u1), "2.2.2.2", true)
+	l.GetUserBucket(testTag, testEmail(u2), "3.3.3.3", true)
+	onlineUsers, _, err := l.GetOnlineDevice(testTag, map[int]int64{1: 2048, 2: 2048}, 1024)
+	assert.NoError(t, err)
+	assert.Len(t, *onlineUsers, 3)
+
+	data, err := l.ExportState()
+	assert.NoError(t, err)
+
+	// The new process adds the inbounds, then imports the state
+	restarted := newTestLimiter(t, nil, u1, u2)
+	assert.NoError(t, restarted.ImportState(data))
+	assert.Equal(t, 2, onlineDeviceCount(restarted, testEmail(u1)))
+	assert.Equal(t, 1, onlineDeviceCount(restarted, testEmail(u2)))
+
+	// The device count is stable, a third device of user 1 is still rejected
+	_, _, reject := restarted.GetUserBucket(testTag, testEmail(u1), "4.4.4.4", true)
+	assert.True(t, reject)
+
+	// The traffic baseline is kept, user 2 used nothing since and goes offline
+	onlineUsers, _, err = restarted.GetOnlineDevice(testTag, map[int]int64{1: 4096, 2: 2048}, 1024)
+	assert.NoError(t, err)
+	assert.Len(t, *onlineUsers, 3)
+	assert.Equal(t, 0, onlineDeviceCount(restarted, testEmail(u2)))
+
+	assert.Error(t, restarted.ImportState([]byte("not json")))
+}
@@ -0,0 +1,161 @@
+package limiter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// userUsage is the traffic of a user in the current billing period
+type userUsage struct {
+	sync.Mutex
+	used       int64
+	lastUpdate time.Time
+}
+
+// lastResetTime returns the latest reset of the period before t, on the given day of month.
+// The day falls back to the last day of shorter months.
+func lastResetTime(day int, t time.Time) time.Time {
+	resetIn := func(year int, month time.Month) time.Time {
+		lastDay := time.Date(year, month+1, 0, 0, 0, 0, 0, t.Location()).Day()
+		return time.Date(year, month, min(day, lastDay), 0, 0, 0, 0, t.Location())
+	}
+	reset := resetIn(t.Year(), t.Month())
+	if reset.After(t) {
+		reset = resetIn(t.Year(), t.Month()-1)
+	}
+	return reset
+}
+
+// add counts n bytes, the usage of a previous period is dropped first
+func (u *userUsage) add(n int64, resetDay int) int64 {
+	u.Lock()
+	defer u.Unlock()
+	t := now()
+	if resetDay > 0 && u.lastUpdate.Before(lastResetTime(resetDay, t)) {
+		u.used = 0
+	}
+	u.used += n
+	u.lastUpdate = t
+	return u.used
+}
+
+// AddUserUsage counts the traffic of the user in the current period and returns the total,
+// the period starts on the ResetDay of the user
+func (l *Limiter) AddUserUsage(tag string, email string, n int64) int64 {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return 0
+	}
+	inboundInfo := value.(*InboundInfo)
+	resetDay := 0
+	if v, ok := inboundInfo.UserInfo.Load(email); ok {
+		resetDay = v.(UserInfo).ResetDay
+	}
+	u, _ := inboundInfo.Usage.LoadOrStore(email, new(userUsage))
+	return u.(*userUsage).add(n, resetDay)
+}
+
+// GetUserUsage returns the traffic of the user in the current period
+func (l *Limiter) GetUserUsage(tag string, email string) int64 {
+	return l.AddUserUsage(tag, email, 0)
+}
+
+// overTrafficQuota reports whether the user used up the TrafficQuota of the current period
+func overTrafficQuota(inboundInfo *InboundInfo, email string, u UserInfo) bool {
+	v, ok := inboundInfo.Usage.Load(email)
+	if !ok {
+		return false
+	}
+	return v.(*userUsage).add(0, u.ResetDay) >= u.TrafficQuota
+}
+
+// deviceUsage accumulates the minutes each user had each of their devices online
+type deviceUsage struct {
+	sync.Mutex
+	lastSample time.Time
+	minutes    map[int]float64 // Key: UID, value: device-minutes
+}
+
+func newDeviceUsage() *deviceUsage {
+	return &deviceUsage{lastSample: now(), minutes: make(map[int]float64)}
+}
+
+// sampleDeviceMinutes adds the devices online since the last report, each counted for the whole interval.
+// Nothing is sampled without TrackDeviceHours.
+func sampleDeviceMinutes(inboundInfo *InboundInfo) {
+	usage := inboundInfo.deviceUsage
+	usage.Lock()
+	defer usage.Unlock()
+	t := now()
+	elapsed := t.Sub(usage.lastSample).Minutes()
+	usage.lastSample = t
+	if !inboundInfo.config.TrackDeviceHours {
+		return
+	}
+	inboundInfo.UserOnlineIP.Range(func(key, value interface{}) bool {
+		value.(*sync.Map).Range(func(key, value interface{}) bool {
+			// Skip the IPs not in the alive IPs of the panel
+			if a, ok := inboundInfo.ipAllowedMap.Load(key); ok && a.(int) == 2 {
+				return true
+			}
+			usage.minutes[value.(int)] += elapsed
+			return true
+		})
+		return true
+	})
+}
+
+// DeviceHours returns the device-hours of each user by UID accumulated over the reports since the last call
+func (l *Limiter) DeviceHours(tag string) (map[int]float64, error) {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return nil, fmt.Errorf("no such inbound in limiter: %s", tag)
+	}
+	usage := value.(*InboundInfo).deviceUsage
+	usage.Lock()
+	defer usage.Unlock()
+	hours := make(map[int]float64, len(usage.minutes))
+	for uid, minutes := range usage.minutes {
+		hours[uid] = minutes / 60
+	}
+	usage.minutes = make(map[int]float64)
+	return hours, nil
+}
+
+// trafficRatio is the traffic of a user since the limiter started
+type trafficRatio struct {
+	sync.Mutex
+	upload   int64
+	download int64
+}
+
+// AddUserTraffic counts the reported upload and download of the user for MaxUploadRatio
+func (l *Limiter) AddUserTraffic(tag string, email string, upload int64, download int64) {
+	value, ok := l.InboundInfo.Load(tag)
+	if !ok {
+		return
+	}
+	v, _ := value.(*InboundInfo).ratio.LoadOrStore(email, new(trafficRatio))
+	r := v.(*trafficRatio)
+	r.Lock()
+	defer r.Unlock()
+	r.upload += upload
+	r.download += download
+}
+
+// overUploadRatio reports whether the user uploaded more than maxRatio times their download.
+// Users with less than minRatioTraffic in total are not judged yet.
+func overUploadRatio(inboundInfo *InboundInfo, email string, maxRatio float64) bool {
+	v, ok := inboundInfo.ratio.Load(email)
+	if !ok {
+		return false
+	}
+	r := v.(*trafficRatio)
+	r.Lock()
+	defer r.Unlock()
+	if r.upload+r.download < minRatioTraffic {
+		return false
+	}
+	return float64(r.upload) > maxRatio*float64(r.download)
+}
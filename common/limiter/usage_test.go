@@ -0,0 +1,168 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/XrayR-project/XrayR/api"
+)
+
+func TestLastResetTime(t *testing.T) {
+	testCases := []struct {
+		day  int
+		t    string
+		want string
+	}{
+		{1, "2024-03-15T10:00:00Z", "2024-03-01T00:00:00Z"},
+		{20, "2024-03-15T10:00:00Z", "2024-02-20T00:00:00Z"},
+		{15, "2024-03-15T00:00:00Z", "2024-03-15T00:00:00Z"},
+		{31, "2024-03-15T10:00:00Z", "2024-02-29T00:00:00Z"},
+		{31, "2024-04-30T10:00:00Z", "2024-04-30T00:00:00Z"},
+		{10, "2024-01-05T10:00:00Z", "2023-12-10T00:00:00Z"},
+	}
+	for _, c := range testCases {
+		at, _ := time.Parse(time.RFC3339, c.t)
+		want, _ := time.Parse(time.RFC3339, c.want)
+		assert.Equal(t, want, lastResetTime(c.day, at), "day %d at %s", c.day, c.t)
+	}
+}
+
+func TestUserUsageResetDay(t *testing.T) {
+	clock := time.Date(2024, 3, 8, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = time.Now })
+
+	u1 := api.UserInfo{UID: 1, Email: "a@test", ResetDay: 10}
+	u2 := api.UserInfo{UID: 2, Email: "b@test", ResetDay: 20}
+	u3 := api.UserInfo{UID: 3, Email: "c@test"}
+	l := newTestLimiter(t, nil, u1, u2, u3)
+	for _, u := range []api.UserInfo{u1, u2, u3} {
+		assert.Equal(t, int64(100), l.AddUserUsage(testTag, testEmail(u), 100))
+	}
+
+	// User 1 resets on the 10th
+	clock = time.Date(2024, 3, 10, 0, 0, 1, 0, time.UTC)
+	assert.Equal(t, int64(50), l.AddUserUsage(testTag, testEmail(u1), 50))
+	assert.Equal(t, int64(150), l.AddUserUsage(testTag, testEmail(u2), 50))
+	assert.Equal(t, int64(150), l.AddUserUsage(testTag, testEmail(u3), 50))
+
+	// User 2 resets on the 20th
+	clock = time.Date(2024, 3, 21, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, int64(50), l.GetUserUsage(testTag, testEmail(u1)))
+	assert.Zero(t, l.GetUserUsage(testTag, testEmail(u2)))
+	assert.Equal(t, int64(150), l.GetUserUsage(testTag, testEmail(u3)))
+
+	// Both reset in the next month, user 3 never does
+	clock = time.Date(2024, 4, 25, 0, 0, 0, 0, time.UTC)
+	assert.Zero(t, l.GetUserUsage(testTag, testEmail(u1)))
+	assert.Zero(t, l.GetUserUsage(testTag, testEmail(u2)))
+	assert.Equal(t, int64(150), l.GetUserUsage(testTag, testEmail(u3)))
+	assert.Zero(t, l.GetUserUsage("no_such_tag", testEmail(u1)))
+}
+
+func TestTrafficQuota(t *testing.T) {
+	clock := time.Date(2024, 3, 8, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = time.Now })
+
+	u1 := api.UserInfo{UID: 1, Email: "a@test", ResetDay: 10, TrafficQuota: 1000}
+	u2 := api.UserInfo{UID: 2, Email: "b@test"}
+	l := newTestLimiter(t, nil, u1, u2)
+
+	l.AddUserUsage(testTag, testEmail(u1), 999)
+	_, _, reject := l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	assert.False(t, reject)
+
+	// The quota is used up
+	l.AddUserUsage(testTag, testEmail(u1), 1)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	assert.True(t, reject)
+	stats, _ := l.RejectStats(testTag)
+	assert.Equal(t, uint64(1), stats.Quota)
+
+	// Users without a quota are never rejected
+	l.AddUserUsage(testTag, testEmail(u2), 1<<40)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u2), "2.2.2.2", true)
+	assert.False(t, reject)
+
+	// The traffic resets on the 10th
+	clock = time.Date(2024, 3, 10, 0, 0, 1, 0, time.UTC)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	assert.False(t, reject)
+}
+
+func TestDeviceHours(t *testing.T) {
+	clock := time.Date(2024, 3, 8, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = time.Now })
+
+	u1 := api.UserInfo{UID: 1, Email: "a@test"}
+	u2 := api.UserInfo{UID: 2, Email: "b@test"}
+	l := newTestLimiter(t, &LimitConfig{TrackDeviceHours: true}, u1, u2)
+	l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	l.GetUserBucket(testTag, testEmail(u1), "2.2.2.2", true)
+	l.GetUserBucket(testTag, testEmail(u2), "3.3.3.3", true)
+
+	// Two reports, 10 and 20 minutes apart
+	clock = clock.Add(10 * time.Minute)
+	_, _, err := l.GetOnlineDevice(testTag, map[int]int64{1: 100, 2: 100}, 0)
+	assert.NoError(t, err)
+	clock = clock.Add(20 * time.Minute)
+	_, _, err = l.GetOnlineDevice(testTag, map[int]int64{1: 200, 2: 100}, 0)
+	assert.NoError(t, err)
+
+	hours, err := l.DeviceHours(testTag)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]float64{1: 1, 2: 0.5}, hours)
+
+	// User 2 went offline in the last report
+	clock = clock.Add(30 * time.Minute)
+	_, _, err = l.GetOnlineDevice(testTag, map[int]int64{1: 300, 2: 100}, 0)
+	assert.NoError(t, err)
+	hours, err = l.DeviceHours(testTag)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]float64{1: 1}, hours)
+
+	_, err = l.DeviceHours("no_such_tag")
+	assert.Error(t, err)
+
+	// Not tracked by default
+	l = newTestLimiter(t, nil, u1)
+	l.GetUserBucket(testTag, testEmail(u1), "1.1.1.1", true)
+	clock = clock.Add(10 * time.Minute)
+	_, _, err = l.GetOnlineDevice(testTag, map[int]int64{1: 100}, 0)
+	assert.NoError(t, err)
+	hours, err = l.DeviceHours(testTag)
+	assert.NoError(t, err)
+	assert.Empty(t, hours)
+}
+
+func TestMaxUploadRatio(t *testing.T) {
+	seeder := api.UserInfo{UID: 1, Email: "a@test", MaxUploadRatio: 2}
+	u := api.UserInfo{UID: 2, Email: "b@test"}
+	l := newTestLimiter(t, nil, seeder, u)
+
+	// Not judged below the minimum traffic
+	l.AddUserTraffic(testTag, testEmail(seeder), 1024, 0)
+	_, _, reject := l.GetUserBucket(testTag, testEmail(seeder), "1.1.1.1", true)
+	assert.False(t, reject)
+
+	// 30 MB up, 10 MB down
+	l.AddUserTraffic(testTag, testEmail(seeder), 30*1024*1024-1024, 10*1024*1024)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(seeder), "1.1.1.1", true)
+	assert.True(t, reject)
+	stats, _ := l.RejectStats(testTag)
+	assert.Equal(t, uint64(1), stats.Ratio)
+
+	// Users without a ratio are never judged
+	l.AddUserTraffic(testTag, testEmail(u), 30*1024*1024, 0)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(u), "2.2.2.2", true)
+	assert.False(t, reject)
+
+	// The downloads catch up
+	l.AddUserTraffic(testTag, testEmail(seeder), 0, 5*1024*1024)
+	_, _, reject = l.GetUserBucket(testTag, testEmail(seeder), "1.1.1.1", true)
+	assert.False(t, reject)
+}
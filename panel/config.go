@@ -6,13 +6,16 @@ import (
 )
 
 type Config struct {
-	LogConfig          *LogConfig        `mapstructure:"Log"`
-	DnsConfigPath      string            `mapstructure:"DnsConfigPath"`
-	InboundConfigPath  string            `mapstructure:"InboundConfigPath"`
-	OutboundConfigPath string            `mapstructure:"OutboundConfigPath"`
-	RouteConfigPath    string            `mapstructure:"RouteConfigPath"`
-	ConnectionConfig   *ConnectionConfig `mapstructure:"ConnectionConfig"`
-	NodesConfig        []*NodesConfig    `mapstructure:"Nodes"`
+	LogConfig             *LogConfig        `mapstructure:"Log"`
+	DnsConfigPath         string            `mapstructure:"DnsConfigPath"`
+	InboundConfigPath     string            `mapstructure:"InboundConfigPath"`
+	OutboundConfigPath    string            `mapstructure:"OutboundConfigPath"`
+	RouteConfigPath       string            `mapstructure:"RouteConfigPath"`
+	ConnectionConfig      *ConnectionConfig `mapstructure:"ConnectionConfig"`
+	MaxConcurrentRequests int               `mapstructure:"MaxConcurrentRequests"`
+	DebugServerAddr       string            `mapstructure:"DebugServerAddr"` // Serve /healthz and /stats of the limiter, empty means disable
+	EnableMetrics         bool              `mapstructure:"EnableMetrics"`   // Serve the Prometheus metrics of the panel requests on /metrics of the debug server
+	NodesConfig           []*NodesConfig    `mapstructure:"Nodes"`
 }
 
 type NodesConfig struct {
@@ -2,6 +2,7 @@ package panel
 
 import (
 	"encoding/json"
+	"net/http"
 	"os"
 	"sync"
 
@@ -12,6 +13,7 @@ import (
 	"github.com/xtls/xray-core/app/stats"
 	"github.com/xtls/xray-core/common/serial"
 	"github.com/xtls/xray-core/core"
+	"github.com/xtls/xray-core/features/routing"
 	"github.com/xtls/xray-core/infra/conf"
 
 	"github.com/XrayR-project/XrayR/api"
@@ -29,6 +31,7 @@ type Panel struct {
 	Server      *core.Instance
 	Service     []service.Service
 	Running     bool
+	debugServer *http.Server
 }
 
 func New(panelConfig *Config) *Panel {
@@ -164,6 +167,23 @@ func (p *Panel) Start() {
 	}
 	p.Server = server
 
+	if p.panelConfig.DebugServerAddr != "" {
+		dispatcher := server.GetFeature(routing.DispatcherType()).(*mydispatcher.DefaultDispatcher)
+		var metrics http.Handler
+		if p.panelConfig.EnableMetrics {
+			metrics = newV2board.MetricsHandler()
+		}
+		debugServer, err := dispatcher.Limiter.StartDebugServer(p.panelConfig.DebugServerAddr, metrics)
+		if err != nil {
+			log.Panicf("Failed to start debug server: %s", err)
+		}
+		p.debugServer = debugServer
+	}
+
+	// Share the cap on panel requests between all nodes
+	newV2board.SetMaxConcurrentRequests(p.panelConfig.MaxConcurrentRequests)
+	// The metrics are only served by the debug server
+	newV2board.SetMetricsEnabled(p.panelConfig.EnableMetrics && p.panelConfig.DebugServerAddr != "")
 	// Load Nodes config
 	for _, nodeConfig := range p.panelConfig.NodesConfig {
 		var apiClient api.API
@@ -207,6 +227,10 @@ func (p *Panel) Close() {
 		}
 	}
 	p.Service = nil
+	if p.debugServer != nil {
+		p.debugServer.Close()
+		p.debugServer = nil
+	}
 	p.Server.Close()
 	p.Running = false
 }
@@ -21,6 +21,7 @@ type Config struct {
 	DisableSniffing           bool                             `mapstructure:"DisableSniffing"`
 	AutoSpeedLimitConfig      *AutoSpeedLimitConfig            `mapstructure:"AutoSpeedLimitConfig"`
 	GlobalDeviceLimitConfig   *limiter.GlobalDeviceLimitConfig `mapstructure:"GlobalDeviceLimitConfig"`
+	LimitConfig               *limiter.LimitConfig             `mapstructure:"LimitConfig"`
 	FallBackConfigs           []*FallBackConfig                `mapstructure:"FallBackConfigs"`
 	DisableLocalREALITYConfig bool                             `mapstructure:"DisableLocalREALITYConfig"`
 	EnableREALITY             bool                             `mapstructure:"EnableREALITY"`
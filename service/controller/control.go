@@ -3,6 +3,8 @@ package controller
 import (
 	"context"
 	"fmt"
+	"maps"
+	"slices"
 
 	"github.com/xtls/xray-core/common/protocol"
 	"github.com/xtls/xray-core/core"
@@ -132,8 +134,13 @@ func (c *Controller) resetTraffic(upCounterList *[]stats.Counter, downCounterLis
 	}
 }
 
-func (c *Controller) AddInboundLimiter(tag string, nodeSpeedLimit uint64, userList *[]api.UserInfo, globalDeviceLimitConfig *limiter.GlobalDeviceLimitConfig) error {
-	err := c.dispatcher.Limiter.AddInboundLimiter(tag, nodeSpeedLimit, userList, globalDeviceLimitConfig)
+func (c *Controller) AddInboundLimiter(tag string, nodeSpeedLimit uint64, userList *[]api.UserInfo, globalDeviceLimitConfig *limiter.GlobalDeviceLimitConfig, limitConfig *limiter.LimitConfig) error {
+	err := c.dispatcher.Limiter.AddInboundLimiter(tag, nodeSpeedLimit, userList, globalDeviceLimitConfig, limitConfig)
+	return err
+}
+
+func (c *Controller) ReloadInboundLimiter(tag string, nodeSpeedLimit uint64, userList *[]api.UserInfo, globalDeviceLimitConfig *limiter.GlobalDeviceLimitConfig, limitConfig *limiter.LimitConfig) error {
+	err := c.dispatcher.Limiter.ReloadInboundLimiter(tag, nodeSpeedLimit, userList, globalDeviceLimitConfig, limitConfig)
 	return err
 }
 
@@ -142,11 +149,24 @@ func (c *Controller) UpdateInboundLimiter(tag string, updatedUserList *[]api.Use
 	return err
 }
 
+func (c *Controller) SetBannedUsers(tag string, bannedList *[]int) error {
+	err := c.dispatcher.Limiter.SetBannedUsers(tag, bannedList)
+	return err
+}
+
 func (c *Controller) DeleteInboundLimiter(tag string) error {
 	err := c.dispatcher.Limiter.DeleteInboundLimiter(tag)
 	return err
 }
 
+func (c *Controller) AddUserUsage(tag string, email string, n int64) int64 {
+	return c.dispatcher.Limiter.AddUserUsage(tag, email, n)
+}
+
+func (c *Controller) AddUserTraffic(tag string, email string, upload int64, download int64) {
+	c.dispatcher.Limiter.AddUserTraffic(tag, email, upload, download)
+}
+
 func (c *Controller) ResetOtraffic(tag string) error {
 	err := c.dispatcher.Limiter.ResetOtraffic(tag)
 	return err
@@ -156,6 +176,19 @@ func (c *Controller) GetOnlineDevice(tag string, userTraffic map[int]int64, T in
 	return c.dispatcher.Limiter.GetOnlineDevice(tag, userTraffic, T)
 }
 
+// GetDeviceHours returns the device-hours of the users since the last call, sorted by UID
+func (c *Controller) GetDeviceHours(tag string) (*[]api.DeviceHours, error) {
+	hours, err := c.dispatcher.Limiter.DeviceHours(tag)
+	if err != nil {
+		return nil, err
+	}
+	deviceHours := make([]api.DeviceHours, 0, len(hours))
+	for _, uid := range slices.Sorted(maps.Keys(hours)) {
+		deviceHours = append(deviceHours, api.DeviceHours{UID: uid, Hours: hours[uid]})
+	}
+	return &deviceHours, nil
+}
+
 func (c *Controller) UpdateRule(tag string, newRuleList []api.DetectRule) error {
 	err := c.dispatcher.RuleManager.UpdateRule(tag, newRuleList)
 	return err
@@ -3,6 +3,7 @@ package controller
 import (
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
 	"time"
 
@@ -28,25 +29,27 @@ type LimitInfo struct {
 }
 
 type Controller struct {
-	server       *core.Instance
-	config       *Config
-	clientInfo   api.ClientInfo
-	apiClient    api.API
-	nodeInfo     *api.NodeInfo
-	Tag          string
-	userList     *[]api.UserInfo
-	tasks        []periodicTask
-	limitedUsers map[api.UserInfo]LimitInfo
-	warnedUsers  map[api.UserInfo]int
-	panelType    string
-	ibm          inbound.Manager
-	obm          outbound.Manager
-	stm          stats.Manager
-	dispatcher   *mydispatcher.DefaultDispatcher
-	startAt      time.Time
-	logger       *log.Entry
-	nextsend     time.Time
-	newpush      int
+	server        *core.Instance
+	config        *Config
+	clientInfo    api.ClientInfo
+	apiClient     api.API
+	nodeInfo      *api.NodeInfo
+	Tag           string
+	userList      *[]api.UserInfo
+	bannedList    *[]int
+	tasks         []periodicTask
+	limitedUsers  map[api.UserInfo]LimitInfo
+	warnedUsers   map[api.UserInfo]int
+	panelType     string
+	ibm           inbound.Manager
+	obm           outbound.Manager
+	stm           stats.Manager
+	dispatcher    *mydispatcher.DefaultDispatcher
+	startAt       time.Time
+	logger        *log.Entry
+	nextsend      time.Time
+	newpush       int
+	misconfigured string // The last invalid node config error, logged once until it changes
 }
 
 type periodicTask struct {
@@ -87,10 +90,14 @@ func (c *Controller) Start() error {
 		return err
 	}
 	if newNodeInfo.Port == 0 {
-		return errors.New("server port must > 0")
+		return invalidPort(newNodeInfo)
 	}
 	c.nodeInfo = newNodeInfo
 	c.Tag = c.buildNodeTag()
+	// Name the node in logs when the panel sends a name
+	if newNodeInfo.Name != "" {
+		c.logger = c.logger.WithFields(log.Fields{"Name": newNodeInfo.Name, "Region": newNodeInfo.Region})
+	}
 
 	// Add new tag
 	err = c.addNewTag(newNodeInfo)
@@ -113,9 +120,10 @@ func (c *Controller) Start() error {
 	}
 
 	// Add Limiter
-	if err := c.AddInboundLimiter(c.Tag, newNodeInfo.SpeedLimit, userInfo, c.config.GlobalDeviceLimitConfig); err != nil {
+	if err := c.AddInboundLimiter(c.Tag, newNodeInfo.SpeedLimit, userInfo, c.config.GlobalDeviceLimitConfig, c.config.LimitConfig); err != nil {
 		c.logger.Print(err)
 	}
+	c.updateBannedUsers()
 
 	// Add Rule Manager
 	if !c.config.DisableGetRule {
@@ -182,11 +190,17 @@ func (c *Controller) Start() error {
 		go c.tasks[i].Start()
 	}
 
+	if err := c.apiClient.ReportNodeOnline(); err != nil {
+		c.logger.Print(err)
+	}
 	return nil
 }
 
 // Close implement the Close() function of the service interface
 func (c *Controller) Close() error {
+	if err := c.apiClient.ReportNodeOffline(); err != nil {
+		c.logger.Print(err)
+	}
 	for i := range c.tasks {
 		if c.tasks[i].Periodic != nil {
 			if err := c.tasks[i].Periodic.Close(); err != nil {
@@ -194,10 +208,32 @@ func (c *Controller) Close() error {
 			}
 		}
 	}
+	// Stop what the api client runs in the background, like the rule list watcher
+	if closer, ok := c.apiClient.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			c.logger.Print(err)
+		}
+	}
 
 	return nil
 }
 
+// invalidPort is the error of a node without a port
+func invalidPort(nodeInfo *api.NodeInfo) error {
+	err := &api.NodeConfigError{NodeType: nodeInfo.NodeType}
+	err.Add("server_port", "server_port must > 0")
+	return err
+}
+
+// reportMisconfigured logs a node config the panel must fix, the current node keeps running meanwhile
+func (c *Controller) reportMisconfigured(err error) {
+	if err.Error() == c.misconfigured {
+		return
+	}
+	c.misconfigured = err.Error()
+	c.logger.Errorf("Panel misconfigured, keep the current node until it is fixed: %s", err)
+}
+
 func (c *Controller) nodeInfoMonitor() (err error) {
 	// delay to start
 	if time.Since(c.startAt) < time.Duration(api.PullInterval)*time.Second {
@@ -210,14 +246,19 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 		if err.Error() == api.NodeNotModified {
 			nodeInfoChanged = false
 			newNodeInfo = c.nodeInfo
+		} else if errors.Is(err, api.ErrInvalidNodeConfig) {
+			c.reportMisconfigured(err)
+			return nil
 		} else {
 			c.logger.Print(err)
 			return nil
 		}
 	}
 	if newNodeInfo.Port == 0 {
-		return errors.New("server port must > 0")
+		c.reportMisconfigured(invalidPort(newNodeInfo))
+		return nil
 	}
+	c.misconfigured = ""
 
 	// Update User
 	var usersChanged = true
@@ -258,10 +299,12 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 				return nil
 			}
 			nodeInfoChanged = true
-			// Remove Old limiter
-			if err = c.DeleteInboundLimiter(oldTag); err != nil {
-				c.logger.Print(err)
-				return nil
+			// Remove Old limiter, the limiter of an unchanged tag is reloaded in place
+			if oldTag != c.Tag {
+				if err = c.DeleteInboundLimiter(oldTag); err != nil {
+					c.logger.Print(err)
+					return nil
+				}
 			}
 		} else {
 			nodeInfoChanged = false
@@ -288,8 +331,8 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 			return nil
 		}
 
-		// Add Limiter
-		if err := c.AddInboundLimiter(c.Tag, newNodeInfo.SpeedLimit, newUserInfo, c.config.GlobalDeviceLimitConfig); err != nil {
+		// Add Limiter, keeping the buckets and online devices of the current session
+		if err := c.ReloadInboundLimiter(c.Tag, newNodeInfo.SpeedLimit, newUserInfo, c.config.GlobalDeviceLimitConfig, c.config.LimitConfig); err != nil {
 			c.logger.Print(err)
 			return nil
 		}
@@ -322,9 +365,28 @@ func (c *Controller) nodeInfoMonitor() (err error) {
 		c.logger.Printf("%d user deleted, %d user added", len(deleted), len(added))
 	}
 	c.userList = newUserInfo
+	c.updateBannedUsers()
 	return nil
 }
 
+// updateBannedUsers pulls the banned users and applies them to the limiter
+func (c *Controller) updateBannedUsers() {
+	bannedList, err := c.apiClient.GetBannedUsers()
+	if err != nil {
+		if err.Error() != api.BannedNotModified {
+			c.logger.Print(err)
+		}
+		bannedList = c.bannedList
+	}
+	if bannedList == nil {
+		return
+	}
+	c.bannedList = bannedList
+	if err := c.SetBannedUsers(c.Tag, bannedList); err != nil {
+		c.logger.Print(err)
+	}
+}
+
 func (c *Controller) removeOldTag(oldTag string) (err error) {
 	err = c.removeInbound(oldTag)
 	if err != nil {
@@ -595,6 +657,11 @@ func (c *Controller) userInfoMonitor() (err error) {
 		} else {
 			c.resetTraffic(&upCounterList, &downCounterList)
 			c.ResetOtraffic(c.Tag)
+			for _, traffic := range userTraffic {
+				email := c.buildUserTag(&api.UserInfo{UID: traffic.UID, Email: traffic.Email})
+				c.AddUserUsage(c.Tag, email, traffic.Upload+traffic.Download)
+				c.AddUserTraffic(c.Tag, email, traffic.Upload, traffic.Download)
+			}
 		}
 	}
 
@@ -609,6 +676,15 @@ func (c *Controller) userInfoMonitor() (err error) {
 		}
 
 	}
+
+	// Report the device-hours
+	if c.config.LimitConfig != nil && c.config.LimitConfig.TrackDeviceHours {
+		if deviceHours, err := c.GetDeviceHours(c.Tag); err != nil {
+			c.logger.Print(err)
+		} else if err = c.apiClient.ReportDeviceHours(deviceHours); err != nil {
+			c.logger.Print(err)
+		}
+	}
 	return nil
 }
 
@@ -21,6 +21,11 @@ import (
 
 // InboundBuilder build Inbound config for different protocol
 func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.InboundHandlerConfig, error) {
+	// The panel client parses these, but the xray-core XrayR is built with has no inbound for them
+	switch nodeInfo.NodeType {
+	case "Hysteria2", "TUIC":
+		return nil, fmt.Errorf("node type %s is parsed from the panel but not runnable on this xray-core, it has no %s inbound", nodeInfo.NodeType, nodeInfo.NodeType)
+	}
 	inboundDetourConfig := &conf.InboundDetourConfig{}
 	// Build Listen IP address
 	if nodeInfo.NodeType == "Shadowsocks-Plugin" {
@@ -82,9 +87,13 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.I
 		}
 	case "Trojan":
 		protocol = "trojan"
-		// Enable fallback
-		if config.EnableFallback {
-			fallbackConfigs, err := buildTrojanFallbacks(config.FallBackConfigs)
+		// Enable fallback, local settings replace the panel ones
+		if config.EnableFallback || len(nodeInfo.Fallbacks) > 0 {
+			fallbacks := config.FallBackConfigs
+			if !config.EnableFallback {
+				fallbacks = panelFallbacks(nodeInfo.Fallbacks)
+			}
+			fallbackConfigs, err := buildTrojanFallbacks(fallbacks)
 			if err == nil {
 				proxySetting = &conf.TrojanServerConfig{
 					Fallbacks: fallbackConfigs,
@@ -134,7 +143,7 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.I
 			NetworkList: []string{"tcp", "udp"},
 		}
 	default:
-		return nil, fmt.Errorf("unsupported node type: %s, Only support: V2ray, Trojan, Shadowsocks, and Shadowsocks-Plugin", nodeInfo.NodeType)
+		return nil, fmt.Errorf("unsupported node type: %s, Only support: V2ray, Vmess, Vless, Trojan, Shadowsocks, and Shadowsocks-Plugin", nodeInfo.NodeType)
 	}
 
 	setting, err := json.Marshal(proxySetting)
@@ -189,6 +198,8 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.I
 			Host: nodeInfo.Host,
 		}
 		streamSetting.SplitHTTPSettings = splithttpSetting
+	case "mkcp":
+		streamSetting.KCPSettings = buildKCPConfig(nodeInfo.TransportTuning)
 	}
 	streamSetting.Network = &transportProtocol
 
@@ -211,6 +222,10 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.I
 				MaxTimeDiff:  r.MaxTimeDiff,
 				ShortIds:     r.ShortIds,
 			}
+			// The bundled xray-core predates the post-quantum settings, REALITY without them would not be what the panel asked for
+			if r.Mldsa65Seed != "" || r.Mldsa65Verify != "" {
+				return nil, fmt.Errorf("REALITY mldsa65_seed and mldsa65_verify of node %d are not supported by this xray-core, remove them from the panel", nodeInfo.NodeID)
+			}
 		}
 	} else if config.EnableREALITY && config.REALITYConfigs != nil {
 		isREALITY = true
@@ -244,6 +259,12 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.I
 		}
 		tlsSettings := &conf.TLSConfig{
 			RejectUnknownSNI: config.CertConfig.RejectUnknownSni,
+			MinVersion:       nodeInfo.MinTLSVersion,
+			MaxVersion:       nodeInfo.MaxTLSVersion,
+		}
+		if len(nodeInfo.Alpn) > 0 {
+			alpn := conf.StringList(nodeInfo.Alpn)
+			tlsSettings.ALPN = &alpn
 		}
 		tlsSettings.Certs = append(tlsSettings.Certs, &conf.TLSCertConfig{CertFile: certFile, KeyFile: keyFile, OcspStapling: 3600})
 		streamSetting.TLSSettings = tlsSettings
@@ -256,11 +277,44 @@ func InboundBuilder(config *Config, nodeInfo *api.NodeInfo, tag string) (*core.I
 		}
 		streamSetting.SocketSettings = sockoptConfig
 	}
+	if t := nodeInfo.TransportTuning; t != nil && t.TCPWindowClamp > 0 {
+		if streamSetting.SocketSettings == nil {
+			streamSetting.SocketSettings = new(conf.SocketConfig)
+		}
+		streamSetting.SocketSettings.TCPWindowClamp = t.TCPWindowClamp
+	}
+	if nodeInfo.TCPFastOpen != nil {
+		if streamSetting.SocketSettings == nil {
+			streamSetting.SocketSettings = new(conf.SocketConfig)
+		}
+		streamSetting.SocketSettings.TFO = nodeInfo.TCPFastOpen
+	}
 	inboundDetourConfig.StreamSetting = streamSetting
 
 	return inboundDetourConfig.Build()
 }
 
+// buildKCPConfig applies the tuning from the panel, the unset values keep the xray defaults
+func buildKCPConfig(t *api.TransportTuning) *conf.KCPConfig {
+	kcpSetting := new(conf.KCPConfig)
+	if t == nil {
+		return kcpSetting
+	}
+	set := func(value uint32) *uint32 {
+		if value == 0 {
+			return nil
+		}
+		return &value
+	}
+	kcpSetting.Mtu = set(t.KCPMtu)
+	kcpSetting.Tti = set(t.KCPTti)
+	kcpSetting.UpCap = set(t.KCPUplinkCapacity)
+	kcpSetting.DownCap = set(t.KCPDownlinkCapacity)
+	kcpSetting.ReadBufferSize = set(t.KCPReadBufferSize)
+	kcpSetting.WriteBufferSize = set(t.KCPWriteBufferSize)
+	return kcpSetting
+}
+
 func getCertFile(certConfig *mylego.CertConfig) (certFile string, keyFile string, err error) {
 	switch certConfig.CertMode {
 	case "file":
@@ -321,6 +375,21 @@ func buildVlessFallbacks(fallbackConfigs []*FallBackConfig) ([]*conf.VLessInboun
 	return vlessFallBacks, nil
 }
 
+// panelFallbacks converts the fallbacks sent by the panel to the local config format
+func panelFallbacks(fallbacks []*api.FallbackConfig) []*FallBackConfig {
+	fallbackConfigs := make([]*FallBackConfig, len(fallbacks))
+	for i, f := range fallbacks {
+		fallbackConfigs[i] = &FallBackConfig{
+			SNI:              f.SNI,
+			Alpn:             f.Alpn,
+			Path:             f.Path,
+			Dest:             f.Dest,
+			ProxyProtocolVer: f.ProxyProtocolVer,
+		}
+	}
+	return fallbackConfigs
+}
+
 func buildTrojanFallbacks(fallbackConfigs []*FallBackConfig) ([]*conf.TrojanInboundFallback, error) {
 	if fallbackConfigs == nil {
 		return nil, fmt.Errorf("you must provide FallBackConfigs")
@@ -1,8 +1,12 @@
 package controller_test
 
 import (
+	"strings"
 	"testing"
 
+	"github.com/xtls/xray-core/app/proxyman"
+	"github.com/xtls/xray-core/transport/internet/kcp"
+
 	"github.com/XrayR-project/XrayR/api"
 	"github.com/XrayR-project/XrayR/common/mylego"
 	. "github.com/XrayR-project/XrayR/service/controller"
@@ -66,6 +70,30 @@ func TestBuildTrojan(t *testing.T) {
 	}
 }
 
+func TestBuildTrojanPanelFallbacks(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "Trojan",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "tcp",
+		Host:              "trojan.test.tk",
+		EnableTLS:         false,
+		Fallbacks:         []*api.FallbackConfig{{Dest: "80"}},
+	}
+	config := &Config{
+		CertConfig: &mylego.CertConfig{CertMode: "none"},
+	}
+	_, err := InboundBuilder(config, nodeInfo, "test_tag")
+	if err != nil {
+		t.Error(err)
+	}
+
+	nodeInfo.Fallbacks = []*api.FallbackConfig{{Path: "/web"}}
+	if _, err := InboundBuilder(config, nodeInfo, "test_tag"); err == nil {
+		t.Error("fallback without dest should fail")
+	}
+}
+
 func TestBuildSS(t *testing.T) {
 	nodeInfo := &api.NodeInfo{
 		NodeType:          "Shadowsocks",
@@ -96,3 +124,85 @@ func TestBuildSS(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestBuildKCPTuning(t *testing.T) {
+	nodeInfo := &api.NodeInfo{
+		NodeType:          "V2ray",
+		NodeID:            1,
+		Port:              1145,
+		TransportProtocol: "kcp",
+		TransportTuning:   &api.TransportTuning{KCPMtu: 1350, KCPTti: 20, KCPUplinkCapacity: 50, TCPWindowClamp: 600},
+		TCPFastOpen:       float64(256),
+	}
+	config := &Config{
+		CertConfig: &mylego.CertConfig{CertMode: "none"},
+	}
+	inbound, err := InboundBuilder(config, nodeInfo, "test_tag")
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := inbound.ReceiverSettings.GetInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := receiver.(*proxyman.ReceiverConfig).StreamSettings
+	if len(stream.TransportSettings) != 1 {
+		t.Fatalf("got %d transport settings, want 1", len(stream.TransportSettings))
+	}
+	settings, err := stream.TransportSettings[0].Settings.GetInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kcpConfig := settings.(*kcp.Config)
+	if kcpConfig.GetMtu().GetValue() != 1350 || kcpConfig.GetTti().GetValue() != 20 || kcpConfig.GetUplinkCapacity().GetValue() != 50 {
+		t.Errorf("got KCP mtu %d, tti %d, uplink %d, want 1350, 20, 50",
+			kcpConfig.GetMtu().GetValue(), kcpConfig.GetTti().GetValue(), kcpConfig.GetUplinkCapacity().GetValue())
+	}
+	// Unset values keep the xray default
+	if kcpConfig.GetDownlinkCapacity() != nil {
+		t.Errorf("got KCP downlink %d, want the default", kcpConfig.GetDownlinkCapacity().GetValue())
+	}
+	if stream.SocketSettings.GetTcpWindowClamp() != 600 || stream.SocketSettings.GetTfo() != 256 {
+		t.Errorf("got TCP window clamp %d, TFO %d, want 600, 256", stream.SocketSettings.GetTcpWindowClamp(), stream.SocketSettings.GetTfo())
+	}
+}
+
+func TestBuildNotRunnable(t *testing.T) {
+	config := &Config{
+		CertConfig: &mylego.CertConfig{CertMode: "none"},
+	}
+	for _, nodeType := range []string{"Hysteria2", "TUIC"} {
+		nodeInfo := &api.NodeInfo{
+			NodeType:          nodeType,
+			NodeID:            1,
+			Port:              443,
+			TransportProtocol: "tcp",
+		}
+		_, err := InboundBuilder(config, nodeInfo, "test_tag")
+		if err == nil || !strings.Contains(err.Error(), "not runnable on this xray-core") {
+			t.Errorf("got %v for %s, want a not runnable error", err, nodeType)
+		}
+	}
+}
+
+func TestBuildREALITYMldsa65(t *testing.T) {
+	config := &Config{
+		CertConfig:                &mylego.CertConfig{CertMode: "none"},
+		DisableLocalREALITYConfig: true,
+		REALITYConfigs:            &REALITYConfig{},
+	}
+	for _, r := range []*api.REALITYConfig{{Mldsa65Seed: "seed"}, {Mldsa65Verify: "verify"}} {
+		nodeInfo := &api.NodeInfo{
+			NodeType:          "Vless",
+			NodeID:            1,
+			Port:              443,
+			TransportProtocol: "tcp",
+			EnableREALITY:     true,
+			REALITYConfig:     r,
+		}
+		_, err := InboundBuilder(config, nodeInfo, "test_tag")
+		if err == nil || !strings.Contains(err.Error(), "mldsa65") {
+			t.Errorf("got %v for %+v, want a mldsa65 error", err, r)
+		}
+	}
+}